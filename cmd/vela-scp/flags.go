@@ -0,0 +1,362 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"github.com/urfave/cli/v3"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+	"github.com/go-vela/vela-openssh/pkg/binarywrapper"
+)
+
+// transferFlags are what is copied and where to.
+func transferFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:     "source",
+			Usage:    "source parameter for scp (see manual 'man scp')",
+			Required: true,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SOURCE"),
+				cli.EnvVar("SOURCE"),
+				cli.File("/vela/parameters/vela-scp/source"),
+				cli.File("/vela/secrets/vela-scp/source"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:     "target",
+			Usage:    "target parameter for scp (see manual 'man scp'), give several to copy the sources to each of them",
+			Required: true,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_TARGET"),
+				cli.EnvVar("TARGET"),
+				cli.File("/vela/parameters/vela-scp/target"),
+				cli.File("/vela/secrets/vela-scp/target"),
+			),
+		},
+	}
+}
+
+// destinationFlags are the remote systems the sources are copied to, given directly or selected from an inventory.
+func destinationFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "destination",
+			Usage: "remote systems to copy the sources to, each combined with the remote path given as the target",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_DESTINATION"),
+				cli.EnvVar("DESTINATION"),
+				cli.File("/vela/parameters/vela-scp/destination"),
+				cli.File("/vela/secrets/vela-scp/destination"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "inventory.contents",
+			Usage: "contents of an ansible-style inventory in the INI or YAML format to select the hosts from",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_INVENTORY_CONTENTS"),
+				cli.EnvVar("INVENTORY_CONTENTS"),
+				cli.File("/vela/parameters/vela-scp/inventory.contents"),
+				cli.File("/vela/secrets/vela-scp/inventory.contents"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "inventory.path",
+			Usage: "path to an ansible-style inventory in the INI or YAML format to select the hosts from",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_INVENTORY_PATH"),
+				cli.EnvVar("INVENTORY_PATH"),
+				cli.File("/vela/parameters/vela-scp/inventory.path"),
+				cli.File("/vela/secrets/vela-scp/inventory.path"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "hosts",
+			Usage: "pattern of groups and hosts to select from the inventory like 'web:&prod:!canary', all of them by default",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_HOSTS"),
+				cli.EnvVar("HOSTS"),
+				cli.File("/vela/parameters/vela-scp/hosts"),
+				cli.File("/vela/secrets/vela-scp/hosts"),
+			),
+		},
+	}
+}
+
+// credentialFlags are how the remote systems are authenticated against.
+func credentialFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "identity-file.path",
+			Usage: "path to the identity file parameter for scp (see manual 'man scp')",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_IDENTITY_FILE_PATH"),
+				cli.EnvVar("IDENTITY_FILE_PATH"),
+				cli.EnvVar("PARAMETER_SSH_KEY_PATH"),
+				cli.EnvVar("SSH_KEY_PATH"),
+				cli.File("/vela/parameters/vela-scp/identity-file.path"),
+				cli.File("/vela/secrets/vela-scp/identity-file.path"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "identity-file.contents",
+			Usage: "contents of the identity-file (not the path, the real deal)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_IDENTITY_FILE_CONTENTS"),
+				cli.EnvVar("IDENTITY_FILE_CONTENTS"),
+				cli.EnvVar("PARAMETER_SSH_KEY"),
+				cli.EnvVar("SSH_KEY"),
+				cli.File("/vela/parameters/vela-scp/identity-file.contents"),
+				cli.File("/vela/secrets/vela-scp/identity-file.contents"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "identities",
+			Usage: "list of identity files as json or yaml, each with its contents and optionally a passphrase, tried in order",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_IDENTITIES"),
+				cli.EnvVar("IDENTITIES"),
+				cli.File("/vela/parameters/vela-scp/identities"),
+				cli.File("/vela/secrets/vela-scp/identities"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "certificate.contents",
+			Usage: "contents of an ssh user certificate paired with the identity file holding its private key",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CERTIFICATE_CONTENTS"),
+				cli.EnvVar("CERTIFICATE_CONTENTS"),
+				cli.File("/vela/parameters/vela-scp/certificate.contents"),
+				cli.File("/vela/secrets/vela-scp/certificate.contents"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "certificate.path",
+			Usage: "paths to ssh user certificates paired with the identity files holding their private keys",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CERTIFICATE_PATH"),
+				cli.EnvVar("CERTIFICATE_PATH"),
+				cli.File("/vela/parameters/vela-scp/certificate.path"),
+				cli.File("/vela/secrets/vela-scp/certificate.path"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "sshpass.password",
+			Usage: "password for use with destination target (used with sshpass)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSHPASS_PASSWORD"),
+				cli.EnvVar("PARAMETER_PASSWORD"),
+				cli.EnvVar("SSHPASS_PASSWORD"),
+				cli.EnvVar("PASSWORD"),
+				cli.File("/vela/parameters/vela-scp/sshpass.password"),
+				cli.File("/vela/secrets/vela-scp/sshpass.password"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "sshpass.passphrase",
+			Usage: "passphrase for use with identity file (decrypted into a built-in ssh-agent)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSHPASS_PASSPHRASE"),
+				cli.EnvVar("SSHPASS_PASSPHRASE"),
+				cli.File("/vela/parameters/vela-scp/sshpass.passphrase"),
+				cli.File("/vela/secrets/vela-scp/sshpass.passphrase"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "passphrase.mode",
+			Usage: "how identity files decrypted with the passphrase are handed to scp, either 'agent' to load them into a built-in ssh-agent or 'file' to write them into restricted files",
+			Value: openssh.PassphraseModeAgent,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_PASSPHRASE_MODE"),
+				cli.EnvVar("PASSPHRASE_MODE"),
+				cli.File("/vela/parameters/vela-scp/passphrase.mode"),
+				cli.File("/vela/secrets/vela-scp/passphrase.mode"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "vault",
+			Usage: "where to have an ephemeral identity signed by the vault ssh secrets engine as JSON or YAML, with the address, mount, role and a token or AppRole",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_VAULT"),
+				cli.EnvVar("VAULT"),
+				cli.File("/vela/parameters/vela-scp/vault"),
+				cli.File("/vela/secrets/vela-scp/vault"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "tmpfs.directory",
+			Usage: "tmpfs directory for files holding secrets when they can't be kept in memory",
+			Value: openssh.DefaultTmpfsDirectory,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_TMPFS_DIRECTORY"),
+				cli.EnvVar("TMPFS_DIRECTORY"),
+				cli.File("/vela/parameters/vela-scp/tmpfs.directory"),
+				cli.File("/vela/secrets/vela-scp/tmpfs.directory"),
+			),
+		},
+	}
+}
+
+// hostKeyFlags are how the host keys of the remote systems are verified.
+func hostKeyFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "known-hosts.contents",
+			Usage: "contents of a known_hosts file to verify host keys against (turns on strict host key checking)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_KNOWN_HOSTS_CONTENTS"),
+				cli.EnvVar("KNOWN_HOSTS_CONTENTS"),
+				cli.File("/vela/parameters/vela-scp/known-hosts.contents"),
+				cli.File("/vela/secrets/vela-scp/known-hosts.contents"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "known-hosts.path",
+			Usage: "path to known_hosts files to verify host keys against (turns on strict host key checking)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_KNOWN_HOSTS_PATH"),
+				cli.EnvVar("KNOWN_HOSTS_PATH"),
+				cli.File("/vela/parameters/vela-scp/known-hosts.path"),
+				cli.File("/vela/secrets/vela-scp/known-hosts.path"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "host-key.fingerprint",
+			Usage: "fingerprints to pin the host keys to, as printed by ssh-keygen -l (turns on strict host key checking)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_HOST_KEY_FINGERPRINT"),
+				cli.EnvVar("HOST_KEY_FINGERPRINT"),
+				cli.File("/vela/parameters/vela-scp/host-key.fingerprint"),
+				cli.File("/vela/secrets/vela-scp/host-key.fingerprint"),
+			),
+		},
+	}
+}
+
+// connectionFlags are how the remote systems are connected to.
+func connectionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "ssh-config",
+			Usage: "map of ssh_config options like port, user and ciphers as JSON or YAML (see manual 'man ssh_config')",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSH_CONFIG"),
+				cli.EnvVar("SSH_CONFIG"),
+				cli.File("/vela/parameters/vela-scp/ssh-config"),
+				cli.File("/vela/secrets/vela-scp/ssh-config"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "jump-hosts",
+			Usage: "list of jump hosts to hop through as JSON or YAML, each with a destination, port, identity file contents and known hosts",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_JUMP_HOSTS"),
+				cli.EnvVar("JUMP_HOSTS"),
+				cli.File("/vela/parameters/vela-scp/jump-hosts"),
+				cli.File("/vela/secrets/vela-scp/jump-hosts"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "backend",
+			Usage: "how to copy files, either 'openssh' to use the scp binary or 'native' to copy in process over sftp",
+			Value: openssh.BackendOpenSSH,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_BACKEND"),
+				cli.EnvVar("BACKEND"),
+				cli.File("/vela/parameters/vela-scp/backend"),
+				cli.File("/vela/secrets/vela-scp/backend"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "scp.flag",
+			Usage: "any additional flags for scp can be specified here",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SCP_FLAG"),
+				cli.EnvVar("SCP_FLAG"),
+				cli.File("/vela/parameters/vela-scp/scp.flag"),
+				cli.File("/vela/secrets/vela-scp/scp.flag"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "sshpass.flag",
+			Usage: "any additional flags for sshpass can be specified here)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSHPASS_FLAG"),
+				cli.EnvVar("SSHPASS_FLAG"),
+				cli.File("/vela/parameters/vela-scp/sshpass.flag"),
+				cli.File("/vela/secrets/vela-scp/sshpass.flag"),
+			),
+		},
+	}
+}
+
+// rolloutFlags are how the copy is rolled out across several targets.
+func rolloutFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "parallelism",
+			Usage: "how many targets the sources are copied to at once, all of them by default",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_PARALLELISM"),
+				cli.EnvVar("PARALLELISM"),
+				cli.File("/vela/parameters/vela-scp/parallelism"),
+				cli.File("/vela/secrets/vela-scp/parallelism"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "max-failures",
+			Usage: "how many targets the copy can fail for before the plugin fails, as a count like 2 or a percentage like 10%",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_MAX_FAILURES"),
+				cli.EnvVar("MAX_FAILURES"),
+				cli.File("/vela/parameters/vela-scp/max-failures"),
+				cli.File("/vela/secrets/vela-scp/max-failures"),
+			),
+		},
+		&cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "stop copying to the rest of the targets once the copy has failed for more of them than max-failures allows",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_FAIL_FAST"),
+				cli.EnvVar("FAIL_FAST"),
+				cli.File("/vela/parameters/vela-scp/fail-fast"),
+				cli.File("/vela/secrets/vela-scp/fail-fast"),
+			),
+		},
+	}
+}
+
+// pluginFlags are how the plugin itself runs.
+func pluginFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "maximum amount of time scp is allowed to run before being terminated (e.g. 10m)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_TIMEOUT"),
+				cli.EnvVar("TIMEOUT"),
+				cli.File("/vela/parameters/vela-scp/timeout"),
+				cli.File("/vela/secrets/vela-scp/timeout"),
+			),
+		},
+		&cli.DurationFlag{
+			Name:  "kill.grace-period",
+			Usage: "how long scp has to exit after being asked to terminate before it is killed",
+			Value: binarywrapper.DefaultKillGracePeriod,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_KILL_GRACE_PERIOD"),
+				cli.EnvVar("KILL_GRACE_PERIOD"),
+				cli.File("/vela/parameters/vela-scp/kill.grace-period"),
+				cli.File("/vela/secrets/vela-scp/kill.grace-period"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "ci",
+			Usage: "set the CI environment (if $CI is set output tries to be friendlier)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CI"),
+				cli.EnvVar("CI"),
+			),
+		},
+	}
+}
@@ -0,0 +1,426 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package main
+
+import (
+	"github.com/urfave/cli/v3"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+	"github.com/go-vela/vela-openssh/internal/ssh"
+	"github.com/go-vela/vela-openssh/pkg/binarywrapper"
+)
+
+// destinationFlags are where the command is executed, given directly or selected from an inventory.
+func destinationFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "destination",
+			Usage: "destination parameter for ssh (see manual 'man ssh'), give several to execute the command on each of them",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_DESTINATION"),
+				cli.EnvVar("DESTINATION"),
+				cli.EnvVar("PARAMETER_HOST"),
+				cli.File("/vela/parameters/vela-ssh/destination"),
+				cli.File("/vela/secrets/vela-ssh/destination"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "inventory.contents",
+			Usage: "contents of an ansible-style inventory in the INI or YAML format to select the hosts from",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_INVENTORY_CONTENTS"),
+				cli.EnvVar("INVENTORY_CONTENTS"),
+				cli.File("/vela/parameters/vela-ssh/inventory.contents"),
+				cli.File("/vela/secrets/vela-ssh/inventory.contents"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "inventory.path",
+			Usage: "path to an ansible-style inventory in the INI or YAML format to select the hosts from",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_INVENTORY_PATH"),
+				cli.EnvVar("INVENTORY_PATH"),
+				cli.File("/vela/parameters/vela-ssh/inventory.path"),
+				cli.File("/vela/secrets/vela-ssh/inventory.path"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "hosts",
+			Usage: "pattern of groups and hosts to select from the inventory like 'web:&prod:!canary', all of them by default",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_HOSTS"),
+				cli.EnvVar("HOSTS"),
+				cli.File("/vela/parameters/vela-ssh/hosts"),
+				cli.File("/vela/secrets/vela-ssh/hosts"),
+			),
+		},
+	}
+}
+
+// commandFlags are what is executed on the destinations and how.
+func commandFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "command",
+			Usage: "command to execute on remote system",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_COMMAND"),
+				cli.EnvVar("COMMAND"),
+				cli.EnvVar("PARAMETER_SCRIPT"),
+				cli.EnvVar("SCRIPT"),
+				cli.File("/vela/parameters/vela-ssh/command"),
+				cli.File("/vela/secrets/vela-ssh/command"),
+			),
+			Required: true,
+		},
+		&cli.StringFlag{
+			Name:  "command.mode",
+			Usage: "how the commands are run, either 'join' to join them with &&, 'script' to send them to the interpreter as a script or 'steps' to report on each one",
+			Value: ssh.CommandModeJoin,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_COMMAND_MODE"),
+				cli.EnvVar("COMMAND_MODE"),
+				cli.File("/vela/parameters/vela-ssh/command.mode"),
+				cli.File("/vela/secrets/vela-ssh/command.mode"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "interpreter",
+			Usage: "remote command the script is sent to over stdin in the script command mode",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_INTERPRETER"),
+				cli.EnvVar("INTERPRETER"),
+				cli.File("/vela/parameters/vela-ssh/interpreter"),
+				cli.File("/vela/secrets/vela-ssh/interpreter"),
+			),
+		},
+		&cli.BoolFlag{
+			Name:  "continue-on-error",
+			Usage: "keep running the rest of the commands in the steps command mode when one fails, failing at the end instead",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CONTINUE_ON_ERROR"),
+				cli.EnvVar("CONTINUE_ON_ERROR"),
+				cli.File("/vela/parameters/vela-ssh/continue-on-error"),
+				cli.File("/vela/secrets/vela-ssh/continue-on-error"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "env",
+			Usage: "map of environmental variables as JSON or YAML that are sent over stdin and exported before the commands run",
+			// There's no plain ENV source since sh reads a startup file from it.
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_ENV"),
+				cli.File("/vela/parameters/vela-ssh/env"),
+				cli.File("/vela/secrets/vela-ssh/env"),
+			),
+		},
+	}
+}
+
+// credentialFlags are how the destinations are authenticated against.
+func credentialFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringSliceFlag{
+			Name:  "identity-file.path",
+			Usage: "path to the identity file parameter for scp (see manual 'man scp')",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_IDENTITY_FILE_PATH"),
+				cli.EnvVar("IDENTITY_FILE_PATH"),
+				cli.EnvVar("PARAMETER_SSH_KEY_PATH"),
+				cli.EnvVar("SSH_KEY_PATH"),
+				cli.File("/vela/parameters/vela-ssh/identity-file.path"),
+				cli.File("/vela/secrets/vela-ssh/identity-file.path"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "identity-file.contents",
+			Usage: "contents of the identity-file (not the path, the real deal)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_IDENTITY_FILE_CONTENTS"),
+				cli.EnvVar("IDENTITY_FILE_CONTENTS"),
+				cli.EnvVar("PARAMETER_SSH_KEY"),
+				cli.EnvVar("SSH_KEY"),
+				cli.File("/vela/parameters/vela-ssh/identity-file.contents"),
+				cli.File("/vela/secrets/vela-ssh/identity-file.contents"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "identities",
+			Usage: "list of identity files as json or yaml, each with its contents and optionally a passphrase, tried in order",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_IDENTITIES"),
+				cli.EnvVar("IDENTITIES"),
+				cli.File("/vela/parameters/vela-ssh/identities"),
+				cli.File("/vela/secrets/vela-ssh/identities"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "certificate.contents",
+			Usage: "contents of an ssh user certificate paired with the identity file holding its private key",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CERTIFICATE_CONTENTS"),
+				cli.EnvVar("CERTIFICATE_CONTENTS"),
+				cli.File("/vela/parameters/vela-ssh/certificate.contents"),
+				cli.File("/vela/secrets/vela-ssh/certificate.contents"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "certificate.path",
+			Usage: "paths to ssh user certificates paired with the identity files holding their private keys",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CERTIFICATE_PATH"),
+				cli.EnvVar("CERTIFICATE_PATH"),
+				cli.File("/vela/parameters/vela-ssh/certificate.path"),
+				cli.File("/vela/secrets/vela-ssh/certificate.path"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "sshpass.password",
+			Usage: "password for use with destination target (used with sshpass)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSHPASS_PASSWORD"),
+				cli.EnvVar("PARAMETER_PASSWORD"),
+				cli.EnvVar("SSHPASS_PASSWORD"),
+				cli.EnvVar("PASSWORD"),
+				cli.File("/vela/parameters/vela-ssh/sshpass.password"),
+				cli.File("/vela/secrets/vela-ssh/sshpass.password"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "sshpass.passphrase",
+			Usage: "passphrase for use with identity file (decrypted into a built-in ssh-agent)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSHPASS_PASSPHRASE"),
+				cli.EnvVar("SSHPASS_PASSPHRASE"),
+				cli.File("/vela/parameters/vela-ssh/sshpass.passphrase"),
+				cli.File("/vela/secrets/vela-ssh/sshpass.passphrase"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "passphrase.mode",
+			Usage: "how identity files decrypted with the passphrase are handed to ssh, either 'agent' to load them into a built-in ssh-agent or 'file' to write them into restricted files",
+			Value: openssh.PassphraseModeAgent,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_PASSPHRASE_MODE"),
+				cli.EnvVar("PASSPHRASE_MODE"),
+				cli.File("/vela/parameters/vela-ssh/passphrase.mode"),
+				cli.File("/vela/secrets/vela-ssh/passphrase.mode"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "vault",
+			Usage: "where to have an ephemeral identity signed by the vault ssh secrets engine as JSON or YAML, with the address, mount, role and a token or AppRole",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_VAULT"),
+				cli.EnvVar("VAULT"),
+				cli.File("/vela/parameters/vela-ssh/vault"),
+				cli.File("/vela/secrets/vela-ssh/vault"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "tmpfs.directory",
+			Usage: "tmpfs directory for files holding secrets when they can't be kept in memory",
+			Value: openssh.DefaultTmpfsDirectory,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_TMPFS_DIRECTORY"),
+				cli.EnvVar("TMPFS_DIRECTORY"),
+				cli.File("/vela/parameters/vela-ssh/tmpfs.directory"),
+				cli.File("/vela/secrets/vela-ssh/tmpfs.directory"),
+			),
+		},
+	}
+}
+
+// hostKeyFlags are how the host keys of the destinations are verified.
+func hostKeyFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "known-hosts.contents",
+			Usage: "contents of a known_hosts file to verify host keys against (turns on strict host key checking)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_KNOWN_HOSTS_CONTENTS"),
+				cli.EnvVar("KNOWN_HOSTS_CONTENTS"),
+				cli.File("/vela/parameters/vela-ssh/known-hosts.contents"),
+				cli.File("/vela/secrets/vela-ssh/known-hosts.contents"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "known-hosts.path",
+			Usage: "path to known_hosts files to verify host keys against (turns on strict host key checking)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_KNOWN_HOSTS_PATH"),
+				cli.EnvVar("KNOWN_HOSTS_PATH"),
+				cli.File("/vela/parameters/vela-ssh/known-hosts.path"),
+				cli.File("/vela/secrets/vela-ssh/known-hosts.path"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "host-key.fingerprint",
+			Usage: "fingerprints to pin the host keys to, as printed by ssh-keygen -l (turns on strict host key checking)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_HOST_KEY_FINGERPRINT"),
+				cli.EnvVar("HOST_KEY_FINGERPRINT"),
+				cli.File("/vela/parameters/vela-ssh/host-key.fingerprint"),
+				cli.File("/vela/secrets/vela-ssh/host-key.fingerprint"),
+			),
+		},
+	}
+}
+
+// connectionFlags are how the destinations are connected to.
+func connectionFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.StringFlag{
+			Name:  "ssh-config",
+			Usage: "map of ssh_config options like port, user and ciphers as JSON or YAML (see manual 'man ssh_config')",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSH_CONFIG"),
+				cli.EnvVar("SSH_CONFIG"),
+				cli.File("/vela/parameters/vela-ssh/ssh-config"),
+				cli.File("/vela/secrets/vela-ssh/ssh-config"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "jump-hosts",
+			Usage: "list of jump hosts to hop through as JSON or YAML, each with a destination, port, identity file contents and known hosts",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_JUMP_HOSTS"),
+				cli.EnvVar("JUMP_HOSTS"),
+				cli.File("/vela/parameters/vela-ssh/jump-hosts"),
+				cli.File("/vela/secrets/vela-ssh/jump-hosts"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "backend",
+			Usage: "how to connect to the destination, either 'openssh' to use the ssh binary or 'native' to connect in process",
+			Value: openssh.BackendOpenSSH,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_BACKEND"),
+				cli.EnvVar("BACKEND"),
+				cli.File("/vela/parameters/vela-ssh/backend"),
+				cli.File("/vela/secrets/vela-ssh/backend"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "ssh.flag",
+			Usage: "any additional flags for ssh can be specified here",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSH_FLAG"),
+				cli.EnvVar("SSH_FLAG"),
+				cli.File("/vela/parameters/vela-ssh/ssh.flag"),
+				cli.File("/vela/secrets/vela-ssh/ssh.flag"),
+			),
+		},
+		&cli.StringSliceFlag{
+			Name:  "sshpass.flag",
+			Usage: "any additional flags for sshpass can be specified here)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_SSHPASS_FLAG"),
+				cli.EnvVar("SSHPASS_FLAG"),
+				cli.File("/vela/parameters/vela-ssh/sshpass.flag"),
+				cli.File("/vela/secrets/vela-ssh/sshpass.flag"),
+			),
+		},
+	}
+}
+
+// rolloutFlags are how the command is rolled out across several destinations.
+func rolloutFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.IntFlag{
+			Name:  "parallelism",
+			Usage: "how many destinations the command is executed on at once, all of them by default",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_PARALLELISM"),
+				cli.EnvVar("PARALLELISM"),
+				cli.File("/vela/parameters/vela-ssh/parallelism"),
+				cli.File("/vela/secrets/vela-ssh/parallelism"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "max-failures",
+			Usage: "how many destinations the command can fail on before the plugin fails, as a count like 2 or a percentage like 10%",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_MAX_FAILURES"),
+				cli.EnvVar("MAX_FAILURES"),
+				cli.File("/vela/parameters/vela-ssh/max-failures"),
+				cli.File("/vela/secrets/vela-ssh/max-failures"),
+			),
+		},
+		&cli.BoolFlag{
+			Name:  "fail-fast",
+			Usage: "stop executing the command on the rest of the destinations once it has failed on more of them than max-failures allows",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_FAIL_FAST"),
+				cli.EnvVar("FAIL_FAST"),
+				cli.File("/vela/parameters/vela-ssh/fail-fast"),
+				cli.File("/vela/secrets/vela-ssh/fail-fast"),
+			),
+		},
+		&cli.BoolFlag{
+			Name:  "canary",
+			Usage: "execute the command on the first destination on its own before the rest, stopping there if it fails",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CANARY"),
+				cli.EnvVar("CANARY"),
+				cli.File("/vela/parameters/vela-ssh/canary"),
+				cli.File("/vela/secrets/vela-ssh/canary"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "batch-size",
+			Usage: "roll the command out to the destinations in batches of this many, as a count like 2 or a percentage like 25%",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_BATCH_SIZE"),
+				cli.EnvVar("BATCH_SIZE"),
+				cli.File("/vela/parameters/vela-ssh/batch-size"),
+				cli.File("/vela/secrets/vela-ssh/batch-size"),
+			),
+		},
+		&cli.DurationFlag{
+			Name:  "batch-pause",
+			Usage: "how long to wait between the batches of a rollout (e.g. 30s)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_BATCH_PAUSE"),
+				cli.EnvVar("BATCH_PAUSE"),
+				cli.File("/vela/parameters/vela-ssh/batch-pause"),
+				cli.File("/vela/secrets/vela-ssh/batch-pause"),
+			),
+		},
+	}
+}
+
+// pluginFlags are how the plugin itself runs.
+func pluginFlags() []cli.Flag {
+	return []cli.Flag{
+		&cli.DurationFlag{
+			Name:  "timeout",
+			Usage: "maximum amount of time ssh is allowed to run before being terminated (e.g. 10m)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_TIMEOUT"),
+				cli.EnvVar("TIMEOUT"),
+				cli.File("/vela/parameters/vela-ssh/timeout"),
+				cli.File("/vela/secrets/vela-ssh/timeout"),
+			),
+		},
+		&cli.DurationFlag{
+			Name:  "kill.grace-period",
+			Usage: "how long ssh has to exit after being asked to terminate before it is killed",
+			Value: binarywrapper.DefaultKillGracePeriod,
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_KILL_GRACE_PERIOD"),
+				cli.EnvVar("KILL_GRACE_PERIOD"),
+				cli.File("/vela/parameters/vela-ssh/kill.grace-period"),
+				cli.File("/vela/secrets/vela-ssh/kill.grace-period"),
+			),
+		},
+		&cli.StringFlag{
+			Name:  "ci",
+			Usage: "set the CI environment (if $CI is set output tries to be friendlier)",
+			Sources: cli.NewValueSourceChain(
+				cli.EnvVar("PARAMETER_CI"),
+				cli.EnvVar("CI"),
+			),
+		},
+	}
+}
@@ -7,10 +7,12 @@ import (
 	"fmt"
 	"net/mail"
 	"os"
+	"slices"
 
 	"github.com/sirupsen/logrus"
 	"github.com/urfave/cli/v3"
 
+	"github.com/go-vela/vela-openssh/internal/auth"
 	"github.com/go-vela/vela-openssh/internal/openssh"
 	"github.com/go-vela/vela-openssh/internal/ssh"
 	"github.com/go-vela/vela-openssh/pkg/binarywrapper"
@@ -34,114 +36,25 @@ func main() {
 		Action:  run,
 	}
 
-	cmd.Flags = []cli.Flag{
-		&cli.StringFlag{
-			Name:  "destination",
-			Usage: "destination parameter for ssh (see manual 'man ssh')",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_DESTINATION"),
-				cli.EnvVar("DESTINATION"),
-				cli.EnvVar("PARAMETER_HOST"),
-				cli.File("/vela/parameters/vela-ssh/destination"),
-				cli.File("/vela/secrets/vela-ssh/destination"),
-			),
-			Required: true,
-		},
-		&cli.StringSliceFlag{
-			Name:  "command",
-			Usage: "command to execute on remote system",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_COMMAND"),
-				cli.EnvVar("COMMAND"),
-				cli.EnvVar("PARAMETER_SCRIPT"),
-				cli.EnvVar("SCRIPT"),
-				cli.File("/vela/parameters/vela-ssh/command"),
-				cli.File("/vela/secrets/vela-ssh/command"),
-			),
-			Required: true,
-		},
-		&cli.StringSliceFlag{
-			Name:  "identity-file.path",
-			Usage: "path to the identity file parameter for scp (see manual 'man scp')",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_IDENTITY_FILE_PATH"),
-				cli.EnvVar("IDENTITY_FILE_PATH"),
-				cli.EnvVar("PARAMETER_SSH_KEY_PATH"),
-				cli.EnvVar("SSH_KEY_PATH"),
-				cli.File("/vela/parameters/vela-ssh/identity-file.path"),
-				cli.File("/vela/secrets/vela-ssh/identity-file.path"),
-			),
-		},
-		&cli.StringFlag{
-			Name:  "identity-file.contents",
-			Usage: "contents of the identity-file (not the path, the real deal)",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_IDENTITY_FILE_CONTENTS"),
-				cli.EnvVar("IDENTITY_FILE_CONTENTS"),
-				cli.EnvVar("PARAMETER_SSH_KEY"),
-				cli.EnvVar("SSH_KEY"),
-				cli.File("/vela/parameters/vela-ssh/identity-file.contents"),
-				cli.File("/vela/secrets/vela-ssh/identity-file.contents"),
-			),
-		},
-		&cli.StringSliceFlag{
-			Name:  "ssh.flag",
-			Usage: "any additional flags for ssh can be specified here",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_SSH_FLAG"),
-				cli.EnvVar("SSH_FLAG"),
-				cli.File("/vela/parameters/vela-ssh/ssh.flag"),
-				cli.File("/vela/secrets/vela-ssh/ssh.flag"),
-			),
-		},
-		&cli.StringFlag{
-			Name:  "sshpass.password",
-			Usage: "password for use with destination target (used with sshpass)",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_SSHPASS_PASSWORD"),
-				cli.EnvVar("PARAMETER_PASSWORD"),
-				cli.EnvVar("SSHPASS_PASSWORD"),
-				cli.EnvVar("PASSWORD"),
-				cli.File("/vela/parameters/vela-ssh/sshpass.password"),
-				cli.File("/vela/secrets/vela-ssh/sshpass.password"),
-			),
-		},
-		&cli.StringFlag{
-			Name:  "sshpass.passphrase",
-			Usage: "passphrase for use with identity file (used with sshpass)",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_SSHPASS_PASSPHRASE"),
-				cli.EnvVar("SSHPASS_PASSPHRASE"),
-				cli.File("/vela/parameters/vela-ssh/sshpass.passphrase"),
-				cli.File("/vela/secrets/vela-ssh/sshpass.passphrase"),
-			),
-		},
-		&cli.StringSliceFlag{
-			Name:  "sshpass.flag",
-			Usage: "any additional flags for sshpass can be specified here)",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_SSHPASS_FLAG"),
-				cli.EnvVar("SSHPASS_FLAG"),
-				cli.File("/vela/parameters/vela-ssh/sshpass.flag"),
-				cli.File("/vela/secrets/vela-ssh/sshpass.flag"),
-			),
-		},
-		&cli.StringFlag{
-			Name:  "ci",
-			Usage: "set the CI environment (if $CI is set output tries to be friendlier)",
-			Sources: cli.NewValueSourceChain(
-				cli.EnvVar("PARAMETER_CI"),
-				cli.EnvVar("CI"),
-			),
-		},
-	}
+	cmd.Flags = slices.Concat(
+		destinationFlags(),
+		commandFlags(),
+		credentialFlags(),
+		hostKeyFlags(),
+		connectionFlags(),
+		rolloutFlags(),
+		pluginFlags(),
+	)
 
+	// Exiting with the same code as the binary lets pipelines tell apart
+	// a failing remote command, authentication failures and sshpass errors.
 	if err := cmd.Run(context.Background(), os.Args); err != nil {
-		logrus.Fatal(err)
+		logrus.Error(err)
+		os.Exit(binarywrapper.ExitCode(err))
 	}
 }
 
-func run(_ context.Context, c *cli.Command) error {
+func run(ctx context.Context, c *cli.Command) error {
 	if c.IsSet("ci") {
 		logrus.SetFormatter(&logrus.TextFormatter{
 			DisableColors: true,
@@ -169,19 +82,67 @@ func run(_ context.Context, c *cli.Command) error {
 		"version-sshpass": openssh.SSHPassVersion,
 	}).Info("Vela SSH Plugin")
 
+	maxFailures, err := binarywrapper.ParseThreshold(c.String("max-failures"))
+	if err != nil {
+		return fmt.Errorf("%w: max_failures: %w", binarywrapper.ErrValidation, err)
+	}
+
+	batchSize, err := binarywrapper.ParseThreshold(c.String("batch-size"))
+	if err != nil {
+		return fmt.Errorf("%w: batch_size: %w", binarywrapper.ErrValidation, err)
+	}
+
+	// The plugin supervises the binary rather than being replaced by it so that
+	// timeouts can be enforced and the temporary files holding secrets are
+	// removed once the binary finishes, even if the step is canceled.
 	bp := binarywrapper.Plugin{
+		ExecStyle:       binarywrapper.Supervised,
+		Timeout:         c.Duration("timeout"),
+		KillGracePeriod: c.Duration("kill.grace-period"),
+		Parallelism:     c.Int("parallelism"),
+		MaxFailures:     maxFailures,
+		FailFast:        c.Bool("fail-fast"),
+		Canary:          c.Bool("canary"),
+		BatchSize:       batchSize,
+		BatchPause:      c.Duration("batch-pause"),
 		PluginConfig: &ssh.Config{
-			Destination:          c.String("destination"),
-			Command:              c.StringSlice("command"),
-			IdentityFilePath:     c.StringSlice("identity-file.path"),
-			IdentityFileContents: c.String("identity-file.contents"),
-			SSHFlags:             c.StringSlice("ssh.flag"),
-			SSHPassword:          c.String("sshpass.password"),
-			SSHPassphrase:        c.String("sshpass.passphrase"),
-			SSHPASSFlags:         c.StringSlice("sshpass.flag"),
+			Destinations:      c.StringSlice("destination"),
+			InventoryContents: c.String("inventory.contents"),
+			InventoryPath:     c.String("inventory.path"),
+			Hosts:             c.String("hosts"),
+			Command:           c.StringSlice("command"),
+			CommandMode:       c.String("command.mode"),
+			Interpreter:       c.String("interpreter"),
+			ContinueOnError:   c.Bool("continue-on-error"),
+			Env:               c.String("env"),
+			SSHFlags:          c.StringSlice("ssh.flag"),
+			SSHPASSFlags:      c.StringSlice("sshpass.flag"),
+			Backend:           c.String("backend"),
+			Credentials: auth.Credentials{
+				IdentityFilePath:     c.StringSlice("identity-file.path"),
+				IdentityFileContents: c.String("identity-file.contents"),
+				Identities:           c.String("identities"),
+				CertificateContents:  c.String("certificate.contents"),
+				CertificatePath:      c.StringSlice("certificate.path"),
+				SSHPassword:          c.String("sshpass.password"),
+				SSHPassphrase:        c.String("sshpass.passphrase"),
+				PassphraseMode:       c.String("passphrase.mode"),
+				KnownHostsContents:   c.String("known-hosts.contents"),
+				KnownHostsPath:       c.StringSlice("known-hosts.path"),
+				HostKeyFingerprint:   c.StringSlice("host-key.fingerprint"),
+				SSHConfig:            c.String("ssh-config"),
+				JumpHosts:            c.String("jump-hosts"),
+				Vault:                c.String("vault"),
+				TmpfsDirectory:       c.String("tmpfs.directory"),
+			},
 		},
 	}
 
-	//nolint:contextcheck // we are not using a context here
-	return bp.Exec()
+	// The native backend doesn't need a binary at all, the
+	// plugin connects to the destination all by itself.
+	if c.String("backend") == openssh.BackendNative {
+		bp.ExecStyle = binarywrapper.InProcess
+	}
+
+	return bp.Exec(ctx)
 }
@@ -3,12 +3,16 @@ module github.com/go-vela/vela-openssh
 go 1.24.5
 
 require (
+	github.com/pkg/sftp v1.13.10
 	github.com/sirupsen/logrus v1.9.3
 	github.com/spf13/afero v1.14.0
 	github.com/urfave/cli/v3 v3.3.8
+	golang.org/x/crypto v0.45.0
+	golang.org/x/sys v0.38.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
-	golang.org/x/sys v0.29.0 // indirect
-	golang.org/x/text v0.23.0 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	golang.org/x/text v0.31.0 // indirect
 )
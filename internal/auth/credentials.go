@@ -0,0 +1,706 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package auth holds the credentials the plugins authenticate against remote systems and verify
+// their host keys with, which are handed to the OpenSSH binaries as files or used to connect
+// in process with the native backend.
+package auth
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+
+	"github.com/go-vela/vela-openssh/internal/native"
+	"github.com/go-vela/vela-openssh/internal/openssh"
+	"github.com/go-vela/vela-openssh/internal/vault"
+)
+
+// Credentials holds how the plugins authenticate against remote systems and verify their
+// host keys, which is the same whether they're executing commands or copying files. It's
+// embedded in the config of each plugin, which validates and sets it up along with the
+// rest of its parameters, then either hands the files Setup created to the binaries
+// or connects natively with them instead.
+type Credentials struct {
+	// IdentityFilePath is the path to the identity file to use
+	// for authenticating against remote systems. You can specify
+	// multiple files to use each one in turn if needed.
+	IdentityFilePath []string
+
+	// IdentityFileContents is a string representation of an identity
+	// file. This is used since the plugin needs to consume secrets
+	// and those sometimes come through as environmental variables
+	// so we'll need to take the raw contents and place them into a file
+	// so that the binaries later can use them.
+	IdentityFileContents string
+
+	// Identities is a list of identity files given as JSON or YAML, each with its contents and
+	// optionally a passphrase, for when remote systems each trust a different key. They're
+	// written to files of their own and tried in order after the identity file contents, with
+	// the passphrase of each one falling back to SSHPassphrase when it doesn't have its own.
+	Identities string
+
+	// CertificateContents is the raw contents of an SSH user certificate, paired with the
+	// identity file holding its private key, and CertificatePath are paths to certificates.
+	// They're passed to the binary with CertificateFile after checking they haven't expired.
+	CertificateContents string
+	CertificatePath     []string
+
+	// SSHPassword is used for authenticating against systems with a password
+	// instead of an identity file. Since this is passed to sshpass it's
+	// limited to only one password for whatever remote systems are in use.
+	// Prefer to use identity files if possible since you can specify quite a bit more.
+	SSHPassword string
+
+	// SSHPassphrase is used for the identity files specified. Rather than being handed off
+	// to sshpass, the identity files are decrypted with it by the plugin and loaded into a
+	// private agent that the binary authenticates with, so there's no prompt to answer.
+	// Identity files that aren't encrypted are loaded into the agent along with them.
+	SSHPassphrase string
+
+	// PassphraseMode picks how the identity files decrypted with their passphrases are handed
+	// to the binary, either loaded into a private agent (the default) or written unencrypted
+	// into restricted temporary files, for images or binaries where an agent can't be used.
+	PassphraseMode string
+
+	// KnownHostsContents is the contents of a known_hosts file to verify host keys against.
+	// Setting this, KnownHostsPath or HostKeyFingerprint turns on strict host key
+	// checking in place of the default flags which accept any host key.
+	KnownHostsContents string
+
+	// KnownHostsPath are paths to known_hosts files to verify host keys against.
+	KnownHostsPath []string
+
+	// HostKeyFingerprint pins the host keys of remote systems to any of these fingerprints,
+	// given in the SHA256:... form printed by ssh-keygen -l.
+	HostKeyFingerprint []string
+
+	// SSHConfig is a map of options from the ssh_config manual given as JSON or YAML,
+	// such as the port, user and ciphers. They're rendered into an ssh_config file that's
+	// generated for each run and passed to the binary with -F, leaving the default flags
+	// in place, or applied directly by the native backend.
+	SSHConfig string
+
+	// JumpHosts is a list of jump hosts given as JSON or YAML, which are hopped through in
+	// order on the way to remote systems. Each has a destination and optionally a port, its
+	// own identity file contents and known hosts, and they're rendered into the ssh_config
+	// file with ProxyJump so that their credentials never appear on the command line.
+	JumpHosts string
+
+	// Vault is where to have an ephemeral identity signed for each run given as JSON or YAML,
+	// with the address, mount and role of the SSH secrets engine and a token or AppRole to log
+	// in with. The identity is generated in memory and used with the signed certificate in
+	// place of the identity file and certificate contents, so no long-lived key is needed.
+	Vault string
+
+	// TmpfsDirectory is where files holding secrets, like identity files and passwords, are
+	// placed when they can't be kept in memory with memfd_create. It should be a tmpfs mount,
+	// otherwise the secret files fall back to TempFileDirectory with a warning.
+	TmpfsDirectory string
+
+	// Internal flags & data
+	locationPasswordFile   string
+	locationSSHConfigFile  string
+	locationKnownHostsFile string
+	temporaryFiles         []string
+	hostKeyFlags           []string
+	sshConfig              openssh.SSHConfig
+	jumpHosts              []openssh.JumpHost
+	agent                  *native.Agent
+	certificateFiles       []string
+	vault                  *openssh.VaultConfig
+	identities             []openssh.IdentityEntry
+	secretFiles            openssh.SecretFiles
+}
+
+// Validate parses the credentials and checks they don't conflict with each other, normalizing
+// the identity file contents along the way and logging what each of them and the certificates hold.
+func (c *Credentials) Validate(fs afero.Fs) error {
+	if len(c.SSHPassword) > 0 && len(c.SSHPassphrase) > 0 {
+		return openssh.ErrAmbiguousAuth
+	}
+
+	if err := openssh.ValidatePassphraseMode(c.PassphraseMode); err != nil {
+		return err
+	}
+
+	if err := c.HostKeys().Validate(); err != nil {
+		return err
+	}
+
+	sshConfig, err := openssh.ParseSSHConfig(c.SSHConfig)
+	if err != nil {
+		return err
+	}
+
+	c.sshConfig = sshConfig
+
+	jumpHosts, err := openssh.ParseJumpHosts(c.JumpHosts)
+	if err != nil {
+		return err
+	}
+
+	c.jumpHosts = jumpHosts
+
+	vaultConfig, err := openssh.ParseVault(c.Vault)
+	if err != nil {
+		return err
+	}
+
+	identities, err := openssh.ParseIdentities(c.Identities)
+	if err != nil {
+		return err
+	}
+
+	if vaultConfig != nil && (c.IdentityFileContents != "" || len(identities) > 0 || c.CertificateContents != "") {
+		return openssh.ErrAmbiguousIdentity
+	}
+
+	c.vault = vaultConfig
+
+	if c.IdentityFileContents != "" {
+		c.IdentityFileContents, err = parseIdentity(c.IdentityFileContents, c.SSHPassphrase, "identity file contents")
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, identity := range identities {
+		if identity.Passphrase == "" {
+			identities[i].Passphrase = c.SSHPassphrase
+		}
+
+		identities[i].Contents, err = parseIdentity(identity.Contents, identities[i].Passphrase, fmt.Sprintf("identity #%d", i+1))
+		if err != nil {
+			return fmt.Errorf("%w #%d: %w", openssh.ErrInvalidIdentities, i+1, err)
+		}
+	}
+
+	c.identities = identities
+
+	for i, jumpHost := range c.jumpHosts {
+		if jumpHost.IdentityFileContents == "" {
+			continue
+		}
+
+		c.jumpHosts[i].IdentityFileContents, err = parseIdentity(jumpHost.IdentityFileContents, c.SSHPassphrase,
+			fmt.Sprintf("identity file contents for jump host #%d", i+1))
+		if err != nil {
+			return fmt.Errorf("%w #%d: %w", openssh.ErrInvalidJumpHost, i+1, err)
+		}
+	}
+
+	certificates, err := c.nativeAuth().Certificates(fs)
+	if err != nil {
+		return err
+	}
+
+	for _, certificate := range certificates {
+		logrus.WithFields(native.CertificateFields(certificate)).Info("using certificate")
+	}
+
+	return nil
+}
+
+// parseIdentity normalizes identity file contents, converting them to the OpenSSH format if
+// they're in another, and logs what they hold along with any repairs that had to be made.
+func parseIdentity(contents, passphrase, description string) (string, error) {
+	identity, err := openssh.ParseIdentity(contents, passphrase)
+	if err != nil {
+		return "", err
+	}
+
+	for _, fix := range identity.Fixes {
+		logrus.Warnf("fixed %s: %s", description, fix)
+	}
+
+	if identity.Format != openssh.FormatOpenSSH {
+		logrus.Infof("converted %s from %s to the OpenSSH format", description, identity.Format)
+	}
+
+	logrus.WithFields(logrus.Fields{
+		"type":        identity.Type,
+		"fingerprint": identity.Fingerprint,
+		"encrypted":   identity.Encrypted,
+	}).Infof("using %s", description)
+
+	return identity.Contents, nil
+}
+
+// SetupVault has Vault sign an ephemeral identity for the run, which is then used
+// the same way as identity file and certificate contents would have been.
+func (c *Credentials) SetupVault(ctx context.Context) error {
+	if c.vault == nil {
+		return nil
+	}
+
+	logrus.Infof("requesting certificate from vault for role %s", c.vault.Role)
+
+	identity, certificate, err := vault.Sign(ctx, *c.vault)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := native.ParseCertificate([]byte(certificate))
+	if err != nil {
+		return err
+	}
+
+	logrus.WithFields(native.CertificateFields(parsed)).Info("using certificate from vault")
+
+	c.IdentityFileContents = identity
+	c.CertificateContents = certificate
+
+	return nil
+}
+
+// Setup places the credentials into restricted files for the binaries, or into the agent
+// when the identity files have passphrases, along with the ssh_config file and the known hosts.
+// The host keys of the destinations are pinned when there's a fingerprint to pin them to.
+func (c *Credentials) Setup(ctx context.Context, fs afero.Fs, destinations []openssh.Destination) error {
+	// Secret files are kept off the disk when running against the real file system,
+	// while the mock file systems used in testing simply have them written into them.
+	if c.secretFiles == nil {
+		if _, ok := fs.(*afero.OsFs); ok {
+			c.secretFiles = openssh.NewSecretFiles(c.TmpfsDirectory)
+		} else {
+			c.secretFiles = &openssh.FsSecretFiles{Fs: fs, Directory: openssh.TempFileDirectory}
+		}
+	}
+
+	if c.UseAgent() && c.PassphraseMode == openssh.PassphraseModeFile {
+		if err := c.setupDecryptedIdentities(fs); err != nil {
+			return err
+		}
+	} else if c.UseAgent() {
+		if err := c.setupAgent(fs); err != nil {
+			return err
+		}
+	} else {
+		identityFiles := []string{}
+
+		// The identity file contents come first, then the identities in order, then the paths.
+		for _, contents := range c.nativeAuth().IdentityFileContents {
+			filename, err := c.createSecretFile(openssh.TempIdentityFilePrefix, contents)
+			if err != nil {
+				return err
+			}
+
+			identityFiles = append(identityFiles, filename)
+		}
+
+		c.IdentityFilePath = append(identityFiles, c.IdentityFilePath...)
+	}
+
+	if c.CertificateContents != "" {
+		filename, err := c.createSecretFile(openssh.TempCertificatePrefix, strings.TrimRight(c.CertificateContents, "\n")+"\n")
+		if err != nil {
+			return err
+		}
+
+		c.certificateFiles = append(c.certificateFiles, filename)
+	}
+
+	for _, path := range c.CertificatePath {
+		c.certificateFiles = append(c.certificateFiles, native.ExpandPath(path))
+	}
+
+	if c.SSHPassword != "" {
+		filename, err := c.createSecretFile(openssh.TempPasswordPrefix, c.SSHPassword)
+		if err != nil {
+			return err
+		}
+
+		c.locationPasswordFile = filename
+	}
+
+	jumpHosts, files, err := openssh.PrepareJumpHosts(c.secretFiles, c.jumpHosts, c.IdentityFilePath)
+	c.temporaryFiles = append(c.temporaryFiles, files...)
+
+	if err != nil {
+		return err
+	}
+
+	c.sshConfig.JumpHosts = jumpHosts
+
+	if !c.sshConfig.Empty() {
+		filename, err := c.createSecretFile(openssh.TempSSHConfigPrefix, c.sshConfig.Render())
+		if err != nil {
+			return err
+		}
+
+		c.locationSSHConfigFile = filename
+	}
+
+	return c.setupHostKeys(ctx, fs, destinations)
+}
+
+// createSecretFile writes the contents into a restricted file that's removed by Cleanup.
+func (c *Credentials) createSecretFile(prefix, contents string) (string, error) {
+	filename, err := c.secretFiles.Create(prefix, contents)
+	if err != nil {
+		return "", err
+	}
+
+	c.temporaryFiles = append(c.temporaryFiles, filename)
+
+	return filename, nil
+}
+
+// setupAgent decrypts the identity files with their passphrases and loads them into a private
+// agent, including those of the jump hosts. The identity files are replaced with their public
+// keys so that the binaries pick the matching identity out of the agent instead of prompting.
+func (c *Credentials) setupAgent(fs afero.Fs) error {
+	auth := c.nativeAuth()
+	if len(auth.IdentityFilePath) == 0 {
+		auth.IdentityFilePath = native.DefaultIdentityFiles(fs)
+	}
+
+	keys, err := auth.PrivateKeys(fs)
+	if err != nil {
+		return err
+	}
+
+	certificates, err := auth.Certificates(fs)
+	if err != nil {
+		return err
+	}
+
+	identities := len(keys)
+
+	for i, jumpHost := range c.jumpHosts {
+		if jumpHost.IdentityFileContents == "" {
+			continue
+		}
+
+		jumpHostKeys, err := c.jumpHostAuth(jumpHost).PrivateKeys(fs)
+		if err != nil {
+			return fmt.Errorf("%w #%d: %w", openssh.ErrInvalidJumpHost, i+1, err)
+		}
+
+		keys = append(keys, jumpHostKeys...)
+	}
+
+	agent, err := native.StartAgent(keys, certificates)
+	if err != nil {
+		return err
+	}
+
+	c.agent = agent
+
+	authorizedKeys, err := agent.AuthorizedKeys()
+	if err != nil {
+		return err
+	}
+
+	c.IdentityFilePath = []string{}
+
+	for i, authorizedKey := range authorizedKeys {
+		if i >= identities {
+			break
+		}
+
+		filename, err := c.createSecretFile(openssh.TempPublicKeyPrefix, authorizedKey)
+		if err != nil {
+			return err
+		}
+
+		c.IdentityFilePath = append(c.IdentityFilePath, filename)
+	}
+
+	// Jump hosts write their identity file contents into a file of their own later on,
+	// so they're simply given the public key to write instead of the encrypted identity.
+	authorizedKeys = authorizedKeys[identities:]
+
+	for i := range c.jumpHosts {
+		if c.jumpHosts[i].IdentityFileContents != "" && len(authorizedKeys) > 0 {
+			c.jumpHosts[i].IdentityFileContents, authorizedKeys = authorizedKeys[0], authorizedKeys[1:]
+		}
+	}
+
+	return nil
+}
+
+// setupDecryptedIdentities decrypts the identity files with their passphrases and writes them
+// unencrypted into restricted files for the binaries to use directly, including those of the
+// jump hosts, so there's neither a prompt to answer nor an agent to run.
+func (c *Credentials) setupDecryptedIdentities(fs afero.Fs) error {
+	auth := c.nativeAuth()
+	if len(auth.IdentityFilePath) == 0 {
+		auth.IdentityFilePath = native.DefaultIdentityFiles(fs)
+	}
+
+	keys, err := auth.PrivateKeys(fs)
+	if err != nil {
+		return err
+	}
+
+	c.IdentityFilePath = []string{}
+
+	for _, key := range keys {
+		contents, err := native.MarshalIdentity(key)
+		if err != nil {
+			return err
+		}
+
+		filename, err := c.createSecretFile(openssh.TempIdentityFilePrefix, contents)
+		if err != nil {
+			return err
+		}
+
+		c.IdentityFilePath = append(c.IdentityFilePath, filename)
+	}
+
+	// Jump hosts write their identity file contents into a file of their own later on,
+	// so they're simply given the decrypted identity to write instead.
+	for i, jumpHost := range c.jumpHosts {
+		if jumpHost.IdentityFileContents == "" {
+			continue
+		}
+
+		jumpHostKeys, err := c.jumpHostAuth(jumpHost).PrivateKeys(fs)
+		if err != nil {
+			return fmt.Errorf("%w #%d: %w", openssh.ErrInvalidJumpHost, i+1, err)
+		}
+
+		if len(jumpHostKeys) == 0 {
+			continue
+		}
+
+		c.jumpHosts[i].IdentityFileContents, err = native.MarshalIdentity(jumpHostKeys[0])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// setupHostKeys writes the known hosts into a restricted file for ssh to strictly check
+// host keys against, pinning the host keys of the destinations when a fingerprint is set.
+func (c *Credentials) setupHostKeys(ctx context.Context, fs afero.Fs, destinations []openssh.Destination) error {
+	hostKeys := c.HostKeys()
+	if !hostKeys.Enabled() {
+		return nil
+	}
+
+	configs := make([]native.Config, 0, len(destinations))
+	for _, destination := range destinations {
+		configs = append(configs, c.DialConfig(fs, destination))
+	}
+
+	contents, err := hostKeys.Pin(ctx, configs)
+	if err != nil {
+		return err
+	}
+
+	filename, err := c.createSecretFile(openssh.TempKnownHostsPrefix, contents)
+	if err != nil {
+		return err
+	}
+
+	c.locationKnownHostsFile = filename
+
+	knownHostsFiles := []string{filename}
+	for _, path := range c.KnownHostsPath {
+		knownHostsFiles = append(knownHostsFiles, native.ExpandPath(path))
+	}
+
+	c.hostKeyFlags = openssh.HostKeyFlags(knownHostsFiles)
+
+	return nil
+}
+
+// Cleanup stops the agent and removes all of the temporary files holding
+// secrets that were created during Setup, overwriting their contents first.
+func (c *Credentials) Cleanup() error {
+	var errs []error
+
+	if err := c.agent.Close(); err != nil {
+		errs = append(errs, err)
+	}
+
+	c.agent = nil
+
+	for _, filename := range c.temporaryFiles {
+		if err := c.secretFiles.Remove(filename); err != nil {
+			errs = append(errs, err)
+		}
+	}
+
+	c.temporaryFiles = nil
+
+	return errors.Join(errs...)
+}
+
+// Redactions returns every secret in the credentials so that they can be masked in the logs.
+// That's the identity file contents, the identities and their passphrases, the password,
+// the passphrase, the secrets Vault is logged in with, and anything Vela has placed
+// in the secrets directory.
+func (c *Credentials) Redactions(fs afero.Fs) []string {
+	secrets := openssh.ReadSecrets(fs, openssh.SecretsDirectory)
+
+	for _, secret := range []string{c.IdentityFileContents, c.SSHPassword, c.SSHPassphrase} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	// This is called before Validate too, so the jump hosts may not have been parsed yet.
+	jumpHosts, _ := openssh.ParseJumpHosts(c.JumpHosts)
+	for _, jumpHost := range jumpHosts {
+		if jumpHost.IdentityFileContents != "" {
+			secrets = append(secrets, jumpHost.IdentityFileContents)
+		}
+	}
+
+	identities, _ := openssh.ParseIdentities(c.Identities)
+	for _, identity := range identities {
+		for _, secret := range []string{identity.Contents, identity.Passphrase} {
+			if secret != "" {
+				secrets = append(secrets, secret)
+			}
+		}
+	}
+
+	if vaultConfig, _ := openssh.ParseVault(c.Vault); vaultConfig != nil {
+		secrets = append(secrets, vaultConfig.Secrets()...)
+	}
+
+	return secrets
+}
+
+// DialConfig returns everything needed to connect to the destination natively.
+func (c *Credentials) DialConfig(fs afero.Fs, destination openssh.Destination) native.Config {
+	return native.Config{
+		Destination: destination,
+		Fs:          fs,
+		HostKeys:    c.HostKeys(),
+		Options:     c.sshConfig,
+		Auth:        c.nativeAuth(),
+		JumpHosts:   c.jumpHostConfigs(fs),
+	}
+}
+
+// nativeAuth returns the credentials the native backend authenticates with.
+func (c *Credentials) nativeAuth() native.Auth {
+	auth := native.Auth{
+		IdentityFilePath: c.IdentityFilePath,
+		CertificatePath:  c.CertificatePath,
+		Passphrase:       c.SSHPassphrase,
+		Password:         c.SSHPassword,
+	}
+
+	if c.IdentityFileContents != "" {
+		auth.IdentityFileContents = []string{c.IdentityFileContents}
+		auth.IdentityFilePassphrases = []string{c.SSHPassphrase}
+	}
+
+	for _, identity := range c.identities {
+		auth.IdentityFileContents = append(auth.IdentityFileContents, identity.Contents)
+		auth.IdentityFilePassphrases = append(auth.IdentityFilePassphrases, identity.Passphrase)
+	}
+
+	if c.CertificateContents != "" {
+		auth.CertificateContents = []string{c.CertificateContents}
+	}
+
+	return auth
+}
+
+// jumpHostAuth returns the credentials of a jump host with identity file contents of its own.
+func (c *Credentials) jumpHostAuth(jumpHost openssh.JumpHost) native.Auth {
+	return native.Auth{
+		IdentityFileContents: []string{jumpHost.IdentityFileContents},
+		Passphrase:           c.SSHPassphrase,
+	}
+}
+
+// jumpHostConfigs returns the jump hosts for the native backend. Jump hosts without
+// identity file contents of their own authenticate with the rest of the credentials.
+func (c *Credentials) jumpHostConfigs(fs afero.Fs) []native.Config {
+	configs := make([]native.Config, 0, len(c.jumpHosts))
+
+	for _, jumpHost := range c.jumpHosts {
+		config := native.Config{
+			Destination: jumpHost.Destination,
+			Fs:          fs,
+			HostKeys:    native.HostKeys{KnownHostsContents: jumpHost.KnownHosts, TmpfsDirectory: c.TmpfsDirectory},
+			Options:     c.sshConfig,
+			Auth:        c.nativeAuth(),
+		}
+
+		if jumpHost.IdentityFileContents != "" {
+			config.Auth = c.jumpHostAuth(jumpHost)
+		}
+
+		configs = append(configs, config)
+	}
+
+	return configs
+}
+
+// HostKeys returns what the host keys of remote systems are verified against.
+func (c *Credentials) HostKeys() native.HostKeys {
+	return native.HostKeys{
+		KnownHostsContents: c.KnownHostsContents,
+		KnownHostsPath:     c.KnownHostsPath,
+		Fingerprint:        c.HostKeyFingerprint,
+		TmpfsDirectory:     c.TmpfsDirectory,
+	}
+}
+
+// Options returns the ssh_config options parsed by Validate.
+func (c *Credentials) Options() openssh.SSHConfig {
+	return c.sshConfig
+}
+
+// UseAgent determines whether any of the identity files have a passphrase
+// to be decrypted with, in which case they're loaded into the built-in agent.
+func (c *Credentials) UseAgent() bool {
+	if c.SSHPassphrase != "" {
+		return true
+	}
+
+	for _, identity := range c.identities {
+		if identity.Passphrase != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Agent returns the agent started by Setup, if there is one.
+func (c *Credentials) Agent() *native.Agent {
+	return c.agent
+}
+
+// PasswordFile returns the file Setup wrote the password into for sshpass.
+func (c *Credentials) PasswordFile() string {
+	return c.locationPasswordFile
+}
+
+// SSHConfigFile returns the ssh_config file Setup generated for the binaries to use with -F.
+func (c *Credentials) SSHConfigFile() string {
+	return c.locationSSHConfigFile
+}
+
+// KnownHostsFile returns the known_hosts file Setup wrote the known hosts into.
+func (c *Credentials) KnownHostsFile() string {
+	return c.locationKnownHostsFile
+}
+
+// HostKeyFlags returns the flags for the binaries to strictly check host keys against the known
+// hosts, which are empty when there's nothing to check them against.
+func (c *Credentials) HostKeyFlags() []string {
+	return c.hostKeyFlags
+}
+
+// CertificateFiles returns the certificates for the binaries to use with CertificateFile.
+func (c *Credentials) CertificateFiles() []string {
+	return c.certificateFiles
+}
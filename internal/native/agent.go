@@ -0,0 +1,175 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package native
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+)
+
+// AgentSocketName is the name of the unix socket inside the private directory of the agent.
+const AgentSocketName = "agent.sock"
+
+// Agent is a private ssh-agent running in process. It holds identity files that have already
+// been decrypted so the binaries can authenticate with them through SSH_AUTH_SOCK without ever
+// being asked for a passphrase. The socket lives in a directory only the plugin can access.
+type Agent struct {
+	// Socket is the path of the unix socket the agent listens on, for SSH_AUTH_SOCK.
+	Socket string
+
+	directory string
+	listener  net.Listener
+	keyring   agent.Agent
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{}
+	wg    sync.WaitGroup
+}
+
+// StartAgent loads the private keys, as parsed by Auth.PrivateKeys, into a new agent and starts
+// listening for the binaries to connect. Each of the certificates is loaded after all of the keys
+// along with the private key it belongs to. The agent must be closed once they're finished with it.
+func StartAgent(keys []any, certificates []*ssh.Certificate) (*Agent, error) {
+	keyring := agent.NewKeyring()
+	signers := make([]ssh.Signer, 0, len(keys))
+
+	for i, key := range keys {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't add identity #%d to the agent: %w", i+1, err)
+		}
+
+		if err := keyring.Add(agent.AddedKey{PrivateKey: key}); err != nil {
+			return nil, fmt.Errorf("couldn't add identity #%d to the agent: %w", i+1, err)
+		}
+
+		signers = append(signers, signer)
+	}
+
+	for _, certificate := range certificates {
+		i := matchCertificate(certificate, signers)
+		if i < 0 {
+			continue
+		}
+
+		if err := keyring.Add(agent.AddedKey{PrivateKey: keys[i], Certificate: certificate}); err != nil {
+			return nil, fmt.Errorf("couldn't add certificate %q to the agent: %w", certificate.KeyId, err)
+		}
+	}
+
+	// MkdirTemp creates the directory so only the plugin can use the socket inside of it.
+	directory, err := os.MkdirTemp(openssh.TempFileDirectory, openssh.TempAgentPrefix)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't create agent directory: %w", err)
+	}
+
+	socket := filepath.Join(directory, AgentSocketName)
+
+	listener, err := net.Listen("unix", socket)
+	if err != nil {
+		os.RemoveAll(directory)
+		return nil, fmt.Errorf("couldn't start agent: %w", err)
+	}
+
+	a := &Agent{
+		Socket:    socket,
+		directory: directory,
+		listener:  listener,
+		keyring:   keyring,
+		conns:     map[net.Conn]struct{}{},
+	}
+
+	a.wg.Add(1)
+
+	go a.serve()
+
+	return a, nil
+}
+
+// serve accepts connections until the agent is closed, serving each of them in turn.
+func (a *Agent) serve() {
+	defer a.wg.Done()
+
+	for {
+		conn, err := a.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		a.mu.Lock()
+		a.conns[conn] = struct{}{}
+		a.mu.Unlock()
+
+		a.wg.Add(1)
+
+		go func() {
+			defer a.wg.Done()
+
+			_ = agent.ServeAgent(a.keyring, conn)
+
+			a.mu.Lock()
+			delete(a.conns, conn)
+			a.mu.Unlock()
+
+			conn.Close()
+		}()
+	}
+}
+
+// AuthorizedKeys returns the public keys of the identities the agent holds in the order they
+// were loaded, followed by the certificates. Handing these to ssh as identity files has it
+// use the matching key from the agent.
+func (a *Agent) AuthorizedKeys() ([]string, error) {
+	keys, err := a.keyring.List()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list agent identities: %w", err)
+	}
+
+	authorizedKeys := make([]string, 0, len(keys))
+	for _, key := range keys {
+		authorizedKeys = append(authorizedKeys, key.String()+"\n")
+	}
+
+	return authorizedKeys, nil
+}
+
+// Close stops the agent, disconnecting anything still connected, forgets the
+// identities it holds and removes its socket. It's safe to call more than once.
+func (a *Agent) Close() error {
+	if a == nil {
+		return nil
+	}
+
+	errs := []error{}
+
+	if err := a.listener.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+		errs = append(errs, fmt.Errorf("couldn't stop agent: %w", err))
+	}
+
+	a.mu.Lock()
+	for conn := range a.conns {
+		conn.Close()
+	}
+	a.mu.Unlock()
+
+	a.wg.Wait()
+
+	if err := a.keyring.RemoveAll(); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't remove agent identities: %w", err))
+	}
+
+	if err := os.RemoveAll(a.directory); err != nil {
+		errs = append(errs, fmt.Errorf("couldn't remove agent directory: %w", err))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,120 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package native
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrInvalidCertificate is returned when a certificate can't be parsed or isn't a user certificate.
+	ErrInvalidCertificate = errors.New("invalid certificate")
+
+	// ErrCertificateExpired is returned when a certificate is no longer valid.
+	ErrCertificateExpired = errors.New("certificate has expired")
+)
+
+// ParseCertificate parses a user certificate in the format written by ssh-keygen -s, such as
+// an id_ed25519-cert.pub file. Expired certificates are rejected up front rather than leaving
+// the remote system to turn them away with nothing more than a permission denied.
+func ParseCertificate(contents []byte) (*ssh.Certificate, error) {
+	publicKey, _, _, _, err := ssh.ParseAuthorizedKey(contents)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+	}
+
+	certificate, ok := publicKey.(*ssh.Certificate)
+	if !ok {
+		return nil, fmt.Errorf("%w: got a %s public key rather than a certificate", ErrInvalidCertificate, publicKey.Type())
+	}
+
+	if certificate.CertType != ssh.UserCert {
+		return nil, fmt.Errorf("%w: %q is a host certificate rather than a user certificate", ErrInvalidCertificate, certificate.KeyId)
+	}
+
+	if certificate.ValidBefore != ssh.CertTimeInfinity && uint64(time.Now().Unix()) >= certificate.ValidBefore { // #nosec G115
+		return nil, fmt.Errorf("%w: %q expired at %s", ErrCertificateExpired, certificate.KeyId, certificateTime(certificate.ValidBefore))
+	}
+
+	return certificate, nil
+}
+
+// CertificateFields describes a certificate for logging, without anything secret in it.
+func CertificateFields(certificate *ssh.Certificate) logrus.Fields {
+	return logrus.Fields{
+		"key-id":       certificate.KeyId,
+		"principals":   certificate.ValidPrincipals,
+		"serial":       certificate.Serial,
+		"valid-after":  certificateTime(certificate.ValidAfter),
+		"valid-before": certificateTime(certificate.ValidBefore),
+	}
+}
+
+// certificateTime formats the seconds since the epoch certificates are valid between.
+func certificateTime(seconds uint64) string {
+	switch seconds {
+	case 0:
+		return "always"
+	case ssh.CertTimeInfinity:
+		return "forever"
+	default:
+		return time.Unix(int64(seconds), 0).UTC().Format(time.RFC3339) // #nosec G115
+	}
+}
+
+// Certificates parses all of the certificates, see ParseCertificate.
+func (a Auth) Certificates(fs afero.Fs) ([]*ssh.Certificate, error) {
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+
+	certificates := []*ssh.Certificate{}
+
+	for i, contents := range a.CertificateContents {
+		certificate, err := ParseCertificate([]byte(contents))
+		if err != nil {
+			return nil, fmt.Errorf("certificate contents #%d: %w", i+1, err)
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	for _, path := range a.CertificatePath {
+		path = ExpandPath(path)
+
+		contents, err := afero.ReadFile(fs, path)
+		if err != nil {
+			return nil, fmt.Errorf("%w: couldn't read certificate file %s: %w", ErrInvalidCertificate, path, err)
+		}
+
+		certificate, err := ParseCertificate(contents)
+		if err != nil {
+			return nil, fmt.Errorf("certificate file %s: %w", path, err)
+		}
+
+		certificates = append(certificates, certificate)
+	}
+
+	return certificates, nil
+}
+
+// matchCertificate returns the position of the signer holding the private key for
+// the certificate, or -1 with a warning if there isn't one since it can't be used.
+func matchCertificate(certificate *ssh.Certificate, signers []ssh.Signer) int {
+	for i, signer := range signers {
+		if bytes.Equal(signer.PublicKey().Marshal(), certificate.Key.Marshal()) {
+			return i
+		}
+	}
+
+	logrus.Warnf("ignoring certificate %q since none of the identity files hold its private key", certificate.KeyId)
+
+	return -1
+}
@@ -0,0 +1,43 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package native
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// Run executes the command on the remote system, streaming its output to stdout and stderr
+// as it arrives. If the command fails the error is an *ssh.ExitError carrying the exit status
+// of the remote command. When the context is done the remote command is sent SIGTERM and
+// the session is closed rather than waiting for the command to finish.
+func Run(ctx context.Context, client *ssh.Client, command string, stdin io.Reader, stdout, stderr io.Writer) error {
+	session, err := client.NewSession()
+	if err != nil {
+		return fmt.Errorf("couldn't open session: %w", err)
+	}
+	defer session.Close()
+
+	session.Stdin = stdin
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	stop := context.AfterFunc(ctx, func() {
+		_ = session.Signal(ssh.SIGTERM)
+		_ = session.Close()
+	})
+	defer stop()
+
+	if err := session.Run(command); err != nil {
+		if ctx.Err() != nil {
+			return fmt.Errorf("remote command interrupted: %w", ctx.Err())
+		}
+
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,371 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+)
+
+var (
+	// ErrHostKeyVerification is returned when a remote system presents a host key that
+	// doesn't match any of the known hosts or pinned fingerprints.
+	ErrHostKeyVerification = errors.New("host key verification failed")
+
+	// ErrInvalidFingerprint is returned when a pinned fingerprint isn't in
+	// the SHA256:... or MD5:... form printed by ssh-keygen -l.
+	ErrInvalidFingerprint = errors.New("invalid host key fingerprint, expected the SHA256:... form printed by ssh-keygen -l")
+
+	// errHostKeyScanned stops the handshake once the host key has been seen when scanning.
+	errHostKeyScanned = errors.New("host key scanned")
+)
+
+// MaxHostKeyScans bounds how many destinations have their host keys scanned at once, so
+// pinning the host keys of a large inventory doesn't connect to all of its hosts together.
+const MaxHostKeyScans = 16
+
+// HostKeys holds what's needed to verify the host keys presented by remote systems.
+// A host key is accepted when it matches any of the known hosts or pinned fingerprints.
+type HostKeys struct {
+	// KnownHostsContents are the raw contents of a known_hosts file.
+	KnownHostsContents string
+
+	// KnownHostsPath are paths to known_hosts files, which may use ~ or environmental variables.
+	KnownHostsPath []string
+
+	// Fingerprint are the fingerprints of the host keys to pin, as printed by ssh-keygen -l.
+	Fingerprint []string
+
+	// TmpfsDirectory is where the known hosts are briefly written to be parsed when they
+	// can't be kept in memory, the same as any other secret file of the plugins.
+	TmpfsDirectory string
+}
+
+// Enabled returns true if there's anything to verify host keys against.
+func (h HostKeys) Enabled() bool {
+	return h.KnownHostsContents != "" || len(h.KnownHostsPath)+len(h.Fingerprint) > 0
+}
+
+// Validate checks that all of the pinned fingerprints are in a form that can be compared.
+func (h HostKeys) Validate() error {
+	for _, fingerprint := range h.Fingerprint {
+		if _, err := normalizeFingerprint(fingerprint); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// Callback returns the host key callback that verifies host keys against the known
+// hosts and pinned fingerprints, along with the host key algorithms to ask the address
+// for so that it presents a key of a type that's known for it. When host keys aren't
+// enabled every host key is accepted, matching openssh.DefaultSSHFlags.
+func (h HostKeys) Callback(fs afero.Fs, address string) (ssh.HostKeyCallback, []string, error) {
+	if !h.Enabled() {
+		// This mirrors openssh.DefaultSSHFlags which skip host key checking.
+		return ssh.InsecureIgnoreHostKey(), nil, nil // #nosec G106
+	}
+
+	fingerprints := make([]string, 0, len(h.Fingerprint))
+
+	for _, fingerprint := range h.Fingerprint {
+		normalized, err := normalizeFingerprint(fingerprint)
+		if err != nil {
+			return nil, nil, err
+		}
+
+		fingerprints = append(fingerprints, normalized)
+	}
+
+	knownHosts, err := h.knownHosts(fs)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	callback := func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+		presented := fmt.Sprintf("%s presented %s key %s", hostname, key.Type(), ssh.FingerprintSHA256(key))
+
+		for _, fingerprint := range fingerprints {
+			if matchesFingerprint(key, fingerprint) {
+				return nil
+			}
+		}
+
+		if knownHosts == nil {
+			return fmt.Errorf("%w: %s, expected %s", ErrHostKeyVerification, presented, strings.Join(h.Fingerprint, " or "))
+		}
+
+		err := knownHosts(hostname, remote, key)
+
+		var revokedErr *knownhosts.RevokedError
+		var keyErr *knownhosts.KeyError
+
+		switch {
+		case err == nil:
+			return nil
+		case errors.As(err, &revokedErr):
+			return fmt.Errorf("%w: %s which has been revoked", ErrHostKeyVerification, presented)
+		case errors.As(err, &keyErr) && len(keyErr.Want) == 0 && len(fingerprints) == 0:
+			return fmt.Errorf("%w: %s but it isn't in the known hosts", ErrHostKeyVerification, presented)
+		case errors.As(err, &keyErr):
+			expected := make([]string, 0, len(keyErr.Want)+len(h.Fingerprint))
+			expected = append(expected, h.Fingerprint...)
+
+			for _, want := range keyErr.Want {
+				expected = append(expected, ssh.FingerprintSHA256(want.Key))
+			}
+
+			return fmt.Errorf("%w: %s, expected %s", ErrHostKeyVerification, presented, strings.Join(expected, " or "))
+		default:
+			return fmt.Errorf("%w: %w", ErrHostKeyVerification, err)
+		}
+	}
+
+	// Fingerprints can be for a key of any type, so only the known hosts narrow down the algorithms.
+	if len(fingerprints) > 0 {
+		return callback, nil, nil
+	}
+
+	return callback, knownAlgorithms(knownHosts, address), nil
+}
+
+// knownHosts parses the known hosts contents and files into a callback, or returns nil if there
+// aren't any. Files given by path that don't exist are skipped with a warning like ssh does.
+func (h HostKeys) knownHosts(fs afero.Fs) (ssh.HostKeyCallback, error) {
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+
+	contents := []string{}
+
+	if h.KnownHostsContents != "" {
+		contents = append(contents, h.KnownHostsContents)
+	}
+
+	for _, path := range h.KnownHostsPath {
+		path = ExpandPath(path)
+
+		file, err := afero.ReadFile(fs, path)
+		if errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("no such known hosts file: %s", path)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't read known hosts file %s: %w", path, err)
+		}
+
+		contents = append(contents, string(file))
+	}
+
+	if len(contents) == 0 {
+		return nil, nil
+	}
+
+	// The knownhosts package only reads from the OS file system, but it reads everything
+	// up front so the combined file is removed straight away. It's kept off the disk
+	// like the secret files are, since the known hosts can reveal the hosts deployed to.
+	secretFiles := openssh.NewSecretFiles(h.TmpfsDirectory)
+
+	filename, err := secretFiles.Create(openssh.TempKnownHostsPrefix, strings.Join(contents, "\n")+"\n")
+	if err != nil {
+		return nil, err
+	}
+	defer secretFiles.Remove(filename)
+
+	callback, err := knownhosts.New(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse known hosts: %w", err)
+	}
+
+	return callback, nil
+}
+
+// Pin returns the contents of a known_hosts file to hand to ssh, which are the known hosts
+// contents along with a line for each of the destinations when fingerprints are pinned.
+// ssh can't check fingerprints by itself, so each host key is scanned and verified here
+// first, and then ssh strictly checks that it's presented that very same key again.
+// The destinations are scanned at once, up to MaxHostKeyScans of them at a time, each with
+// its own options and jump hosts, and every one of them that couldn't be verified is reported.
+func (h HostKeys) Pin(ctx context.Context, destinations []Config) (string, error) {
+	lines := []string{}
+
+	if h.KnownHostsContents != "" {
+		lines = append(lines, strings.TrimRight(h.KnownHostsContents, "\n"))
+	}
+
+	if len(h.Fingerprint) > 0 {
+		keys := make([]ssh.PublicKey, len(destinations))
+		errs := make([]error, len(destinations))
+
+		slots := make(chan struct{}, MaxHostKeyScans)
+
+		var wg sync.WaitGroup
+
+		for i, destination := range destinations {
+			destination.HostKeys = h
+
+			slots <- struct{}{}
+
+			wg.Add(1)
+
+			go func() {
+				defer func() {
+					<-slots
+					wg.Done()
+				}()
+
+				keys[i], errs[i] = ScanHostKey(ctx, destination)
+			}()
+		}
+
+		wg.Wait()
+
+		if err := errors.Join(errs...); err != nil {
+			return "", err
+		}
+
+		for i, destination := range destinations {
+			address := destination.Destination.Address()
+
+			logrus.Infof("verified %s key %s for %s", keys[i].Type(), ssh.FingerprintSHA256(keys[i]), address)
+
+			lines = append(lines, KnownHostsLine(address, keys[i]))
+		}
+	}
+
+	return strings.Join(lines, "\n") + "\n", nil
+}
+
+// KnownHostsLine returns a line for a known_hosts file pinning the key to the address.
+func KnownHostsLine(address string, key ssh.PublicKey) string {
+	return knownhosts.Line([]string{knownhosts.Normalize(address)}, key)
+}
+
+// ScanHostKey connects to the destination just long enough to see the host key it presents
+// and verify it against the host keys of the config, without authenticating to it. Like
+// connecting for real, it gives up after the connect timeout from the options, and the
+// destination is connected to through the jump hosts, which are authenticated to as usual.
+func ScanHostKey(ctx context.Context, config Config) (ssh.PublicKey, error) {
+	address := config.Destination.Address()
+
+	callback, hostKeyAlgorithms, err := config.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	var key ssh.PublicKey
+
+	var verifyErr error
+
+	clientConfig := &ssh.ClientConfig{
+		User: config.Destination.User,
+		HostKeyCallback: func(hostname string, remote net.Addr, presented ssh.PublicKey) error {
+			key, verifyErr = presented, callback(hostname, remote, presented)
+			return errHostKeyScanned
+		},
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           config.connectTimeout(),
+	}
+
+	via, closeJumpHosts, err := dialJumpHosts(ctx, config.JumpHosts)
+	if err != nil {
+		return nil, err
+	}
+	defer closeJumpHosts()
+
+	ctx, cancel := context.WithTimeout(ctx, clientConfig.Timeout)
+	defer cancel()
+
+	conn, err := dialConn(ctx, address, via)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to %s: %w", address, err)
+	}
+
+	client, err := newClient(ctx, conn, address, clientConfig)
+	if err == nil {
+		client.Close()
+	}
+
+	if key == nil {
+		return nil, fmt.Errorf("couldn't scan host key of %s: %w", address, err)
+	}
+
+	return key, verifyErr
+}
+
+// normalizeFingerprint trims a fingerprint down to the form ssh.FingerprintSHA256 and
+// ssh.FingerprintLegacyMD5 return, keeping the MD5: prefix to tell the two apart.
+func normalizeFingerprint(fingerprint string) (string, error) {
+	fingerprint = strings.TrimSpace(fingerprint)
+
+	switch {
+	case strings.HasPrefix(fingerprint, "SHA256:") && len(fingerprint) > len("SHA256:"):
+		return strings.TrimRight(fingerprint, "="), nil
+	case strings.HasPrefix(strings.ToUpper(fingerprint), "MD5:") && len(fingerprint) > len("MD5:"):
+		return "MD5:" + strings.ToLower(fingerprint[len("MD5:"):]), nil
+	default:
+		return "", fmt.Errorf("%w: %q", ErrInvalidFingerprint, fingerprint)
+	}
+}
+
+// matchesFingerprint checks the key against a normalized fingerprint.
+func matchesFingerprint(key ssh.PublicKey, fingerprint string) bool {
+	if strings.HasPrefix(fingerprint, "MD5:") {
+		return "MD5:"+ssh.FingerprintLegacyMD5(key) == fingerprint
+	}
+
+	return ssh.FingerprintSHA256(key) == fingerprint
+}
+
+// knownAlgorithms returns the host key algorithms for the key types known for the address,
+// found by asking the known hosts about a key that can't match and looking at what it wanted.
+// Without this a remote system might present a key of another type and fail verification.
+func knownAlgorithms(knownHosts ssh.HostKeyCallback, address string) []string {
+	if knownHosts == nil {
+		return nil
+	}
+
+	remote, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		remote = &net.TCPAddr{}
+	}
+
+	var keyErr *knownhosts.KeyError
+	if err := knownHosts(address, remote, probeKey{}); !errors.As(err, &keyErr) {
+		return nil
+	}
+
+	var algorithms []string
+
+	for _, want := range keyErr.Want {
+		switch want.Key.Type() {
+		case ssh.KeyAlgoRSA:
+			algorithms = append(algorithms, ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA)
+		default:
+			algorithms = append(algorithms, want.Key.Type())
+		}
+	}
+
+	return algorithms
+}
+
+// probeKey is a public key that never matches anything in the known hosts.
+type probeKey struct{}
+
+func (probeKey) Type() string { return "vela-probe" }
+
+func (probeKey) Marshal() []byte { return []byte("vela-probe") }
+
+func (probeKey) Verify([]byte, *ssh.Signature) error { return ErrHostKeyVerification }
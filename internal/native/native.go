@@ -0,0 +1,476 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package native connects to remote systems in process using golang.org/x/crypto/ssh
+// as an alternative to executing the OpenSSH binaries. It takes the same identity files,
+// password and passphrase as the binaries would, without needing sshpass to provide them.
+package native
+
+import (
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+	"golang.org/x/crypto/ssh"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+)
+
+// DefaultConnectTimeout bounds how long connecting and authenticating
+// can take when the config doesn't set its own timeout.
+const DefaultConnectTimeout = 30 * time.Second
+
+// ErrNoAuthMethods is returned when there aren't any credentials to authenticate with.
+var ErrNoAuthMethods = errors.New("no identity files or password to authenticate with")
+
+// Auth holds the credentials used to authenticate against remote systems.
+type Auth struct {
+	// IdentityFileContents are the raw contents of identity files.
+	IdentityFileContents []string
+
+	// IdentityFilePath are paths to identity files, which may use ~ or environmental variables.
+	IdentityFilePath []string
+
+	// CertificateContents are the raw contents of certificates, and CertificatePath are paths
+	// to them. Each is paired with whichever of the identity files holds its private key.
+	CertificateContents []string
+	CertificatePath     []string
+
+	// Passphrase unlocks any of the identity files that are encrypted.
+	Passphrase string
+
+	// IdentityFilePassphrases unlock the identity file contents at the same position
+	// instead of the Passphrase, which is still used for any that are left empty.
+	IdentityFilePassphrases []string
+
+	// Password is used for password and keyboard-interactive authentication.
+	Password string
+}
+
+// Config holds everything needed to connect to a remote system.
+type Config struct {
+	Auth
+
+	// Destination is the remote system to connect to.
+	Destination openssh.Destination
+
+	// HostKeys verifies the host key presented by the remote system.
+	// When it's empty every host key is accepted, matching the default ssh flags.
+	HostKeys HostKeys
+
+	// Options are the ssh_config options to apply. Their connect timeout bounds connecting and
+	// authenticating, defaulting to DefaultConnectTimeout. Compression isn't supported, and
+	// algorithm lists that modify the defaults with a leading +, - or ^ are ignored.
+	Options openssh.SSHConfig
+
+	// JumpHosts are connected to in order, each through the one before it,
+	// with the destination connected to through the last of them.
+	JumpHosts []Config
+
+	// Fs is where identity files are read from, defaults to the OS file system.
+	Fs afero.Fs
+}
+
+// Dial connects and authenticates to the destination, hopping through each of the jump hosts
+// first. The connections to the jump hosts are closed along with the returned client.
+func Dial(ctx context.Context, config Config) (*ssh.Client, error) {
+	via, closeJumpHosts, err := dialJumpHosts(ctx, config.JumpHosts)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := dial(ctx, config, via)
+	if err != nil {
+		closeJumpHosts()
+		return nil, err
+	}
+
+	go func() {
+		_ = client.Wait()
+		closeJumpHosts()
+	}()
+
+	return client, nil
+}
+
+// dialJumpHosts connects to each of the jump hosts through the one before it, returning the
+// client for the last of them to connect through along with a function to close them all.
+func dialJumpHosts(ctx context.Context, jumpHosts []Config) (*ssh.Client, func(), error) {
+	clients := []*ssh.Client{}
+
+	closeAll := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+
+	var via *ssh.Client
+
+	for _, jumpHost := range jumpHosts {
+		client, err := dial(ctx, jumpHost, via)
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("couldn't jump through %s: %w", jumpHost.Destination, err)
+		}
+
+		clients = append(clients, client)
+		via = client
+	}
+
+	return via, closeAll, nil
+}
+
+// dial connects and authenticates to a single system, either directly or through a jump host.
+func dial(ctx context.Context, config Config, via *ssh.Client) (*ssh.Client, error) {
+	clientConfig, err := config.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	// Like ConnectTimeout for ssh, the connect timeout bounds opening
+	// the connection along with the handshake over it.
+	ctx, cancel := context.WithTimeout(ctx, clientConfig.Timeout)
+	defer cancel()
+
+	conn, err := dialConn(ctx, config.Destination.Address(), via)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't connect to %s: %w", config.Destination.Address(), err)
+	}
+
+	client, err := newClient(ctx, conn, config.Destination.Address(), clientConfig)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.Options.ServerAliveInterval > 0 {
+		go keepAlive(client, config.Options.ServerAliveInterval)
+	}
+
+	return client, nil
+}
+
+// dialConn opens a connection to the address, either directly or through a jump host,
+// giving up when the context is done, such as when the connect timeout passes.
+func dialConn(ctx context.Context, address string, via *ssh.Client) (net.Conn, error) {
+	var conn net.Conn
+
+	var err error
+
+	if via != nil {
+		conn, err = via.DialContext(ctx, "tcp", address)
+	} else {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+
+	return conn, err
+}
+
+// keepAlive checks the connection is still alive every interval, like ServerAliveInterval does for ssh,
+// closing it if the remote system stops answering so that whatever is using it doesn't hang forever.
+func keepAlive(client *ssh.Client, interval time.Duration) {
+	done := make(chan struct{})
+
+	go func() {
+		_ = client.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if _, _, err := client.SendRequest("keepalive@openssh.com", true, nil); err != nil {
+				client.Close()
+				return
+			}
+		}
+	}
+}
+
+// newClient performs the SSH handshake over an established connection,
+// giving up when the context is done without it finishing.
+func newClient(ctx context.Context, conn net.Conn, address string, clientConfig *ssh.ClientConfig) (*ssh.Client, error) {
+	// Closing the connection rather than setting a deadline also works
+	// for connections to jump hosts, which don't support deadlines.
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, address, clientConfig)
+	if err != nil {
+		conn.Close()
+
+		if ctx.Err() != nil {
+			return nil, fmt.Errorf("couldn't connect to %s: %w", address, ctx.Err())
+		}
+
+		return nil, fmt.Errorf("couldn't connect to %s: %w", address, err)
+	}
+
+	return ssh.NewClient(sshConn, channels, requests), nil
+}
+
+// ClientConfig builds the x/crypto/ssh client configuration for the destination.
+func (c Config) ClientConfig() (*ssh.ClientConfig, error) {
+	methods, err := c.Methods(c.Fs)
+	if err != nil {
+		return nil, err
+	}
+
+	hostKeyCallback, hostKeyAlgorithms, err := c.hostKeyCallback()
+	if err != nil {
+		return nil, err
+	}
+
+	if c.Options.Compression != nil && *c.Options.Compression {
+		logrus.Warn("compression isn't supported by the native backend")
+	}
+
+	clientConfig := &ssh.ClientConfig{
+		User:              c.Destination.User,
+		Auth:              methods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: hostKeyAlgorithms,
+		Timeout:           c.connectTimeout(),
+	}
+
+	clientConfig.Ciphers = algorithms("ciphers", c.Options.Ciphers)
+	clientConfig.KeyExchanges = algorithms("kex", c.Options.KexAlgorithms)
+
+	return clientConfig, nil
+}
+
+// hostKeyCallback returns the callback verifying the host key of the destination along
+// with the host key algorithms to ask for, preferring those set in the options.
+func (c Config) hostKeyCallback() (ssh.HostKeyCallback, []string, error) {
+	callback, hostKeyAlgorithms, err := c.HostKeys.Callback(c.Fs, c.Destination.Address())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if configured := algorithms("host_key_algorithms", c.Options.HostKeyAlgorithms); len(configured) > 0 {
+		hostKeyAlgorithms = configured
+	}
+
+	return callback, hostKeyAlgorithms, nil
+}
+
+// connectTimeout returns how long connecting and authenticating can take.
+func (c Config) connectTimeout() time.Duration {
+	if c.Options.ConnectTimeout > 0 {
+		return c.Options.ConnectTimeout
+	}
+
+	return DefaultConnectTimeout
+}
+
+// algorithms returns the list of algorithms to use, or nil to use the defaults when
+// the list modifies the defaults with a leading +, - or ^ since only ssh understands them.
+func algorithms(option string, algorithms []string) []string {
+	if len(algorithms) > 0 && strings.ContainsAny(algorithms[0][:1], "+-^") {
+		logrus.Warnf("ignoring %s since modifying the defaults isn't supported by the native backend", option)
+		return nil
+	}
+
+	return algorithms
+}
+
+// Methods returns the authentication methods for the credentials, trying
+// identity files first and falling back to the password just like ssh does.
+func (a Auth) Methods(fs afero.Fs) ([]ssh.AuthMethod, error) {
+	signers, err := a.Signers(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := []ssh.AuthMethod{}
+
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+
+	if a.Password != "" {
+		methods = append(methods,
+			ssh.Password(a.Password),
+			ssh.KeyboardInteractive(func(_, _ string, questions []string, _ []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = a.Password
+				}
+
+				return answers, nil
+			}),
+		)
+	}
+
+	if len(methods) == 0 {
+		return nil, ErrNoAuthMethods
+	}
+
+	return methods, nil
+}
+
+// Signers parses all of the identity files into signers, see PrivateKeys. Any certificates
+// come first, paired with the identity file holding their private key, since like ssh
+// they're tried before the identity files themselves.
+func (a Auth) Signers(fs afero.Fs) ([]ssh.Signer, error) {
+	keys, err := a.PrivateKeys(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	signers := make([]ssh.Signer, 0, len(keys))
+
+	for _, key := range keys {
+		signer, err := ssh.NewSignerFromKey(key)
+		if err != nil {
+			return nil, err
+		}
+
+		signers = append(signers, signer)
+	}
+
+	certificates, err := a.Certificates(fs)
+	if err != nil {
+		return nil, err
+	}
+
+	certificateSigners := []ssh.Signer{}
+
+	for _, certificate := range certificates {
+		i := matchCertificate(certificate, signers)
+		if i < 0 {
+			continue
+		}
+
+		signer, err := ssh.NewCertSigner(certificate, signers[i])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidCertificate, err)
+		}
+
+		certificateSigners = append(certificateSigners, signer)
+	}
+
+	return append(certificateSigners, signers...), nil
+}
+
+// PrivateKeys parses all of the identity files into private keys, decrypting any that are
+// encrypted with the passphrase. Identity files given by path that don't exist are skipped
+// with a warning, the same way ssh treats them, as are encrypted identity files without
+// a passphrase. Anything else that can't be parsed or decrypted is an error.
+func (a Auth) PrivateKeys(fs afero.Fs) ([]any, error) {
+	if fs == nil {
+		fs = afero.NewOsFs()
+	}
+
+	keys := []any{}
+
+	for i, contents := range a.IdentityFileContents {
+		passphrase := a.Passphrase
+		if i < len(a.IdentityFilePassphrases) && a.IdentityFilePassphrases[i] != "" {
+			passphrase = a.IdentityFilePassphrases[i]
+		}
+
+		key, err := parse([]byte(contents), passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse identity file contents #%d: %w", i+1, err)
+		}
+
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, path := range a.IdentityFilePath {
+		path = ExpandPath(path)
+
+		contents, err := afero.ReadFile(fs, path)
+		if errors.Is(err, os.ErrNotExist) {
+			logrus.Warnf("no such identity file: %s", path)
+			continue
+		} else if err != nil {
+			return nil, fmt.Errorf("couldn't read identity file %s: %w", path, err)
+		}
+
+		key, err := parse(contents, a.Passphrase)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't parse identity file %s: %w", path, err)
+		}
+
+		if key != nil {
+			keys = append(keys, key)
+		}
+	}
+
+	return keys, nil
+}
+
+// parse returns the private key for an identity file, or nil if it's
+// encrypted and there isn't a passphrase available to unlock it.
+func parse(contents []byte, passphrase string) (any, error) {
+	key, err := ssh.ParseRawPrivateKey(contents)
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		if passphrase == "" {
+			logrus.Warn("skipping encrypted identity file since no passphrase was provided")
+			return nil, nil
+		}
+
+		return ssh.ParseRawPrivateKeyWithPassphrase(contents, []byte(passphrase))
+	}
+
+	return key, err
+}
+
+// MarshalIdentity returns the contents of an unencrypted identity file in the OpenSSH format holding the private key.
+func MarshalIdentity(key any) (string, error) {
+	block, err := ssh.MarshalPrivateKey(key, "")
+	if err != nil {
+		return "", fmt.Errorf("couldn't marshal identity: %w", err)
+	}
+
+	return string(pem.EncodeToMemory(block)), nil
+}
+
+// DefaultIdentityFiles returns which of the identity files ssh tries by
+// default exist, for when the plugin isn't given any identity files.
+func DefaultIdentityFiles(fs afero.Fs) []string {
+	files := []string{}
+
+	for _, path := range []string{"~/.ssh/id_rsa", "~/.ssh/id_ecdsa", "~/.ssh/id_ed25519"} {
+		if ok, _ := afero.Exists(fs, ExpandPath(path)); ok {
+			files = append(files, path)
+		}
+	}
+
+	return files
+}
+
+// ExpandPath expands a leading ~ to the home directory along with
+// any environmental variables, the way the shell would for ssh.
+func ExpandPath(path string) string {
+	if path == "~" || strings.HasPrefix(path, "~/") {
+		if home, err := os.UserHomeDir(); err == nil {
+			path = home + path[1:]
+		}
+	}
+
+	return os.ExpandEnv(path)
+}
@@ -0,0 +1,301 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package native
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+	"github.com/spf13/afero"
+)
+
+var (
+	// ErrDirectoryNotRecursive is returned when a source is a directory but the transfer isn't recursive.
+	ErrDirectoryNotRecursive = errors.New("source is a directory, use -r to copy it recursively")
+
+	// ErrDirectoryCycle is returned when a symlink in a source points back at a directory
+	// containing it, which would otherwise be copied over and over again forever.
+	ErrDirectoryCycle = errors.New("symlink loops back to a directory it's in")
+)
+
+// Transfer copies files between the local file system and a remote system over SFTP,
+// which sidesteps the differences between versions of scp and the protocol they speak.
+type Transfer struct {
+	// Client is the SFTP client for the remote system.
+	Client *sftp.Client
+
+	// Fs is the local file system, defaults to the OS file system.
+	Fs afero.Fs
+
+	// Recursive copies directories along with everything in them.
+	Recursive bool
+
+	// Preserve keeps the modification times of the copied files. Like scp, the
+	// permissions of the copied files are kept either way.
+	Preserve bool
+
+	// Progress receives a line for every file once it has been copied.
+	Progress io.Writer
+
+	// Remote labels the remote side of the transfer in the progress lines.
+	Remote string
+}
+
+// Upload copies the local sources to the target on the remote system.
+func (t *Transfer) Upload(ctx context.Context, sources []string, target string) error {
+	return t.copyAll(ctx, t.local(), sources, &remoteFs{t.Client}, target)
+}
+
+// Download copies the sources on the remote system to the local target.
+func (t *Transfer) Download(ctx context.Context, sources []string, target string) error {
+	return t.copyAll(ctx, &remoteFs{t.Client}, sources, t.local(), target)
+}
+
+// local returns the local side of the transfer.
+func (t *Transfer) local() fileSystem {
+	if t.Fs == nil {
+		t.Fs = afero.NewOsFs()
+	}
+
+	return &localFs{t.Fs}
+}
+
+// copyAll copies each of the sources to the target. Like scp, when the target is an
+// existing directory, or there's more than one source, sources are placed inside of it.
+func (t *Transfer) copyAll(ctx context.Context, src fileSystem, sources []string, dst fileSystem, target string) error {
+	info, err := dst.Stat(target)
+	intoDirectory := err == nil && info.IsDir()
+
+	if len(sources) > 1 && !intoDirectory {
+		return fmt.Errorf("target %s must be an existing directory when copying multiple sources", target)
+	}
+
+	for _, source := range sources {
+		destination := target
+		if intoDirectory {
+			destination = dst.Join(target, src.Base(source))
+		}
+
+		if err := t.copy(ctx, src, source, dst, destination, map[string]bool{}); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// copy copies a single file, or a directory and everything in it when recursive.
+// Symlinks are followed like scp does, the directories being copied are tracked
+// so a symlink pointing back at one of them fails the copy rather than looping.
+func (t *Transfer) copy(
+	ctx context.Context, src fileSystem, source string, dst fileSystem, destination string, directories map[string]bool,
+) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	info, err := src.Stat(source)
+	if err != nil {
+		return fmt.Errorf("couldn't read %s: %w", source, err)
+	}
+
+	if !info.IsDir() {
+		return t.copyFile(src, source, info, dst, destination)
+	}
+
+	if !t.Recursive {
+		return fmt.Errorf("%w: %s", ErrDirectoryNotRecursive, source)
+	}
+
+	id, err := src.ID(source, info)
+	if err != nil {
+		return fmt.Errorf("couldn't resolve %s: %w", source, err)
+	}
+
+	if directories[id] {
+		return fmt.Errorf("%w: %s", ErrDirectoryCycle, source)
+	}
+
+	directories[id] = true
+	defer delete(directories, id)
+
+	if err := dst.Mkdir(destination); err != nil {
+		return fmt.Errorf("couldn't create directory %s: %w", destination, err)
+	}
+
+	entries, err := src.ReadDir(source)
+	if err != nil {
+		return fmt.Errorf("couldn't read directory %s: %w", source, err)
+	}
+
+	for _, entry := range entries {
+		err := t.copy(ctx, src, src.Join(source, entry.Name()), dst, dst.Join(destination, entry.Name()), directories)
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.attributes(dst, destination, info)
+}
+
+// copyFile copies the contents of a single file and reports on its progress.
+func (t *Transfer) copyFile(src fileSystem, source string, info os.FileInfo, dst fileSystem, destination string) error {
+	start := time.Now()
+
+	in, err := src.Open(source)
+	if err != nil {
+		return fmt.Errorf("couldn't open %s: %w", source, err)
+	}
+	defer in.Close()
+
+	out, err := dst.Create(destination)
+	if err != nil {
+		return fmt.Errorf("couldn't create %s: %w", destination, err)
+	}
+
+	written, err := io.Copy(out, in)
+	if err != nil {
+		out.Close()
+		return fmt.Errorf("couldn't copy %s to %s: %w", source, destination, err)
+	}
+
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("couldn't finish writing %s: %w", destination, err)
+	}
+
+	if err := t.attributes(dst, destination, info); err != nil {
+		return err
+	}
+
+	if t.Progress != nil {
+		fmt.Fprintf(t.Progress, "%s -> %s (%d bytes in %s)\n",
+			src.Label(t.Remote, source), dst.Label(t.Remote, destination), written, time.Since(start).Round(time.Millisecond))
+	}
+
+	return nil
+}
+
+// attributes sets the mode of the destination to match the source,
+// along with the modification time when preserving it.
+func (t *Transfer) attributes(dst fileSystem, destination string, info os.FileInfo) error {
+	if err := dst.Chmod(destination, info.Mode().Perm()); err != nil {
+		return fmt.Errorf("couldn't set mode of %s: %w", destination, err)
+	}
+
+	if !t.Preserve {
+		return nil
+	}
+
+	if err := dst.Chtimes(destination, info.ModTime(), info.ModTime()); err != nil {
+		return fmt.Errorf("couldn't set modification time of %s: %w", destination, err)
+	}
+
+	return nil
+}
+
+// fileSystem is the little bit of a file system a transfer needs
+// so that uploads and downloads can share the same logic.
+type fileSystem interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+	Create(name string) (io.WriteCloser, error)
+	Mkdir(name string) error
+	Chmod(name string, mode os.FileMode) error
+	Chtimes(name string, atime, mtime time.Time) error
+	Join(elem ...string) string
+	Base(name string) string
+	Label(remote, name string) string
+
+	// ID returns something unique to the file no matter which path it's reached through.
+	ID(name string, info os.FileInfo) (string, error)
+}
+
+// localFs is the local side of a transfer.
+type localFs struct {
+	fs afero.Fs
+}
+
+func (l *localFs) Stat(name string) (os.FileInfo, error) { return l.fs.Stat(name) }
+
+func (l *localFs) ReadDir(name string) ([]os.FileInfo, error) { return afero.ReadDir(l.fs, name) }
+
+func (l *localFs) Open(name string) (io.ReadCloser, error) { return l.fs.Open(name) }
+
+func (l *localFs) Create(name string) (io.WriteCloser, error) { return l.fs.Create(name) }
+
+func (l *localFs) Chmod(name string, mode os.FileMode) error { return l.fs.Chmod(name, mode) }
+
+func (l *localFs) Chtimes(name string, atime, mtime time.Time) error {
+	return l.fs.Chtimes(name, atime, mtime)
+}
+
+func (l *localFs) Join(elem ...string) string { return filepath.Join(elem...) }
+
+func (l *localFs) Base(name string) string { return filepath.Base(name) }
+
+func (l *localFs) Label(_, name string) string { return name }
+
+func (l *localFs) ID(name string, info os.FileInfo) (string, error) {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return fmt.Sprintf("%d:%d", stat.Dev, stat.Ino), nil
+	}
+
+	// File systems without inodes, like the in memory ones, don't have symlinks either.
+	return filepath.Clean(name), nil
+}
+
+func (l *localFs) Mkdir(name string) error {
+	if err := l.fs.Mkdir(name, 0o755); err != nil && !errors.Is(err, os.ErrExist) {
+		return err
+	}
+
+	return nil
+}
+
+// remoteFs is the remote side of a transfer.
+type remoteFs struct {
+	client *sftp.Client
+}
+
+func (r *remoteFs) Stat(name string) (os.FileInfo, error) { return r.client.Stat(name) }
+
+func (r *remoteFs) ReadDir(name string) ([]os.FileInfo, error) { return r.client.ReadDir(name) }
+
+func (r *remoteFs) Open(name string) (io.ReadCloser, error) { return r.client.Open(name) }
+
+func (r *remoteFs) Create(name string) (io.WriteCloser, error) { return r.client.Create(name) }
+
+func (r *remoteFs) Chmod(name string, mode os.FileMode) error { return r.client.Chmod(name, mode) }
+
+func (r *remoteFs) Chtimes(name string, atime, mtime time.Time) error {
+	return r.client.Chtimes(name, atime, mtime)
+}
+
+func (r *remoteFs) Join(elem ...string) string { return path.Join(elem...) }
+
+func (r *remoteFs) Base(name string) string { return path.Base(name) }
+
+func (r *remoteFs) Label(remote, name string) string { return remote + ":" + name }
+
+func (r *remoteFs) ID(name string, _ os.FileInfo) (string, error) { return r.client.RealPath(name) }
+
+func (r *remoteFs) Mkdir(name string) error {
+	if err := r.client.Mkdir(name); err != nil {
+		if info, statErr := r.client.Stat(name); statErr == nil && info.IsDir() {
+			return nil
+		}
+
+		return err
+	}
+
+	return nil
+}
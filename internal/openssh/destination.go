@@ -0,0 +1,205 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+)
+
+// These are the backends the plugins can use to connect to remote systems.
+const (
+	// BackendOpenSSH executes the OpenSSH binaries (and sshpass when needed).
+	BackendOpenSSH = "openssh"
+
+	// BackendNative connects to remote systems in process using golang.org/x/crypto/ssh.
+	BackendNative = "native"
+
+	// DefaultPort is the port used when a destination doesn't specify one.
+	DefaultPort = 22
+)
+
+var (
+	// ErrUnknownBackend is returned when the plugin is configured with a backend that doesn't exist.
+	ErrUnknownBackend = fmt.Errorf("unknown backend, use either %q or %q", BackendOpenSSH, BackendNative)
+
+	// ErrInvalidDestination is returned when a destination can't be parsed.
+	ErrInvalidDestination = errors.New("invalid destination")
+)
+
+// ValidateBackend checks that the backend is one that exists, with an empty backend meaning the default.
+func ValidateBackend(backend string) error {
+	switch backend {
+	case "", BackendOpenSSH, BackendNative:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownBackend, backend)
+	}
+}
+
+// Destination is a remote system broken down into the parts needed to connect to it.
+type Destination struct {
+	User string
+	Host string
+	Port int
+}
+
+// ParseDestination breaks down a destination given in any of the forms ssh accepts,
+// either [user@]host or ssh://[user@]host[:port]. When the user or port are missing
+// they default to the current user and port 22, just like they would for ssh.
+func ParseDestination(destination string) (Destination, error) {
+	return SSHConfig{}.ParseDestination(destination)
+}
+
+// ParseDestination breaks down a destination just like the package level ParseDestination,
+// except that a missing user or port default to the ones in the config when they're set.
+func (c SSHConfig) ParseDestination(destination string) (Destination, error) {
+	d := Destination{Port: DefaultPort}
+	if c.Port != 0 {
+		d.Port = c.Port
+	}
+
+	if strings.HasPrefix(destination, "ssh://") {
+		u, err := url.Parse(destination)
+		if err != nil {
+			return d, fmt.Errorf("%w: %w", ErrInvalidDestination, err)
+		}
+
+		d.User = u.User.Username()
+		d.Host = u.Hostname()
+
+		if u.Port() != "" {
+			port, err := strconv.Atoi(u.Port())
+			if err != nil {
+				return d, fmt.Errorf("%w: bad port %q", ErrInvalidDestination, u.Port())
+			}
+
+			d.Port = port
+		}
+	} else {
+		host := destination
+		if i := strings.LastIndex(destination, "@"); i >= 0 {
+			d.User, host = destination[:i], destination[i+1:]
+		}
+
+		d.Host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	}
+
+	if d.Host == "" {
+		return d, fmt.Errorf("%w: missing host in %q", ErrInvalidDestination, destination)
+	}
+
+	if d.User == "" {
+		d.User = c.User
+	}
+
+	if d.User == "" {
+		d.User = CurrentUser()
+	}
+
+	return d, nil
+}
+
+// ParseLocation breaks down a source or target given to scp, which is either a local path,
+// a remote path in the form [user@]host:path, or scp://[user@]host[:port][/path]. Just like
+// scp, anything with a slash before the first colon is treated as a local path. Remote paths
+// are returned relative to the home directory of the user unless they're absolute.
+func ParseLocation(location string) (Destination, string, bool, error) {
+	return SSHConfig{}.ParseLocation(location)
+}
+
+// ParseLocation breaks down a source or target just like the package level ParseLocation,
+// except that a missing user or port default to the ones in the config when they're set.
+func (c SSHConfig) ParseLocation(location string) (Destination, string, bool, error) {
+	if strings.HasPrefix(location, "scp://") {
+		u, err := url.Parse(location)
+		if err != nil {
+			return Destination{}, "", false, fmt.Errorf("%w: %w", ErrInvalidDestination, err)
+		}
+
+		d, err := c.ParseDestination("ssh://" + u.Host)
+		if u.User != nil {
+			d.User = u.User.Username()
+		}
+
+		return d, remotePath(strings.TrimPrefix(u.Path, "/")), true, err
+	}
+
+	colon := remoteColon(location)
+	if colon < 0 {
+		return Destination{}, location, false, nil
+	}
+
+	d, err := c.ParseDestination(location[:colon])
+
+	return d, remotePath(location[colon+1:]), true, err
+}
+
+// remoteColon returns the index of the colon separating the host from the path
+// in a remote location, or -1 if the location is a local path. Colons inside
+// of brackets are part of an IPv6 address rather than the separator.
+func remoteColon(location string) int {
+	bracketed := false
+
+	for i, r := range location {
+		switch {
+		case r == '[':
+			bracketed = true
+		case r == ']':
+			bracketed = false
+		case r == '/' && !bracketed:
+			return -1
+		case r == ':' && !bracketed:
+			if i == 0 {
+				return -1
+			}
+
+			return i
+		}
+	}
+
+	return -1
+}
+
+// remotePath turns a path on a remote system into one relative to the home directory,
+// since that's where SFTP starts out, with an empty path meaning the home directory itself.
+func remotePath(path string) string {
+	switch {
+	case path == "" || path == "~":
+		return "."
+	case strings.HasPrefix(path, "~/"):
+		return strings.TrimPrefix(path, "~/")
+	default:
+		return path
+	}
+}
+
+// Address returns the host and port in the form expected when dialing.
+func (d Destination) Address() string {
+	return net.JoinHostPort(d.Host, strconv.Itoa(d.Port))
+}
+
+// String returns the destination in the ssh:// form.
+func (d Destination) String() string {
+	return fmt.Sprintf("ssh://%s@%s", d.User, d.Address())
+}
+
+// CurrentUser returns the name of the user running the plugin, which
+// is the user ssh falls back to when a destination doesn't include one.
+func CurrentUser() string {
+	if u, err := user.Current(); err == nil && u.Username != "" {
+		return u.Username
+	}
+
+	if name := os.Getenv("USER"); name != "" {
+		return name
+	}
+
+	return "root"
+}
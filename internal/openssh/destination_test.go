@@ -0,0 +1,111 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseDestination(t *testing.T) {
+	tests := map[string]struct {
+		destination string
+		want        Destination
+	}{
+		"user and host": {
+			destination: "some-user@some-host",
+			want:        Destination{User: "some-user", Host: "some-host", Port: DefaultPort},
+		},
+		"ssh schema with port": {
+			destination: "ssh://some-user@some-host:2222",
+			want:        Destination{User: "some-user", Host: "some-host", Port: 2222},
+		},
+		"ssh schema with ipv6 host": {
+			destination: "ssh://some-user@[::1]:2222",
+			want:        Destination{User: "some-user", Host: "::1", Port: 2222},
+		},
+		"host only uses current user": {
+			destination: "some-host",
+			want:        Destination{User: CurrentUser(), Host: "some-host", Port: DefaultPort},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseDestination(test.destination)
+			if err != nil {
+				t.Errorf("ParseDestination() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			if got != test.want {
+				t.Errorf("ParseDestination() mismatch\ngot:    %+v\nwanted: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseDestinationErrors(t *testing.T) {
+	for _, destination := range []string{"", "some-user@", "ssh://some-user@some-host:port"} {
+		if _, err := ParseDestination(destination); !errors.Is(err, ErrInvalidDestination) {
+			t.Errorf("ParseDestination(%q) returned wrong error\ngot:    %s\nwanted: %s", destination, err, ErrInvalidDestination)
+		}
+	}
+}
+
+func TestParseLocation(t *testing.T) {
+	tests := map[string]struct {
+		location        string
+		wantDestination Destination
+		wantPath        string
+		wantRemote      bool
+	}{
+		"local relative path": {
+			location: "some/local/file",
+			wantPath: "some/local/file",
+		},
+		"local path with colon after slash": {
+			location: "./some:file",
+			wantPath: "./some:file",
+		},
+		"remote path relative to home": {
+			location:        "some-user@some-host:~/some/path",
+			wantDestination: Destination{User: "some-user", Host: "some-host", Port: DefaultPort},
+			wantPath:        "some/path",
+			wantRemote:      true,
+		},
+		"remote absolute path on ipv6 host": {
+			location:        "some-user@[::1]:/some/path",
+			wantDestination: Destination{User: "some-user", Host: "::1", Port: DefaultPort},
+			wantPath:        "/some/path",
+			wantRemote:      true,
+		},
+		"remote home directory": {
+			location:        "some-user@some-host:",
+			wantDestination: Destination{User: "some-user", Host: "some-host", Port: DefaultPort},
+			wantPath:        ".",
+			wantRemote:      true,
+		},
+		"scp schema with port": {
+			location:        "scp://some-user@some-host:1234/some/path",
+			wantDestination: Destination{User: "some-user", Host: "some-host", Port: 1234},
+			wantPath:        "some/path",
+			wantRemote:      true,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			destination, path, remote, err := ParseLocation(test.location)
+			if err != nil {
+				t.Errorf("ParseLocation() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			if destination != test.wantDestination || path != test.wantPath || remote != test.wantRemote {
+				t.Errorf("ParseLocation() mismatch\ngot:    %+v %q %t\nwanted: %+v %q %t",
+					destination, path, remote, test.wantDestination, test.wantPath, test.wantRemote)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ErrInvalidIdentities is returned when the identities parameter can't be parsed.
+var ErrInvalidIdentities = errors.New("invalid identity")
+
+// identityOptions are the options each of the identities accepts.
+var identityOptions = []string{
+	"contents",
+	"passphrase",
+}
+
+// identityAliases are the other names the identity options are known by.
+var identityAliases = map[string]string{
+	"identityfilecontents": "contents",
+	"key":                  "contents",
+	"privatekey":           "contents",
+	"sshpasspassphrase":    "passphrase",
+}
+
+// IdentityEntry is one of several identity files that are tried in turn, each with its own passphrase.
+type IdentityEntry struct {
+	// Contents are the raw contents of the identity file.
+	Contents string
+
+	// Passphrase unlocks the identity file if it's encrypted.
+	Passphrase string
+}
+
+// ParseIdentities parses the identities parameter, which is a list of identity files given as
+// either JSON or YAML in the order they're tried. Each is either the contents of the identity
+// file or a map with its contents and optionally a passphrase. Values are expanded with any
+// environmental variables so they can be given using secrets.
+func ParseIdentities(raw string) ([]IdentityEntry, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	entries := []any{}
+	if err := yaml.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdentities, err)
+	}
+
+	identities := make([]IdentityEntry, 0, len(entries))
+
+	for i, entry := range entries {
+		identity, err := parseIdentityEntry(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w #%d: %w", ErrInvalidIdentities, i+1, err)
+		}
+
+		identities = append(identities, identity)
+	}
+
+	return identities, nil
+}
+
+// parseIdentityEntry parses a single entry from the identities parameter.
+func parseIdentityEntry(entry any) (IdentityEntry, error) {
+	identity := IdentityEntry{}
+
+	switch e := entry.(type) {
+	case string:
+		identity.Contents = os.ExpandEnv(e)
+	case map[string]any:
+		for name, value := range e {
+			option, err := lookupOption(name, identityOptions, identityAliases)
+			if err != nil {
+				return identity, fmt.Errorf("unknown option %w", err)
+			}
+
+			s, ok := value.(string)
+			if !ok {
+				return identity, fmt.Errorf("%s: expected a string but got %v", name, value)
+			}
+
+			if option == "contents" {
+				identity.Contents = os.ExpandEnv(s)
+			} else {
+				identity.Passphrase = os.ExpandEnv(s)
+			}
+		}
+	default:
+		return identity, fmt.Errorf("expected the identity file contents or a map but got %v", entry)
+	}
+
+	if strings.TrimSpace(identity.Contents) == "" {
+		return identity, errors.New("missing contents")
+	}
+
+	return identity, nil
+}
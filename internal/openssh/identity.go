@@ -0,0 +1,303 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+
+	"golang.org/x/crypto/ssh"
+)
+
+var (
+	// ErrInvalidIdentity is returned when identity file contents can't be parsed as a private key.
+	ErrInvalidIdentity = errors.New("invalid identity file contents")
+
+	// ErrPublicKeyIdentity is returned when identity file contents hold a public key rather than a private key.
+	ErrPublicKeyIdentity = errors.New("identity file contents hold a public key rather than a private key")
+)
+
+// These are the ways the plugins can hand identity files decrypted with the passphrase to the binaries.
+const (
+	// PassphraseModeAgent loads the decrypted identity files into a private agent, so they're only ever in memory.
+	PassphraseModeAgent = "agent"
+
+	// PassphraseModeFile writes the decrypted identity files into restricted files that the binaries use directly.
+	PassphraseModeFile = "file"
+)
+
+// ErrUnknownPassphraseMode is returned when the plugin is configured with a passphrase mode that doesn't exist.
+var ErrUnknownPassphraseMode = fmt.Errorf("unknown passphrase mode, use either %q or %q", PassphraseModeAgent, PassphraseModeFile)
+
+// ValidatePassphraseMode checks that the passphrase mode is one that exists, with an empty mode meaning the default.
+func ValidatePassphraseMode(mode string) error {
+	switch mode {
+	case "", PassphraseModeAgent, PassphraseModeFile:
+		return nil
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownPassphraseMode, mode)
+	}
+}
+
+// FormatOpenSSH is the format of identity files that are used as they are, rather than being converted.
+const FormatOpenSSH = "OpenSSH"
+
+// puttyPrefix starts every PuTTY .ppk file.
+const puttyPrefix = "PuTTY-User-Key-File-"
+
+// pemFormats describes the formats of private keys by the type of their PEM block.
+var pemFormats = map[string]string{
+	"OPENSSH PRIVATE KEY":   FormatOpenSSH,
+	"RSA PRIVATE KEY":       "PKCS#1",
+	"EC PRIVATE KEY":        "SEC 1",
+	"PRIVATE KEY":           "PKCS#8",
+	"ENCRYPTED PRIVATE KEY": "encrypted PKCS#8",
+}
+
+// pemBoundary matches the BEGIN and END lines of a PEM block, even when the newlines
+// around them have been lost and they're run together with the rest of the contents.
+var pemBoundary = regexp.MustCompile(`-----(BEGIN|END) ([A-Z0-9 ]+)-----`)
+
+// Identity describes identity file contents once they've been parsed and normalized.
+type Identity struct {
+	// Contents are the normalized identity file contents, ready to be written to a file.
+	Contents string
+
+	// Format is the format the contents were given in, like PuTTY .ppk v3 or PKCS#8.
+	// Anything other than FormatOpenSSH has been converted to an OpenSSH private key.
+	Format string
+
+	// Type and Fingerprint describe the key, like ssh-ed25519 and the SHA256:... form printed by
+	// ssh-keygen -l. They're empty for encrypted keys that don't say what their public key is.
+	Type        string
+	Fingerprint string
+
+	// Encrypted is true when the key needs a passphrase.
+	Encrypted bool
+
+	// Fixes describe each of the ways the contents had to be repaired.
+	Fixes []string
+}
+
+// ParseIdentity normalizes identity file contents that have been mangled on their way into a
+// secret, such as newlines that were escaped or turned into CRLF line endings, a missing trailing
+// newline, being base64 encoded, or the newlines within the key being replaced by spaces. It then
+// parses the key, decrypting it with the passphrase if it's encrypted and one is given, so that
+// the problem can be reported up front instead of ssh saying nothing but "invalid format".
+//
+// Keys in the PuTTY .ppk v2 and v3, PKCS#1, SEC 1, PKCS#8 and encrypted PKCS#8 formats are
+// converted to an OpenSSH private key, which stays encrypted with the passphrase if it was.
+// Encrypted PuTTY .ppk and PKCS#8 keys can't be converted without the passphrase.
+func ParseIdentity(contents, passphrase string) (Identity, error) {
+	identity := Identity{}
+	identity.Contents, identity.Fixes = normalizeIdentity(contents)
+
+	if publicKey := parsePublicKey(identity.Contents); publicKey != nil {
+		return identity, fmt.Errorf("%w (%s %s), use the private key it belongs to instead",
+			ErrPublicKeyIdentity, publicKey.Type(), ssh.FingerprintSHA256(publicKey))
+	}
+
+	key, comment, err := identity.parse(passphrase)
+	if err != nil || key == nil {
+		return identity, err
+	}
+
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		return identity, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	identity.Type, identity.Fingerprint = signer.PublicKey().Type(), ssh.FingerprintSHA256(signer.PublicKey())
+
+	if identity.Format == FormatOpenSSH {
+		return identity, nil
+	}
+
+	var block *pem.Block
+	if identity.Encrypted {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(key, comment, []byte(passphrase))
+	} else {
+		block, err = ssh.MarshalPrivateKey(key, comment)
+	}
+
+	if err != nil {
+		return identity, fmt.Errorf("%w: couldn't convert %s key to the OpenSSH format: %w", ErrInvalidIdentity, identity.Format, err)
+	}
+
+	identity.Contents = string(pem.EncodeToMemory(block))
+
+	return identity, nil
+}
+
+// parse works out the format of the identity and parses its key, returning the key along with its
+// comment. The key is nil when it's encrypted and there isn't a passphrase, so it's left as it is.
+func (i *Identity) parse(passphrase string) (any, string, error) {
+	if strings.HasPrefix(i.Contents, puttyPrefix) {
+		file, key, err := parsePuTTY(i.Contents, passphrase)
+		i.Format = fmt.Sprintf("PuTTY .ppk v%d", file.version)
+		i.Encrypted = file.encryption != "" && file.encryption != "none"
+
+		return key, file.comment, err
+	}
+
+	i.Format = FormatOpenSSH
+
+	if block, _ := pem.Decode([]byte(i.Contents)); block != nil && pemFormats[block.Type] != "" {
+		i.Format = pemFormats[block.Type]
+	}
+
+	if i.Format == "encrypted PKCS#8" {
+		i.Encrypted = true
+
+		if passphrase == "" {
+			return nil, "", fmt.Errorf("%w: the PKCS#8 key is encrypted, so the passphrase is needed to convert it", ErrInvalidIdentity)
+		}
+
+		block, _ := pem.Decode([]byte(i.Contents))
+		key, err := decryptPKCS8(block.Bytes, passphrase)
+
+		return key, "", err
+	}
+
+	key, err := ssh.ParseRawPrivateKey([]byte(i.Contents))
+
+	var missing *ssh.PassphraseMissingError
+	if errors.As(err, &missing) {
+		i.Encrypted = true
+
+		if missing.PublicKey != nil {
+			i.Type, i.Fingerprint = missing.PublicKey.Type(), ssh.FingerprintSHA256(missing.PublicKey)
+		}
+
+		if passphrase == "" {
+			return nil, "", nil
+		}
+
+		key, err = ssh.ParseRawPrivateKeyWithPassphrase([]byte(i.Contents), []byte(passphrase))
+	}
+
+	if err != nil {
+		return nil, "", fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	return key, "", nil
+}
+
+// normalizeIdentity repairs the common ways identity file contents get mangled, returning
+// the repaired contents along with a description of each repair that was needed.
+func normalizeIdentity(contents string) (string, []string) {
+	fixes := []string{}
+	normalized := strings.TrimSpace(contents)
+
+	if !strings.Contains(normalized, "\n") && strings.Contains(normalized, `\n`) {
+		normalized = strings.TrimSpace(strings.ReplaceAll(strings.ReplaceAll(normalized, `\r\n`, `\n`), `\n`, "\n"))
+		fixes = append(fixes, `replaced escaped \n with newlines`)
+	}
+
+	if strings.Contains(normalized, "\r") {
+		normalized = strings.ReplaceAll(strings.ReplaceAll(normalized, "\r\n", "\n"), "\r", "\n")
+		fixes = append(fixes, "converted CRLF line endings")
+	}
+
+	if !strings.HasPrefix(normalized, "-----") && !strings.HasPrefix(normalized, puttyPrefix) && parsePublicKey(normalized) == nil {
+		compact := strings.Join(strings.Fields(normalized), "")
+
+		if decoded, err := base64.StdEncoding.DecodeString(compact); err == nil &&
+			(strings.Contains(string(decoded), "-----BEGIN") || strings.HasPrefix(string(decoded), puttyPrefix)) {
+			decodedNormalized, decodedFixes := normalizeIdentity(string(decoded))
+			normalized = strings.TrimSpace(decodedNormalized)
+			fixes = append(append(fixes, "decoded base64 encoded contents"), decodedFixes...)
+		}
+	}
+
+	if rewrapped, ok := rewrapPEM(normalized); ok {
+		normalized = rewrapped
+		fixes = append(fixes, "restored newlines within the key")
+	}
+
+	return normalized + "\n", fixes
+}
+
+// rewrapPEM puts back the newlines in a PEM block that's lost them, such as when they've been
+// replaced by spaces, returning false if the block is fine as it is or can't be repaired.
+func rewrapPEM(contents string) (string, bool) {
+	if block, _ := pem.Decode([]byte(contents + "\n")); block != nil {
+		return "", false
+	}
+
+	boundaries := pemBoundary.FindAllStringSubmatchIndex(contents, -1)
+	if len(boundaries) != 2 || contents[boundaries[0][2]:boundaries[0][3]] != "BEGIN" {
+		return "", false
+	}
+
+	begin, end := contents[boundaries[0][0]:boundaries[0][1]], contents[boundaries[1][0]:boundaries[1][1]]
+	body := strings.Join(strings.Fields(contents[boundaries[0][1]:boundaries[1][0]]), "")
+
+	// Encrypted keys in the older PEM format have headers that can't be told apart once
+	// their newlines are gone, so those are left for the parser to complain about.
+	if strings.Contains(body, ":") {
+		return "", false
+	}
+
+	lines := []string{begin}
+
+	for len(body) > 70 {
+		lines = append(lines, body[:70])
+		body = body[70:]
+	}
+
+	lines = append(lines, body, end)
+
+	rewrapped := strings.Join(lines, "\n")
+	if block, _ := pem.Decode([]byte(rewrapped + "\n")); block == nil {
+		return "", false
+	}
+
+	return rewrapped, true
+}
+
+// parsePublicKey returns the public key held by the contents, in either
+// the authorized_keys format or the RFC 4716 format, or nil if there isn't one.
+func parsePublicKey(contents string) ssh.PublicKey {
+	if publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(contents)); err == nil {
+		return publicKey
+	}
+
+	if !strings.HasPrefix(contents, "---- BEGIN SSH2 PUBLIC KEY ----") {
+		return nil
+	}
+
+	lines := []string{}
+	continued := false
+
+	for _, line := range strings.Split(contents, "\n")[1:] {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "----") {
+			break
+		}
+
+		// Header lines, which may continue onto the next with a trailing backslash, are skipped.
+		header := continued || strings.Contains(line, ":")
+		continued = header && strings.HasSuffix(line, `\`)
+
+		if !header {
+			lines = append(lines, line)
+		}
+	}
+
+	decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines, ""))
+	if err != nil {
+		return nil
+	}
+
+	publicKey, err := ssh.ParsePublicKey(decoded)
+	if err != nil {
+		return nil
+	}
+
+	return publicKey
+}
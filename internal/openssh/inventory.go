@@ -0,0 +1,723 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/afero"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// InventoryAll is the group every host of an inventory is in, which is
+	// also the pattern that selects all of them.
+	InventoryAll = "all"
+
+	// inventoryUngrouped is the group of the hosts that aren't in any other group.
+	inventoryUngrouped = "ungrouped"
+)
+
+var (
+	// ErrInvalidInventory is returned when the inventory can't be read or parsed.
+	ErrInvalidInventory = errors.New("invalid inventory")
+
+	// ErrMissingInventory is returned when hosts are selected without an inventory to select them from.
+	ErrMissingInventory = errors.New("missing inventory to select the hosts from")
+
+	// ErrNoInventoryHosts is returned when the pattern doesn't select any of the hosts in the inventory.
+	ErrNoInventoryHosts = errors.New("no hosts in the inventory match")
+
+	// ErrUnknownHostVariable is returned when a template references a variable the host doesn't have.
+	ErrUnknownHostVariable = errors.New("unknown host variable")
+)
+
+// hostRange matches a range of hosts like web[01:10].example.com, optionally with a stride.
+var hostRange = regexp.MustCompile(`^(.*?)\[([0-9]+|[a-z]):([0-9]+|[a-z])(?::([0-9]+))?\](.*)$`)
+
+// templateVariable matches a reference to a host variable in a template, like {{ app_version }}.
+var templateVariable = regexp.MustCompile(`\{\{\s*([A-Za-z_][A-Za-z0-9_]*)\s*\}\}`)
+
+// Inventory is an Ansible-style inventory of hosts, the groups they're in and their variables.
+type Inventory struct {
+	hosts      []string
+	hostVars   map[string]map[string]string
+	groups     map[string]*inventoryGroup
+	groupOrder []string
+	depths     map[string]int
+}
+
+// inventoryGroup is a group of an inventory, with the hosts and groups that are in it.
+type inventoryGroup struct {
+	hosts    []string
+	children []string
+	vars     map[string]string
+}
+
+// InventoryHost is a host selected from an inventory along with its variables, which
+// are those of its groups overridden by those of any groups nested in them, then by
+// its own. The inventory_hostname variable is always set to the name of the host.
+type InventoryHost struct {
+	Name string
+	Vars map[string]string
+}
+
+// LoadInventory parses the inventory from its contents, or reads it from the path when there
+// aren't any contents. It returns no inventory at all when neither of them are given.
+func LoadInventory(fs afero.Fs, contents, path string) (*Inventory, error) {
+	if strings.TrimSpace(contents) != "" {
+		return ParseInventory(contents)
+	}
+
+	if path == "" {
+		return nil, nil
+	}
+
+	raw, err := afero.ReadFile(fs, path)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInventory, err)
+	}
+
+	return ParseInventory(string(raw))
+}
+
+// ParseInventory parses an inventory in either of the formats Ansible accepts, YAML or INI.
+// Hosts can be given as ranges like web[01:10].example.com, and values are expanded with
+// any environmental variables so they can be given using secrets.
+func ParseInventory(raw string) (*Inventory, error) {
+	inventory := &Inventory{
+		hostVars: map[string]map[string]string{},
+		groups:   map[string]*inventoryGroup{},
+	}
+
+	inventory.group(InventoryAll)
+
+	var (
+		document yaml.Node
+		err      error
+	)
+
+	// INI inventories are rarely valid YAML, and never a map when they are.
+	if yaml.Unmarshal([]byte(raw), &document) == nil && len(document.Content) > 0 && document.Content[0].Kind == yaml.MappingNode {
+		err = inventory.parseYAML(document.Content[0])
+	} else {
+		err = inventory.parseINI(raw)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidInventory, err)
+	}
+
+	inventory.finish()
+
+	return inventory, nil
+}
+
+// parseYAML parses the groups at the top of a YAML inventory, which is usually just all.
+func (inv *Inventory) parseYAML(root *yaml.Node) error {
+	return forEachEntry(root, inv.parseYAMLGroup)
+}
+
+// parseYAMLGroup parses a group of a YAML inventory with its hosts, children and vars.
+func (inv *Inventory) parseYAMLGroup(name string, node *yaml.Node) error {
+	inv.group(name)
+
+	return forEachEntry(node, func(key string, value *yaml.Node) error {
+		switch key {
+		case "hosts":
+			return forEachEntry(value, func(host string, varsNode *yaml.Node) error {
+				vars, err := yamlVars(varsNode)
+				if err != nil {
+					return fmt.Errorf("host %s: %w", host, err)
+				}
+
+				return inv.addHosts(name, host, vars)
+			})
+		case "children":
+			return forEachEntry(value, func(child string, childNode *yaml.Node) error {
+				inv.addChild(name, child)
+
+				return inv.parseYAMLGroup(child, childNode)
+			})
+		case "vars":
+			vars, err := yamlVars(value)
+			if err != nil {
+				return fmt.Errorf("group %s: %w", name, err)
+			}
+
+			maps.Copy(inv.groups[name].vars, vars)
+
+			return nil
+		default:
+			return fmt.Errorf("group %s: unknown key %q, expected hosts, children or vars", name, key)
+		}
+	})
+}
+
+// forEachEntry calls the function for each entry of a YAML map in order, where an empty
+// value is treated the same as an empty map since that's how hosts without vars look.
+func forEachEntry(node *yaml.Node, fn func(key string, value *yaml.Node) error) error {
+	if node == nil || node.Tag == "!!null" {
+		return nil
+	}
+
+	if node.Kind != yaml.MappingNode {
+		return fmt.Errorf("line %d: expected a map", node.Line)
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if err := fn(node.Content[i].Value, node.Content[i+1]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// yamlVars turns a YAML map of variables into strings, with anything
+// that isn't a string or a number encoded as JSON like Ansible would.
+func yamlVars(node *yaml.Node) (map[string]string, error) {
+	vars := map[string]string{}
+
+	err := forEachEntry(node, func(key string, value *yaml.Node) error {
+		var decoded any
+		if err := value.Decode(&decoded); err != nil {
+			return err
+		}
+
+		switch v := decoded.(type) {
+		case nil:
+			vars[key] = ""
+		case string:
+			vars[key] = os.ExpandEnv(v)
+		case int, float64, bool:
+			vars[key] = fmt.Sprint(v)
+		default:
+			encoded, err := json.Marshal(v)
+			if err != nil {
+				return fmt.Errorf("%s: %w", key, err)
+			}
+
+			vars[key] = string(encoded)
+		}
+
+		return nil
+	})
+
+	return vars, err
+}
+
+// parseINI parses an INI inventory, where hosts come before any sections or under a [group]
+// section with their vars as key=value pairs, while [group:vars] sections hold the vars of the
+// group and [group:children] sections list the groups nested in it.
+func (inv *Inventory) parseINI(raw string) error {
+	group, kind := "", ""
+
+	for i, line := range strings.Split(raw, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			group, kind, _ = strings.Cut(line[1:len(line)-1], ":")
+
+			if kind != "" && kind != "vars" && kind != "children" {
+				return fmt.Errorf("line %d: unknown section %q, expected vars or children", i+1, kind)
+			}
+
+			inv.group(group)
+
+			continue
+		}
+
+		fields, err := splitFields(line)
+		if err != nil {
+			return fmt.Errorf("line %d: %w", i+1, err)
+		}
+
+		switch kind {
+		case "vars":
+			key, value, ok := strings.Cut(line, "=")
+			if !ok {
+				return fmt.Errorf("line %d: expected key=value", i+1)
+			}
+
+			values, err := splitFields(value)
+			if err != nil || len(values) != 1 {
+				return fmt.Errorf("line %d: expected a single value for %s", i+1, strings.TrimSpace(key))
+			}
+
+			inv.groups[group].vars[strings.TrimSpace(key)] = os.ExpandEnv(values[0])
+		case "children":
+			inv.addChild(group, fields[0])
+		default:
+			vars := map[string]string{}
+
+			for _, field := range fields[1:] {
+				key, value, ok := strings.Cut(field, "=")
+				if !ok {
+					return fmt.Errorf("line %d: expected key=value but got %q", i+1, field)
+				}
+
+				vars[key] = os.ExpandEnv(value)
+			}
+
+			if err := inv.addHosts(group, fields[0], vars); err != nil {
+				return fmt.Errorf("line %d: %w", i+1, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+// splitFields splits a line of an INI inventory on whitespace, keeping quoted values together.
+func splitFields(line string) ([]string, error) {
+	var (
+		fields  []string
+		field   strings.Builder
+		quote   rune
+		inField bool
+	)
+
+	for _, r := range line {
+		switch {
+		case quote != 0 && r == quote:
+			quote = 0
+		case quote != 0:
+			field.WriteRune(r)
+		case r == '"' || r == '\'':
+			quote, inField = r, true
+		case r == ' ' || r == '\t':
+			if inField {
+				fields = append(fields, field.String())
+				field.Reset()
+				inField = false
+			}
+		default:
+			field.WriteRune(r)
+			inField = true
+		}
+	}
+
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated quote in %q", line)
+	}
+
+	if inField {
+		fields = append(fields, field.String())
+	}
+
+	return fields, nil
+}
+
+// group returns the group with the name, creating it if it doesn't exist yet.
+func (inv *Inventory) group(name string) *inventoryGroup {
+	group, ok := inv.groups[name]
+	if !ok {
+		group = &inventoryGroup{vars: map[string]string{}}
+		inv.groups[name] = group
+		inv.groupOrder = append(inv.groupOrder, name)
+	}
+
+	return group
+}
+
+// addHosts adds the host, or each of the hosts in its range, to the group with the vars.
+// A port given along with the host, like host:2222, is taken as its ansible_port.
+func (inv *Inventory) addHosts(group, pattern string, vars map[string]string) error {
+	names, err := expandHostRange(pattern)
+	if err != nil {
+		return err
+	}
+
+	for _, name := range names {
+		hostVars := maps.Clone(vars)
+
+		if host, port, ok := strings.Cut(name, ":"); ok && !strings.Contains(port, ":") {
+			if _, err := strconv.Atoi(port); err == nil {
+				name = host
+				hostVars["ansible_port"] = port
+			}
+		}
+
+		if _, ok := inv.hostVars[name]; !ok {
+			inv.hosts = append(inv.hosts, name)
+			inv.hostVars[name] = map[string]string{}
+		}
+
+		maps.Copy(inv.hostVars[name], hostVars)
+
+		if group != "" && !slices.Contains(inv.group(group).hosts, name) {
+			inv.groups[group].hosts = append(inv.groups[group].hosts, name)
+		}
+	}
+
+	return nil
+}
+
+// addChild nests the child group in the parent group.
+func (inv *Inventory) addChild(parent, child string) {
+	inv.group(child)
+
+	if p := inv.group(parent); !slices.Contains(p.children, child) {
+		p.children = append(p.children, child)
+	}
+}
+
+// expandHostRange expands a host with ranges like web[01:10].example.com or db-[a:c] into
+// each of the hosts in them, keeping the leading zeros of numeric ranges.
+func expandHostRange(pattern string) ([]string, error) {
+	match := hostRange.FindStringSubmatch(pattern)
+	if match == nil {
+		return []string{pattern}, nil
+	}
+
+	prefix, start, end, strideText, suffix := match[1], match[2], match[3], match[4], match[5]
+
+	stride := 1
+	if strideText != "" {
+		stride, _ = strconv.Atoi(strideText)
+	}
+
+	var values []string
+
+	first, firstErr := strconv.Atoi(start)
+	last, lastErr := strconv.Atoi(end)
+
+	switch {
+	case stride < 1:
+		return nil, fmt.Errorf("bad stride in host range %s", pattern)
+	case firstErr == nil && lastErr == nil && first <= last:
+		width := 0
+		if strings.HasPrefix(start, "0") {
+			width = len(start)
+		}
+
+		for n := first; n <= last; n += stride {
+			values = append(values, fmt.Sprintf("%0*d", width, n))
+		}
+	case firstErr != nil && lastErr != nil && start <= end:
+		for r := start[0]; r <= end[0]; r += byte(stride) {
+			values = append(values, string(r))
+		}
+	default:
+		return nil, fmt.Errorf("bad host range %s", pattern)
+	}
+
+	hosts := []string{}
+
+	for _, value := range values {
+		expanded, err := expandHostRange(prefix + value + suffix)
+		if err != nil {
+			return nil, err
+		}
+
+		hosts = append(hosts, expanded...)
+	}
+
+	return hosts, nil
+}
+
+// finish nests every group without a parent in all, puts the hosts that aren't in
+// any group in ungrouped, and works out how deeply each group is nested.
+func (inv *Inventory) finish() {
+	parented := map[string]bool{}
+
+	for _, group := range inv.groups {
+		for _, child := range group.children {
+			parented[child] = true
+		}
+	}
+
+	grouped := map[string]bool{}
+
+	for _, name := range inv.groupOrder {
+		if name == InventoryAll {
+			continue
+		}
+
+		for _, host := range inv.groups[name].hosts {
+			grouped[host] = true
+		}
+	}
+
+	for _, host := range inv.hosts {
+		if !grouped[host] {
+			inv.group(inventoryUngrouped).hosts = append(inv.group(inventoryUngrouped).hosts, host)
+		}
+	}
+
+	for _, name := range inv.groupOrder {
+		if name != InventoryAll && !parented[name] {
+			inv.addChild(InventoryAll, name)
+		}
+	}
+
+	// Groups nested more deeply take precedence, so their depth is the longest way down to
+	// them from all. It's bounded by the number of groups in case they're nested in a loop.
+	inv.depths = map[string]int{InventoryAll: 0}
+
+	for range inv.groupOrder {
+		for _, name := range inv.groupOrder {
+			depth, ok := inv.depths[name]
+			if !ok {
+				continue
+			}
+
+			for _, child := range inv.groups[name].children {
+				if d, ok := inv.depths[child]; (!ok || d < depth+1) && depth+1 < len(inv.groupOrder) {
+					inv.depths[child] = depth + 1
+				}
+			}
+		}
+	}
+}
+
+// members returns every host in the group, including those in the groups nested in it.
+func (inv *Inventory) members(name string, seen map[string]bool) []string {
+	if name == InventoryAll {
+		return inv.hosts
+	}
+
+	if seen[name] {
+		return nil
+	}
+
+	seen[name] = true
+
+	group := inv.groups[name]
+	hosts := slices.Clone(group.hosts)
+
+	for _, child := range group.children {
+		hosts = append(hosts, inv.members(child, seen)...)
+	}
+
+	return hosts
+}
+
+// Select returns the hosts matching the pattern in the order they're in the inventory. Like
+// Ansible, a pattern is a list of groups or hosts separated by commas or colons, which can use
+// wildcards like web* or be regular expressions like ~web\d+. Those starting with & narrow the
+// selection down to the hosts that are also in them, and those starting with ! exclude their
+// hosts. An empty pattern selects all of the hosts.
+func (inv *Inventory) Select(pattern string) ([]InventoryHost, error) {
+	if strings.TrimSpace(pattern) == "" {
+		pattern = InventoryAll
+	}
+
+	union := map[string]bool{}
+	intersections := []map[string]bool{}
+	excluded := map[string]bool{}
+
+	for _, term := range patternTerms(pattern) {
+		var selected map[string]bool
+
+		switch {
+		case strings.HasPrefix(term, "!"):
+			selected = excluded
+			term = term[1:]
+		case strings.HasPrefix(term, "&"):
+			selected = map[string]bool{}
+			intersections = append(intersections, selected)
+			term = term[1:]
+		default:
+			selected = union
+		}
+
+		hosts, err := inv.match(term)
+		if err != nil {
+			return nil, err
+		}
+
+		for _, host := range hosts {
+			selected[host] = true
+		}
+	}
+
+	hosts := []InventoryHost{}
+
+	for _, host := range inv.hosts {
+		if !union[host] || excluded[host] {
+			continue
+		}
+
+		if slices.ContainsFunc(intersections, func(intersection map[string]bool) bool { return !intersection[host] }) {
+			continue
+		}
+
+		hosts = append(hosts, InventoryHost{Name: host, Vars: inv.vars(host)})
+	}
+
+	if len(hosts) == 0 {
+		return nil, fmt.Errorf("%w: %s", ErrNoInventoryHosts, pattern)
+	}
+
+	return hosts, nil
+}
+
+// patternTerms splits a pattern into its terms, leaving regular expressions alone since they
+// might contain colons themselves.
+func patternTerms(pattern string) []string {
+	terms := []string{}
+
+	for _, part := range strings.Split(pattern, ",") {
+		part = strings.TrimSpace(part)
+
+		if strings.HasPrefix(strings.TrimLeft(part, "!&"), "~") {
+			terms = append(terms, part)
+			continue
+		}
+
+		for _, term := range strings.Split(part, ":") {
+			if term = strings.TrimSpace(term); term != "" {
+				terms = append(terms, term)
+			}
+		}
+	}
+
+	return terms
+}
+
+// match returns the hosts in the groups matching the term and the hosts matching it themselves.
+func (inv *Inventory) match(term string) ([]string, error) {
+	matches := func(name string) (bool, error) {
+		return path.Match(term, name)
+	}
+
+	if strings.HasPrefix(term, "~") {
+		re, err := regexp.Compile(term[1:])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidInventory, err)
+		}
+
+		matches = func(name string) (bool, error) {
+			return re.MatchString(name), nil
+		}
+	}
+
+	hosts := []string{}
+
+	for _, name := range inv.groupOrder {
+		ok, err := matches(name)
+		if err != nil {
+			return nil, fmt.Errorf("%w: bad pattern %q: %w", ErrInvalidInventory, term, err)
+		}
+
+		if ok {
+			hosts = append(hosts, inv.members(name, map[string]bool{})...)
+		}
+	}
+
+	for _, name := range inv.hosts {
+		if ok, _ := matches(name); ok {
+			hosts = append(hosts, name)
+		}
+	}
+
+	return hosts, nil
+}
+
+// vars returns the variables of the host, starting with those of all then the groups it's in
+// from the least to the most deeply nested, and finally its own.
+func (inv *Inventory) vars(host string) map[string]string {
+	groups := []string{}
+
+	for _, name := range inv.groupOrder {
+		if _, ok := inv.depths[name]; ok && slices.Contains(inv.members(name, map[string]bool{}), host) {
+			groups = append(groups, name)
+		}
+	}
+
+	slices.SortStableFunc(groups, func(a, b string) int {
+		if inv.depths[a] != inv.depths[b] {
+			return inv.depths[a] - inv.depths[b]
+		}
+
+		return strings.Compare(a, b)
+	})
+
+	vars := map[string]string{}
+
+	for _, name := range groups {
+		maps.Copy(vars, inv.groups[name].vars)
+	}
+
+	maps.Copy(vars, inv.hostVars[host])
+	vars["inventory_hostname"] = host
+
+	return vars
+}
+
+// lookup returns the first of the variables the host has set.
+func (h InventoryHost) lookup(names ...string) string {
+	for _, name := range names {
+		if value := h.Vars[name]; value != "" {
+			return value
+		}
+	}
+
+	return ""
+}
+
+// Destination returns where to connect to the host in the ssh://[user@]host[:port] form,
+// using the ansible_host, ansible_user and ansible_port variables when they're set.
+func (h InventoryHost) Destination() string {
+	host := h.lookup("ansible_host", "ansible_ssh_host")
+	if host == "" {
+		host = h.Name
+	}
+
+	if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	if user := h.lookup("ansible_user", "ansible_ssh_user"); user != "" {
+		host = user + "@" + host
+	}
+
+	if port := h.lookup("ansible_port", "ansible_ssh_port"); port != "" {
+		host += ":" + port
+	}
+
+	return "ssh://" + host
+}
+
+// IdentityFile returns the path of the identity file the host
+// is connected to with, from ansible_ssh_private_key_file.
+func (h InventoryHost) IdentityFile() string {
+	return h.lookup("ansible_ssh_private_key_file", "ansible_private_key_file")
+}
+
+// Render replaces the references to variables of the host in the template, like
+// {{ app_version }}, failing when it references a variable the host doesn't have.
+func (h InventoryHost) Render(template string) (string, error) {
+	missing := []string{}
+
+	rendered := templateVariable.ReplaceAllStringFunc(template, func(reference string) string {
+		name := templateVariable.FindStringSubmatch(reference)[1]
+
+		value, ok := h.Vars[name]
+		if !ok {
+			missing = append(missing, name)
+		}
+
+		return value
+	})
+
+	if len(missing) > 0 {
+		return template, fmt.Errorf("%w for %s: %s", ErrUnknownHostVariable, h.Name, strings.Join(missing, ", "))
+	}
+
+	return rendered, nil
+}
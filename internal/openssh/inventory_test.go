@@ -0,0 +1,318 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"maps"
+	"reflect"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+const iniInventory = `
+bastion.example.com ansible_user=admin
+
+[web]
+web[01:03].example.com
+web-canary.example.com:2222 app_version="1.2.3 canary"
+
+[db]
+db-[a:b].example.com ansible_host=10.0.0.1
+
+[web:vars]
+ansible_user=deploy
+app_version=1.2.2
+
+[prod:children]
+web
+db
+
+[prod:vars]
+ansible_ssh_private_key_file=/vela/secrets/prod_key
+app_version=1.0.0
+`
+
+const yamlInventory = `
+all:
+  vars:
+    ansible_user: root
+  hosts:
+    bastion.example.com:
+      ansible_user: admin
+  children:
+    prod:
+      vars:
+        ansible_ssh_private_key_file: /vela/secrets/prod_key
+        app_version: 1.0.0
+      children:
+        web:
+          vars:
+            ansible_user: deploy
+            app_version: 1.2.2
+          hosts:
+            web[01:03].example.com:
+            web-canary.example.com:
+              ansible_port: 2222
+              app_version: 1.2.3 canary
+        db:
+          hosts:
+            db-[a:b].example.com:
+              ansible_host: 10.0.0.1
+`
+
+func TestInventorySelect(t *testing.T) {
+	tests := map[string]struct {
+		pattern   string
+		wantHosts []string
+		wantErr   error
+	}{
+		"selects every host by default": {
+			wantHosts: []string{
+				"bastion.example.com", "web01.example.com", "web02.example.com", "web03.example.com",
+				"web-canary.example.com", "db-a.example.com", "db-b.example.com",
+			},
+		},
+		"selects a group": {
+			pattern:   "db",
+			wantHosts: []string{"db-a.example.com", "db-b.example.com"},
+		},
+		"selects the groups nested in a group": {
+			pattern:   "prod:!web",
+			wantHosts: []string{"db-a.example.com", "db-b.example.com"},
+		},
+		"selects the hosts that aren't in a group": {
+			pattern:   "ungrouped",
+			wantHosts: []string{"bastion.example.com"},
+		},
+		"selects hosts with wildcards and exclusions": {
+			pattern:   "web*,!*canary*",
+			wantHosts: []string{"web01.example.com", "web02.example.com", "web03.example.com"},
+		},
+		"selects hosts with regular expressions and intersections": {
+			pattern:   `~web0[12]\.,&web`,
+			wantHosts: []string{"web01.example.com", "web02.example.com"},
+		},
+		"fails when nothing matches": {
+			pattern: "cache",
+			wantErr: ErrNoInventoryHosts,
+		},
+		"fails with a bad regular expression": {
+			pattern: "~web[",
+			wantErr: ErrInvalidInventory,
+		},
+	}
+
+	for format, raw := range map[string]string{"ini": iniInventory, "yaml": yamlInventory} {
+		inventory, err := ParseInventory(raw)
+		if err != nil {
+			t.Fatalf("ParseInventory() should not have raised error %q for the %s inventory", err, format)
+		}
+
+		for name, test := range tests {
+			t.Run(format+" "+name, func(t *testing.T) {
+				hosts, err := inventory.Select(test.pattern)
+				if !errors.Is(err, test.wantErr) {
+					t.Errorf("Select() error mismatch\ngot:    %v\nwanted: %v", err, test.wantErr)
+				}
+
+				names := []string{}
+				for _, host := range hosts {
+					names = append(names, host.Name)
+				}
+
+				if test.wantErr == nil && !reflect.DeepEqual(names, test.wantHosts) {
+					t.Errorf("Select() mismatch\ngot:    %v\nwanted: %v", names, test.wantHosts)
+				}
+			})
+		}
+	}
+}
+
+func TestInventoryHost(t *testing.T) {
+	tests := map[string]struct {
+		host             string
+		wantDestination  string
+		wantIdentityFile string
+		wantRendered     string
+	}{
+		"without any groups": {
+			host:            "bastion.example.com",
+			wantDestination: "ssh://admin@bastion.example.com",
+			wantRendered:    "bastion.example.com",
+		},
+		"nested groups override their parents": {
+			host:             "web01.example.com",
+			wantDestination:  "ssh://deploy@web01.example.com",
+			wantIdentityFile: "/vela/secrets/prod_key",
+			wantRendered:     "web01.example.com 1.2.2",
+		},
+		"host vars override their groups": {
+			host:             "web-canary.example.com",
+			wantDestination:  "ssh://deploy@web-canary.example.com:2222",
+			wantIdentityFile: "/vela/secrets/prod_key",
+			wantRendered:     "web-canary.example.com 1.2.3 canary",
+		},
+		"connects to ansible_host": {
+			host:             "db-a.example.com",
+			wantDestination:  "ssh://10.0.0.1",
+			wantIdentityFile: "/vela/secrets/prod_key",
+			wantRendered:     "db-a.example.com 1.0.0",
+		},
+	}
+
+	for format, raw := range map[string]string{"ini": iniInventory, "yaml": yamlInventory} {
+		inventory, err := ParseInventory(raw)
+		if err != nil {
+			t.Fatalf("ParseInventory() should not have raised error %q for the %s inventory", err, format)
+		}
+
+		for name, test := range tests {
+			t.Run(format+" "+name, func(t *testing.T) {
+				hosts, err := inventory.Select(test.host)
+				if err != nil || len(hosts) != 1 {
+					t.Fatalf("Select() should have returned the host: %v %v", hosts, err)
+				}
+
+				host := hosts[0]
+
+				// The YAML inventory sets a user for all, which the hosts without one get instead.
+				wantDestination := test.wantDestination
+				if format == "yaml" && test.host == "db-a.example.com" {
+					wantDestination = "ssh://root@10.0.0.1"
+				}
+
+				if got := host.Destination(); got != wantDestination {
+					t.Errorf("Destination() mismatch\ngot:    %s\nwanted: %s", got, wantDestination)
+				}
+
+				if got := host.IdentityFile(); got != test.wantIdentityFile {
+					t.Errorf("IdentityFile() mismatch\ngot:    %s\nwanted: %s", got, test.wantIdentityFile)
+				}
+
+				template := "{{ inventory_hostname }}"
+				if test.wantIdentityFile != "" {
+					template += " {{app_version}}"
+				}
+
+				if got, err := host.Render(template); err != nil || got != test.wantRendered {
+					t.Errorf("Render() mismatch\ngot:    %s %v\nwanted: %s", got, err, test.wantRendered)
+				}
+
+				if _, err := host.Render("{{ missing }}"); !errors.Is(err, ErrUnknownHostVariable) {
+					t.Errorf("Render() should have raised error %q but got %v", ErrUnknownHostVariable, err)
+				}
+			})
+		}
+	}
+}
+
+func TestParseInventory(t *testing.T) {
+	t.Setenv("DEPLOY_USER", "release")
+
+	tests := map[string]struct {
+		raw      string
+		wantVars map[string]map[string]string
+		wantErr  error
+	}{
+		"expands environmental variables and host ranges with strides": {
+			raw: "[web]\nweb[1:5:2] ansible_user=$DEPLOY_USER\n",
+			wantVars: map[string]map[string]string{
+				"web1": {"ansible_user": "release", "inventory_hostname": "web1"},
+				"web3": {"ansible_user": "release", "inventory_hostname": "web3"},
+				"web5": {"ansible_user": "release", "inventory_hostname": "web5"},
+			},
+		},
+		"encodes structured YAML vars as JSON": {
+			raw: "all:\n  hosts:\n    web:\n      ports: [80, 443]\n      enabled: true\n",
+			wantVars: map[string]map[string]string{
+				"web": {"ports": "[80,443]", "enabled": "true", "inventory_hostname": "web"},
+			},
+		},
+		"fails with an unknown YAML key": {
+			raw:     "all:\n  host:\n    web:\n",
+			wantErr: ErrInvalidInventory,
+		},
+		"fails with an unknown INI section": {
+			raw:     "[web:hosts]\nweb\n",
+			wantErr: ErrInvalidInventory,
+		},
+		"fails with a bad host range": {
+			raw:     "web[3:1]\n",
+			wantErr: ErrInvalidInventory,
+		},
+		"fails with an unterminated quote": {
+			raw:     "web app_version=\"1.2.3\n",
+			wantErr: ErrInvalidInventory,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			inventory, err := ParseInventory(test.raw)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("ParseInventory() error mismatch\ngot:    %v\nwanted: %v", err, test.wantErr)
+			}
+
+			if test.wantErr != nil {
+				return
+			}
+
+			hosts, err := inventory.Select("")
+			if err != nil {
+				t.Fatalf("Select() should not have raised error %q", err)
+			}
+
+			got := map[string]map[string]string{}
+			for _, host := range hosts {
+				got[host.Name] = host.Vars
+			}
+
+			if !maps.EqualFunc(got, test.wantVars, maps.Equal) {
+				t.Errorf("ParseInventory() mismatch\ngot:    %v\nwanted: %v", got, test.wantVars)
+			}
+		})
+	}
+}
+
+func TestLoadInventory(t *testing.T) {
+	fs := afero.NewMemMapFs()
+	_ = afero.WriteFile(fs, "/vela/src/hosts.ini", []byte("[web]\nweb01\n"), 0o644)
+
+	tests := map[string]struct {
+		contents  string
+		path      string
+		wantHosts int
+		wantErr   error
+	}{
+		"nothing given":            {},
+		"read from the workspace":  {path: "/vela/src/hosts.ini", wantHosts: 1},
+		"contents take precedence": {contents: "web01\nweb02\n", path: "/vela/src/hosts.ini", wantHosts: 2},
+		"missing from the workspace": {
+			path:    "/vela/src/missing.ini",
+			wantErr: ErrInvalidInventory,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			inventory, err := LoadInventory(fs, test.contents, test.path)
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("LoadInventory() error mismatch\ngot:    %v\nwanted: %v", err, test.wantErr)
+			}
+
+			if inventory == nil {
+				if test.wantHosts != 0 {
+					t.Errorf("LoadInventory() should have returned an inventory")
+				}
+
+				return
+			}
+
+			if hosts, _ := inventory.Select(""); len(hosts) != test.wantHosts {
+				t.Errorf("LoadInventory() mismatch\ngot:    %d hosts\nwanted: %d hosts", len(hosts), test.wantHosts)
+			}
+		})
+	}
+}
@@ -0,0 +1,187 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// JumpHostAliasPrefix is the prefix of the host aliases jump hosts are
+// given in the generated ssh_config file, followed by their position.
+const JumpHostAliasPrefix = "vela-jump-"
+
+// ErrInvalidJumpHost is returned when the jump_hosts parameter can't be parsed.
+var ErrInvalidJumpHost = errors.New("invalid jump host")
+
+// jumpHostOptions are the options each of the jump hosts accepts.
+var jumpHostOptions = []string{
+	"destination",
+	"port",
+	"identity_file_contents",
+	"known_hosts",
+}
+
+// jumpHostAliases are the other names the jump host options are known by.
+var jumpHostAliases = map[string]string{
+	"host":               "destination",
+	"knownhostscontents": "known_hosts",
+}
+
+// JumpHost is a system the connection hops through on the way to the remote system,
+// which has its own credentials and known hosts rather than sharing those of the plugin.
+type JumpHost struct {
+	// Destination is the jump host to connect to.
+	Destination Destination
+
+	// IdentityFileContents is the raw contents of the identity file for the jump host.
+	IdentityFileContents string
+
+	// KnownHosts are the known_hosts lines to verify the host key of the jump host against.
+	// When there aren't any, the host key isn't verified just like the default flags.
+	KnownHosts string
+
+	// IdentityFile and KnownHostsFile are where the identity and known hosts for the jump host
+	// are written to, or the identity files of the plugin when it doesn't have its own.
+	IdentityFile   []string
+	KnownHostsFile string
+}
+
+// ParseJumpHosts parses the jump_hosts parameter, which is a list of jump hosts given as
+// either JSON or YAML in the order they're hopped through. Each jump host has a destination
+// in any of the forms ssh accepts and optionally a port, identity file contents and known hosts.
+// Values are expanded with any environmental variables so they can be given using secrets.
+func ParseJumpHosts(raw string) ([]JumpHost, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	entries := []map[string]any{}
+	if err := yaml.Unmarshal([]byte(raw), &entries); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidJumpHost, err)
+	}
+
+	jumpHosts := make([]JumpHost, 0, len(entries))
+
+	for i, entry := range entries {
+		jumpHost, err := parseJumpHost(entry)
+		if err != nil {
+			return nil, fmt.Errorf("%w #%d: %w", ErrInvalidJumpHost, i+1, err)
+		}
+
+		jumpHosts = append(jumpHosts, jumpHost)
+	}
+
+	return jumpHosts, nil
+}
+
+// parseJumpHost parses a single entry from the jump_hosts parameter.
+func parseJumpHost(entry map[string]any) (JumpHost, error) {
+	jumpHost := JumpHost{}
+	values := map[string]string{}
+
+	for name, value := range entry {
+		option, err := lookupOption(name, jumpHostOptions, jumpHostAliases)
+		if err != nil {
+			return jumpHost, fmt.Errorf("unknown option %w", err)
+		}
+
+		switch v := value.(type) {
+		case string:
+			values[option] = os.ExpandEnv(v)
+		case int:
+			values[option] = strconv.Itoa(v)
+		default:
+			return jumpHost, fmt.Errorf("%s: expected a string but got %v", name, value)
+		}
+	}
+
+	destination, err := configString(values["destination"])
+	if err != nil {
+		return jumpHost, fmt.Errorf("destination: %w", err)
+	}
+
+	jumpHost.Destination, err = ParseDestination(destination)
+	if err != nil {
+		return jumpHost, err
+	}
+
+	if port, ok := values["port"]; ok {
+		if err := (&SSHConfig{}).set("port", port); err != nil {
+			return jumpHost, err
+		}
+
+		jumpHost.Destination.Port, _ = strconv.Atoi(port)
+	}
+
+	jumpHost.IdentityFileContents = values["identity_file_contents"]
+	jumpHost.KnownHosts = values["known_hosts"]
+
+	return jumpHost, nil
+}
+
+// PrepareJumpHosts writes the identity file contents and known hosts of each of the jump hosts
+// into restricted files so they can be rendered into the ssh_config file, returning the jump
+// hosts along with the files that were created. Jump hosts without their own identity file
+// contents fall back to the identity files of the plugin.
+func PrepareJumpHosts(secretFiles SecretFiles, jumpHosts []JumpHost, identityFiles []string) ([]JumpHost, []string, error) {
+	prepared := make([]JumpHost, 0, len(jumpHosts))
+	files := []string{}
+
+	for _, jumpHost := range jumpHosts {
+		jumpHost.IdentityFile = identityFiles
+
+		if jumpHost.IdentityFileContents != "" {
+			filename, err := secretFiles.Create(TempIdentityFilePrefix, jumpHost.IdentityFileContents)
+			if err != nil {
+				return prepared, files, err
+			}
+
+			files = append(files, filename)
+			jumpHost.IdentityFile = []string{filename}
+		}
+
+		if jumpHost.KnownHosts != "" {
+			filename, err := secretFiles.Create(TempKnownHostsPrefix, strings.TrimRight(jumpHost.KnownHosts, "\n")+"\n")
+			if err != nil {
+				return prepared, files, err
+			}
+
+			files = append(files, filename)
+			jumpHost.KnownHostsFile = filename
+		}
+
+		prepared = append(prepared, jumpHost)
+	}
+
+	return prepared, files, nil
+}
+
+// render returns the lines of the ssh_config file for the jump host at the given position.
+// The binaries don't pass command line options along to jump hosts, so host key checking
+// is spelled out here, strictly checking against the known hosts when there are any.
+func (j JumpHost) render(position int) []string {
+	lines := []string{
+		"Host " + JumpHostAliasPrefix + strconv.Itoa(position),
+		"  HostName " + j.Destination.Host,
+		"  Port " + strconv.Itoa(j.Destination.Port),
+		"  User " + j.Destination.User,
+	}
+
+	for _, file := range j.IdentityFile {
+		lines = append(lines, fmt.Sprintf("  IdentityFile %q", file))
+	}
+
+	if j.KnownHostsFile != "" {
+		lines = append(lines, "  StrictHostKeyChecking yes", fmt.Sprintf("  UserKnownHostsFile %q", j.KnownHostsFile))
+	} else {
+		lines = append(lines, "  StrictHostKeyChecking no", "  UserKnownHostsFile /dev/null")
+	}
+
+	return append(lines, "  GlobalKnownHostsFile /dev/null")
+}
@@ -5,7 +5,9 @@ package openssh
 import (
 	"errors"
 	"fmt"
+	"os"
 	"runtime/debug"
+	"strings"
 
 	"github.com/spf13/afero"
 )
@@ -41,7 +43,7 @@ var (
 	// ErrMissingSSH is returned when the ssh binary isn't found in the locations below.
 	ErrMissingSSH = errors.New("can't find ssh binary")
 
-	// ErrMissingSSHPASS is returned when the sshpass binary isn't found in the locations below.
+	// ErrMissingSSHPASS is returned when the sshpass binary is needed but isn't found in the locations below.
 	ErrMissingSSHPASS = errors.New("can't find sshpass binary")
 
 	// ErrAmbiguousAuth is returned when both password and passphrase specified.
@@ -52,11 +54,22 @@ var (
 const (
 	TempFileDirectory      = "/tmp/"
 	TempIdentityFilePrefix = "vela-plugin-openssh-identity-file-"
-	TempPassphrasePrefix   = "vela-plugin-openssh-passphrase-file-" // #nosec G101
-	TempPasswordPrefix     = "vela-plugin-openssh-password-file-"   // #nosec G101
+	TempPasswordPrefix     = "vela-plugin-openssh-password-file-" // #nosec G101
+	TempKnownHostsPrefix   = "vela-plugin-openssh-known-hosts-file-"
+	TempPublicKeyPrefix    = "vela-plugin-openssh-public-key-file-"
+	TempCertificatePrefix  = "vela-plugin-openssh-certificate-file-"
+	TempAgentPrefix        = "vela-plugin-openssh-agent-"
+	TempProbePrefix        = "vela-plugin-openssh-probe-"
 
 	// Read-write only for the user who creates this file.
 	TempFilePermissions = 0o600
+
+	// SecretsDirectory is where Vela places the secrets for a step as files.
+	SecretsDirectory = "/vela/secrets/"
+
+	// maxSecretFileSize keeps an unexpectedly large file in the secrets
+	// directory from being read into memory for redaction.
+	maxSecretFileSize = 1024 * 1024
 )
 
 var (
@@ -76,27 +89,44 @@ var (
 	// benefits from the same default host checking behavior.
 	DefaultSCPFlags = DefaultSSHFlags
 
+	// StrictHostKeyFlags replace the DefaultSSHFlags when the plugin has been given
+	// known hosts or fingerprints to verify host keys against, see HostKeyFlags.
+	StrictHostKeyFlags = []string{"-o StrictHostKeyChecking=yes", "-o GlobalKnownHostsFile=/dev/null"}
+
 	// DefaultSSHPassFlags is just like the SCP flags in that these are to aid with debugging
 	// but if a user specifies any flags these will be disregarded.
 	DefaultSSHPassFlags = []string{}
 )
 
-// CreateRestrictedFile will create a new file in a given location with a given prefix
-// while ensuring it has the correct restricted permissions for the scp and ssh binaries to be happy.
-func CreateRestrictedFile(fs afero.Fs, fileprefix string, contents string) (string, error) {
-	file, err := afero.TempFile(fs, TempFileDirectory, fileprefix)
-	if err != nil {
-		return "", fmt.Errorf("couldn't create temporary file: %w", err)
-	}
-	defer file.Close()
+// HostKeyFlags returns the flags that make ssh strictly check host keys against only the
+// given known hosts files. These go ahead of any flags from the user since ssh uses the
+// first value it's given for an option, so they can't accidentally turn checking back off.
+func HostKeyFlags(knownHostsFiles []string) []string {
+	quoted := make([]string, 0, len(knownHostsFiles))
 
-	if _, err := file.Write([]byte(contents)); err != nil {
-		return "", fmt.Errorf("couldn't inject temporary file contents: %w", err)
+	for _, file := range knownHostsFiles {
+		quoted = append(quoted, fmt.Sprintf("%q", file))
 	}
 
-	if err := fs.Chmod(file.Name(), TempFilePermissions); err != nil {
-		return "", fmt.Errorf("couldn't set file permissions: %w", err)
-	}
+	return append(append([]string{}, StrictHostKeyFlags...), "-o UserKnownHostsFile="+strings.Join(quoted, " "))
+}
+
+// ReadSecrets returns the contents of every file found in the given secrets directory so
+// they can be redacted from the logs. A missing directory simply means there's no secrets.
+func ReadSecrets(fs afero.Fs, directory string) []string {
+	secrets := []string{}
+
+	_ = afero.Walk(fs, directory, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() || info.Size() > maxSecretFileSize {
+			return nil
+		}
+
+		if contents, err := afero.ReadFile(fs, path); err == nil && len(contents) > 0 {
+			secrets = append(secrets, string(contents))
+		}
+
+		return nil
+	})
 
-	return file.Name(), nil
+	return secrets
 }
@@ -0,0 +1,173 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/des" // #nosec G502 -- older tooling still encrypts PKCS#8 keys with 3DES.
+	"crypto/pbkdf2"
+	"crypto/sha1" // #nosec G505 -- HMAC-SHA1 is the default PBKDF2 PRF.
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"fmt"
+	"hash"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The object identifiers of the PBES2 schemes that encrypted PKCS#8 keys are read with.
+var (
+	oidPBES2  = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 13}
+	oidPBKDF2 = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 5, 12}
+	oidScrypt = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 11591, 4, 11}
+
+	pbkdf2PRFs = map[string]func() hash.Hash{
+		"1.2.840.113549.2.7":  sha1.New,
+		"1.2.840.113549.2.8":  sha256.New224,
+		"1.2.840.113549.2.9":  sha256.New,
+		"1.2.840.113549.2.10": sha512.New384,
+		"1.2.840.113549.2.11": sha512.New,
+	}
+
+	pbes2Ciphers = map[string]struct {
+		keySize int
+		block   func(key []byte) (cipher.Block, error)
+	}{
+		"2.16.840.1.101.3.4.1.2":  {16, aes.NewCipher},
+		"2.16.840.1.101.3.4.1.22": {24, aes.NewCipher},
+		"2.16.840.1.101.3.4.1.42": {32, aes.NewCipher},
+		"1.2.840.113549.3.7":      {24, des.NewTripleDESCipher},
+	}
+)
+
+// encryptedPrivateKeyInfo is the ASN.1 structure of an encrypted PKCS#8 key from RFC 5208.
+type encryptedPrivateKeyInfo struct {
+	Algorithm     pkix.AlgorithmIdentifier
+	EncryptedData []byte
+}
+
+// pbes2Parameters are the parameters of the PBES2 scheme from RFC 8018.
+type pbes2Parameters struct {
+	KeyDerivationFunc pkix.AlgorithmIdentifier
+	EncryptionScheme  pkix.AlgorithmIdentifier
+}
+
+// pbkdf2Parameters are the parameters of the PBKDF2 key derivation function from RFC 8018.
+type pbkdf2Parameters struct {
+	Salt           []byte
+	IterationCount int
+	KeyLength      int                      `asn1:"optional"`
+	PRF            pkix.AlgorithmIdentifier `asn1:"optional"`
+}
+
+// scryptParameters are the parameters of the scrypt key derivation function from RFC 7914.
+type scryptParameters struct {
+	Salt                     []byte
+	CostParameter            int
+	BlockSize                int
+	ParallelizationParameter int
+	KeyLength                int `asn1:"optional"`
+}
+
+// decryptPKCS8 decrypts an encrypted PKCS#8 key with the passphrase, supporting the PBES2 scheme with
+// either PBKDF2 or scrypt and AES or 3DES, which covers what OpenSSL and Java tooling produce.
+func decryptPKCS8(der []byte, passphrase string) (any, error) {
+	info := encryptedPrivateKeyInfo{}
+	if _, err := asn1.Unmarshal(der, &info); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	if !info.Algorithm.Algorithm.Equal(oidPBES2) {
+		return nil, fmt.Errorf("%w: encrypted PKCS#8 keys are only supported with PBES2, not %s", ErrInvalidIdentity, info.Algorithm.Algorithm)
+	}
+
+	parameters := pbes2Parameters{}
+	if _, err := asn1.Unmarshal(info.Algorithm.Parameters.FullBytes, &parameters); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	scheme, ok := pbes2Ciphers[parameters.EncryptionScheme.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("%w: encrypted PKCS#8 keys with the %s cipher aren't supported", ErrInvalidIdentity, parameters.EncryptionScheme.Algorithm)
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(parameters.EncryptionScheme.Parameters.FullBytes, &iv); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	key, err := deriveKey(parameters.KeyDerivationFunc, passphrase, scheme.keySize)
+	if err != nil {
+		return nil, err
+	}
+
+	block, err := scheme.block(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	if len(iv) != block.BlockSize() || len(info.EncryptedData) == 0 || len(info.EncryptedData)%block.BlockSize() != 0 {
+		return nil, fmt.Errorf("%w: the encrypted PKCS#8 key is malformed", ErrInvalidIdentity)
+	}
+
+	decrypted := make([]byte, len(info.EncryptedData))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(decrypted, info.EncryptedData)
+
+	// A wrong passphrase almost always leaves invalid padding or a key that won't parse.
+	padding := int(decrypted[len(decrypted)-1])
+	if padding == 0 || padding > block.BlockSize() {
+		return nil, fmt.Errorf("%w: the PKCS#8 key couldn't be decrypted, the passphrase may be wrong", ErrInvalidIdentity)
+	}
+
+	privateKey, err := x509.ParsePKCS8PrivateKey(decrypted[:len(decrypted)-padding])
+	if err != nil {
+		return nil, fmt.Errorf("%w: the PKCS#8 key couldn't be decrypted, the passphrase may be wrong", ErrInvalidIdentity)
+	}
+
+	return privateKey, nil
+}
+
+// deriveKey derives the cipher key from the passphrase with PBKDF2 or scrypt.
+func deriveKey(function pkix.AlgorithmIdentifier, passphrase string, keySize int) ([]byte, error) {
+	switch {
+	case function.Algorithm.Equal(oidPBKDF2):
+		parameters := pbkdf2Parameters{}
+		if _, err := asn1.Unmarshal(function.Parameters.FullBytes, &parameters); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+		}
+
+		prf := sha1.New
+		if len(parameters.PRF.Algorithm) > 0 {
+			var ok bool
+			if prf, ok = pbkdf2PRFs[parameters.PRF.Algorithm.String()]; !ok {
+				return nil, fmt.Errorf("%w: encrypted PKCS#8 keys with the %s PRF aren't supported", ErrInvalidIdentity, parameters.PRF.Algorithm)
+			}
+		}
+
+		key, err := pbkdf2.Key(prf, passphrase, parameters.Salt, parameters.IterationCount, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+		}
+
+		return key, nil
+	case function.Algorithm.Equal(oidScrypt):
+		parameters := scryptParameters{}
+		if _, err := asn1.Unmarshal(function.Parameters.FullBytes, &parameters); err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+		}
+
+		key, err := scrypt.Key([]byte(passphrase), parameters.Salt, parameters.CostParameter,
+			parameters.BlockSize, parameters.ParallelizationParameter, keySize)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+		}
+
+		return key, nil
+	default:
+		return nil, fmt.Errorf("%w: encrypted PKCS#8 keys with the %s key derivation function aren't supported", ErrInvalidIdentity, function.Algorithm)
+	}
+}
@@ -0,0 +1,291 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha1" // #nosec G505 -- PuTTY .ppk v2 files are keyed and authenticated with SHA-1.
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"math/big"
+	"strconv"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/ssh"
+)
+
+// puttyFile holds the parts of a PuTTY .ppk file.
+type puttyFile struct {
+	version    int
+	algorithm  string
+	encryption string
+	comment    string
+	public     []byte
+	private    []byte
+	mac        []byte
+	headers    map[string]string
+}
+
+// parsePuTTY decrypts a PuTTY .ppk file in either the version 2 or version 3 format, which
+// needs the passphrase if the file is encrypted, returning the file along with its private key.
+func parsePuTTY(contents, passphrase string) (*puttyFile, any, error) {
+	file, err := readPuTTY(contents)
+	if err != nil {
+		return file, nil, err
+	}
+
+	if file.encryption != "none" && passphrase == "" {
+		return file, nil, fmt.Errorf("%w: the PuTTY .ppk file is encrypted, so the passphrase is needed to convert it", ErrInvalidIdentity)
+	}
+
+	macKey, err := file.decrypt(passphrase)
+	if err != nil {
+		return file, nil, err
+	}
+
+	var mac hash.Hash
+	if file.version == 2 {
+		mac = hmac.New(sha1.New, macKey)
+	} else {
+		mac = hmac.New(sha256.New, macKey)
+	}
+
+	mac.Write(ssh.Marshal(struct {
+		Algorithm  string
+		Encryption string
+		Comment    string
+		Public     []byte
+		Private    []byte
+	}{file.algorithm, file.encryption, file.comment, file.public, file.private}))
+
+	if !hmac.Equal(mac.Sum(nil), file.mac) {
+		if file.encryption != "none" {
+			return file, nil, fmt.Errorf("%w: the PuTTY .ppk file couldn't be decrypted, the passphrase may be wrong", ErrInvalidIdentity)
+		}
+
+		return file, nil, fmt.Errorf("%w: the PuTTY .ppk file is corrupted", ErrInvalidIdentity)
+	}
+
+	key, err := file.key()
+	if err != nil {
+		return file, nil, fmt.Errorf("%w: the PuTTY .ppk file holds an invalid %s key: %w", ErrInvalidIdentity, file.algorithm, err)
+	}
+
+	return file, key, nil
+}
+
+// readPuTTY splits a PuTTY .ppk file into its headers and the keys they hold, without decrypting anything.
+func readPuTTY(contents string) (*puttyFile, error) {
+	file := &puttyFile{headers: map[string]string{}}
+	lines := strings.Split(strings.TrimSpace(contents), "\n")
+
+	for i := 0; i < len(lines); i++ {
+		name, value, found := strings.Cut(lines[i], ":")
+		if !found {
+			return file, fmt.Errorf("%w: the PuTTY .ppk file has an unexpected line %d", ErrInvalidIdentity, i+1)
+		}
+
+		name, value = strings.TrimSpace(name), strings.TrimSpace(value)
+
+		if i == 0 {
+			version, err := strconv.Atoi(strings.TrimPrefix(name, puttyPrefix))
+			if err != nil || (version != 2 && version != 3) {
+				return file, fmt.Errorf("%w: only version 2 and 3 PuTTY .ppk files are supported, not %s", ErrInvalidIdentity, name)
+			}
+
+			file.version, file.algorithm = version, value
+
+			continue
+		}
+
+		if name == "Public-Lines" || name == "Private-Lines" {
+			count, err := strconv.Atoi(value)
+			if err != nil || count < 0 || i+count >= len(lines) {
+				return file, fmt.Errorf("%w: the PuTTY .ppk file has an invalid %s header", ErrInvalidIdentity, name)
+			}
+
+			decoded, err := base64.StdEncoding.DecodeString(strings.Join(lines[i+1:i+1+count], ""))
+			if err != nil {
+				return file, fmt.Errorf("%w: the PuTTY .ppk file has invalid %s: %w", ErrInvalidIdentity, name, err)
+			}
+
+			if name == "Public-Lines" {
+				file.public = decoded
+			} else {
+				file.private = decoded
+			}
+
+			i += count
+
+			continue
+		}
+
+		file.headers[name] = value
+	}
+
+	file.encryption, file.comment = file.headers["Encryption"], file.headers["Comment"]
+
+	mac, err := hex.DecodeString(file.headers["Private-MAC"])
+	if err != nil || len(mac) == 0 {
+		return file, fmt.Errorf("%w: the PuTTY .ppk file has an invalid Private-MAC header", ErrInvalidIdentity)
+	}
+
+	file.mac = mac
+
+	if len(file.public) == 0 || len(file.private) == 0 {
+		return file, fmt.Errorf("%w: the PuTTY .ppk file is missing its keys", ErrInvalidIdentity)
+	}
+
+	if file.encryption != "none" && file.encryption != "aes256-cbc" {
+		return file, fmt.Errorf("%w: the PuTTY .ppk file has unsupported encryption %q", ErrInvalidIdentity, file.encryption)
+	}
+
+	return file, nil
+}
+
+// decrypt decrypts the private key in place if it's encrypted, returning the key used to check its MAC.
+func (f *puttyFile) decrypt(passphrase string) ([]byte, error) {
+	var cipherKey, iv, macKey []byte
+
+	switch {
+	case f.version == 2:
+		macKeyHash := sha1.Sum([]byte("putty-private-key-file-mac-key" + passphrase)) // #nosec G401
+		macKey = macKeyHash[:]
+
+		if f.encryption == "none" {
+			return macKey, nil
+		}
+
+		first := sha1.Sum(append([]byte{0, 0, 0, 0}, passphrase...))  // #nosec G401
+		second := sha1.Sum(append([]byte{0, 0, 0, 1}, passphrase...)) // #nosec G401
+		cipherKey, iv = append(first[:], second[:]...)[:32], make([]byte, aes.BlockSize)
+	case f.encryption == "none":
+		return []byte{}, nil
+	default:
+		derived, err := f.argon2(passphrase)
+		if err != nil {
+			return nil, err
+		}
+
+		cipherKey, iv, macKey = derived[:32], derived[32:48], derived[48:]
+	}
+
+	if len(f.private)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("%w: the PuTTY .ppk file has a truncated private key", ErrInvalidIdentity)
+	}
+
+	block, err := aes.NewCipher(cipherKey)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidIdentity, err)
+	}
+
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(f.private, f.private)
+
+	return macKey, nil
+}
+
+// argon2 derives the cipher key, IV and MAC key of a version 3 file from the passphrase.
+func (f *puttyFile) argon2(passphrase string) ([]byte, error) {
+	parameters := map[string]uint64{}
+
+	for _, name := range []string{"Argon2-Memory", "Argon2-Passes", "Argon2-Parallelism"} {
+		value, err := strconv.ParseUint(f.headers[name], 10, 32)
+		if err != nil || value == 0 {
+			return nil, fmt.Errorf("%w: the PuTTY .ppk file has an invalid %s header", ErrInvalidIdentity, name)
+		}
+
+		parameters[name] = value
+	}
+
+	salt, err := hex.DecodeString(f.headers["Argon2-Salt"])
+	if err != nil {
+		return nil, fmt.Errorf("%w: the PuTTY .ppk file has an invalid Argon2-Salt header", ErrInvalidIdentity)
+	}
+
+	memory, passes := uint32(parameters["Argon2-Memory"]), uint32(parameters["Argon2-Passes"]) // #nosec G115
+	parallelism := uint8(min(parameters["Argon2-Parallelism"], 255))                           // #nosec G115
+
+	switch f.headers["Key-Derivation"] {
+	case "Argon2id":
+		return argon2.IDKey([]byte(passphrase), salt, passes, memory, parallelism, 80), nil
+	case "Argon2i":
+		return argon2.Key([]byte(passphrase), salt, passes, memory, parallelism, 80), nil
+	default:
+		return nil, fmt.Errorf("%w: the PuTTY .ppk file has unsupported Key-Derivation %q", ErrInvalidIdentity, f.headers["Key-Derivation"])
+	}
+}
+
+// key puts the private key back together from its public and private halves.
+func (f *puttyFile) key() (any, error) {
+	publicKey, err := ssh.ParsePublicKey(f.public)
+	if err != nil {
+		return nil, err
+	}
+
+	if publicKey.Type() != f.algorithm {
+		return nil, fmt.Errorf("the public key is %s", publicKey.Type())
+	}
+
+	public, ok := publicKey.(ssh.CryptoPublicKey)
+	if !ok {
+		return nil, fmt.Errorf("%s keys aren't supported", f.algorithm)
+	}
+
+	switch public := public.CryptoPublicKey().(type) {
+	case *rsa.PublicKey:
+		private := struct {
+			D, P, Q, Iqmp *big.Int
+			Padding       []byte `ssh:"rest"`
+		}{}
+
+		if err := ssh.Unmarshal(f.private, &private); err != nil {
+			return nil, err
+		}
+
+		key := &rsa.PrivateKey{PublicKey: *public, D: private.D, Primes: []*big.Int{private.P, private.Q}}
+		if err := key.Validate(); err != nil {
+			return nil, err
+		}
+
+		key.Precompute()
+
+		return key, nil
+	case *ecdsa.PublicKey:
+		private := struct {
+			D       *big.Int
+			Padding []byte `ssh:"rest"`
+		}{}
+
+		if err := ssh.Unmarshal(f.private, &private); err != nil {
+			return nil, err
+		}
+
+		return &ecdsa.PrivateKey{PublicKey: *public, D: private.D}, nil
+	case ed25519.PublicKey:
+		private := struct {
+			Seed    []byte
+			Padding []byte `ssh:"rest"`
+		}{}
+
+		if err := ssh.Unmarshal(f.private, &private); err != nil {
+			return nil, err
+		}
+
+		if len(private.Seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("the private key is %d bytes", len(private.Seed))
+		}
+
+		return ed25519.NewKeyFromSeed(private.Seed), nil
+	default:
+		return nil, fmt.Errorf("%s keys aren't supported", f.algorithm)
+	}
+}
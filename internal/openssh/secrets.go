@@ -0,0 +1,116 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/afero"
+)
+
+// DefaultTmpfsDirectory is the memory backed directory that secret files fall back to
+// when memfd_create isn't available, since it's mounted as tmpfs on most Linux systems.
+const DefaultTmpfsDirectory = "/dev/shm/"
+
+// SecretFiles creates the restricted files holding secrets, like identity files and passwords,
+// that the binaries are pointed at while they run.
+type SecretFiles interface {
+	// Create places the contents into a new restricted file with the given prefix,
+	// returning the path that the binaries can open it with.
+	Create(prefix, contents string) (string, error)
+
+	// Remove gets rid of a file made by Create so the secret it held doesn't linger.
+	// Files that are already gone are not treated as an error.
+	Remove(filename string) error
+}
+
+// NewSecretFiles picks where secret files are kept so they stay off the disk wherever possible.
+// Anonymous files in memory from memfd_create are preferred, then the tmpfs directory, and only
+// then TempFileDirectory with a warning since it's often a persistent disk on the runners.
+func NewSecretFiles(tmpfsDirectory string) SecretFiles {
+	files, err := newMemfdSecretFiles()
+	if err == nil {
+		return files
+	}
+
+	logrus.Debugf("can't keep secret files in memory: %s", err)
+
+	if tmpfsDirectory == "" {
+		tmpfsDirectory = DefaultTmpfsDirectory
+	}
+
+	if isTmpfs(tmpfsDirectory) {
+		return &FsSecretFiles{Fs: afero.NewOsFs(), Directory: tmpfsDirectory}
+	}
+
+	logrus.Warnf("%s isn't a tmpfs directory, secret files will be written to %s which may be backed by a disk",
+		tmpfsDirectory, TempFileDirectory)
+
+	return &FsSecretFiles{Fs: afero.NewOsFs(), Directory: TempFileDirectory}
+}
+
+// FsSecretFiles keeps secret files in a directory of the file system, which is also how
+// they're written into the mock file systems used in testing.
+type FsSecretFiles struct {
+	Fs        afero.Fs
+	Directory string
+}
+
+// Create will create a new file in the directory with the given prefix while ensuring
+// it has the correct restricted permissions for the scp and ssh binaries to be happy.
+func (f *FsSecretFiles) Create(prefix, contents string) (string, error) {
+	file, err := afero.TempFile(f.Fs, f.Directory, prefix)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create temporary file: %w", err)
+	}
+	defer file.Close()
+
+	if _, err := file.Write([]byte(contents)); err != nil {
+		return "", fmt.Errorf("couldn't inject temporary file contents: %w", err)
+	}
+
+	if err := f.Fs.Chmod(file.Name(), TempFilePermissions); err != nil {
+		return "", fmt.Errorf("couldn't set file permissions: %w", err)
+	}
+
+	return file.Name(), nil
+}
+
+// Remove will overwrite the contents of the file with zeros before removing it
+// so the secret it held doesn't linger on the underlying disk.
+func (f *FsSecretFiles) Remove(filename string) error {
+	fileInfo, err := f.Fs.Stat(filename)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("couldn't check temporary file: %w", err)
+	}
+
+	file, err := f.Fs.OpenFile(filename, os.O_WRONLY, TempFilePermissions)
+	if err != nil {
+		return fmt.Errorf("couldn't open temporary file: %w", err)
+	}
+
+	if _, err := file.Write(make([]byte, fileInfo.Size())); err != nil {
+		file.Close()
+		return fmt.Errorf("couldn't overwrite temporary file contents: %w", err)
+	}
+
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return fmt.Errorf("couldn't flush temporary file contents: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("couldn't close temporary file: %w", err)
+	}
+
+	if err := f.Fs.Remove(filename); err != nil {
+		return fmt.Errorf("couldn't remove temporary file: %w", err)
+	}
+
+	return nil
+}
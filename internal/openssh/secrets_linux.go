@@ -0,0 +1,103 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"fmt"
+	"os"
+	"sync"
+
+	"golang.org/x/sys/unix"
+)
+
+// memfdSecretFiles keeps secret files as anonymous files in memory from memfd_create, which never
+// touch a disk and disappear once closed. The binaries open them through the plugin's own entry
+// in /proc, since ssh closes any file descriptors it inherits before reading its identity files,
+// which is why this relies on the plugin staying around while the binary runs.
+type memfdSecretFiles struct {
+	mu    sync.Mutex
+	files map[string]*os.File
+}
+
+// newMemfdSecretFiles checks that memfd_create is available and that the files it
+// makes can be opened by path, which isn't the case in some sandboxes.
+func newMemfdSecretFiles() (SecretFiles, error) {
+	m := &memfdSecretFiles{files: map[string]*os.File{}}
+
+	filename, err := m.Create(TempProbePrefix, "")
+	if err != nil {
+		return nil, err
+	}
+	defer m.Remove(filename)
+
+	file, err := os.Open(filename)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't open memory file: %w", err)
+	}
+
+	return m, file.Close()
+}
+
+// Create makes a new memory file holding the contents, which is restricted
+// to the user in the same way a file on disk would be for the binaries.
+func (m *memfdSecretFiles) Create(prefix, contents string) (string, error) {
+	fd, err := unix.MemfdCreate(prefix, unix.MFD_CLOEXEC)
+	if err != nil {
+		return "", fmt.Errorf("couldn't create memory file: %w", err)
+	}
+
+	file := os.NewFile(uintptr(fd), prefix)
+
+	if err := file.Chmod(TempFilePermissions); err != nil {
+		file.Close()
+		return "", fmt.Errorf("couldn't set memory file permissions: %w", err)
+	}
+
+	if _, err := file.WriteString(contents); err != nil {
+		file.Close()
+		return "", fmt.Errorf("couldn't inject memory file contents: %w", err)
+	}
+
+	filename := fmt.Sprintf("/proc/%d/fd/%d", os.Getpid(), fd)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.files[filename] = file
+
+	return filename, nil
+}
+
+// Remove truncates the memory file so the secret is released straight away,
+// even if a binary that's still running has it open, before closing it.
+func (m *memfdSecretFiles) Remove(filename string) error {
+	m.mu.Lock()
+	file, ok := m.files[filename]
+	delete(m.files, filename)
+	m.mu.Unlock()
+
+	if !ok {
+		return nil
+	}
+
+	if err := file.Truncate(0); err != nil {
+		file.Close()
+		return fmt.Errorf("couldn't truncate memory file: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("couldn't close memory file: %w", err)
+	}
+
+	return nil
+}
+
+// isTmpfs reports whether the directory is on a file system that's backed by memory.
+func isTmpfs(directory string) bool {
+	stat := unix.Statfs_t{}
+	if err := unix.Statfs(directory, &stat); err != nil {
+		return false
+	}
+
+	return stat.Type == unix.TMPFS_MAGIC || stat.Type == unix.RAMFS_MAGIC
+}
@@ -0,0 +1,17 @@
+// SPDX-License-Identifier: Apache-2.0
+
+//go:build !linux
+
+package openssh
+
+import "errors"
+
+// newMemfdSecretFiles always fails since memfd_create only exists on Linux.
+func newMemfdSecretFiles() (SecretFiles, error) {
+	return nil, errors.New("memfd_create is only available on Linux")
+}
+
+// isTmpfs can't tell what backs the directory outside of Linux, so it's assumed to be a disk.
+func isTmpfs(string) bool {
+	return false
+}
@@ -0,0 +1,81 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/spf13/afero"
+)
+
+func TestSecretFiles(t *testing.T) {
+	fs := afero.NewMemMapFs()
+
+	tests := map[string]struct {
+		secretFiles SecretFiles
+		fs          afero.Fs
+		wantPrefix  string
+	}{
+		"kept in memory": {
+			secretFiles: NewSecretFiles(t.TempDir()),
+			fs:          afero.NewOsFs(),
+			wantPrefix:  "/proc/",
+		},
+		"kept in the tmpfs directory": {
+			secretFiles: &FsSecretFiles{Fs: afero.NewOsFs(), Directory: DefaultTmpfsDirectory},
+			fs:          afero.NewOsFs(),
+			wantPrefix:  DefaultTmpfsDirectory,
+		},
+		"kept in a mock file system": {
+			secretFiles: &FsSecretFiles{Fs: fs, Directory: TempFileDirectory},
+			fs:          fs,
+			wantPrefix:  TempFileDirectory,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, ok := test.secretFiles.(*memfdSecretFiles); !ok && test.wantPrefix == "/proc/" {
+				t.Skip("memfd_create isn't available")
+			}
+
+			if ok, _ := afero.DirExists(test.fs, test.wantPrefix); !ok && test.fs != fs {
+				t.Skipf("%s doesn't exist", test.wantPrefix)
+			}
+
+			filename, err := test.secretFiles.Create(TempPasswordPrefix, "hunter2")
+			if err != nil {
+				t.Errorf("Create() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			if !strings.HasPrefix(filename, test.wantPrefix) {
+				t.Errorf("Create() put the file in the wrong place\ngot:    %s\nwanted: %s...", filename, test.wantPrefix)
+			}
+
+			fileInfo, err := test.fs.Stat(filename)
+			if err != nil || fileInfo.Mode().Perm() != TempFilePermissions {
+				t.Errorf("Create() did not restrict the file: %v %v", fileInfo, err)
+			}
+
+			if contents, _ := afero.ReadFile(test.fs, filename); string(contents) != "hunter2" {
+				t.Errorf("Create() did not write the contents\ngot:    %q", contents)
+			}
+
+			if err := test.secretFiles.Remove(filename); err != nil {
+				t.Errorf("Remove() should not have raised error %q", err)
+			}
+
+			if _, err := test.fs.Stat(filename); !errors.Is(err, os.ErrNotExist) {
+				t.Errorf("Remove() did not remove the file: %v", err)
+			}
+
+			if err := test.secretFiles.Remove(filename); err != nil {
+				t.Errorf("Remove() should not have raised error for a file that's already gone %q", err)
+			}
+		})
+	}
+}
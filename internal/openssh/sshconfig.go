@@ -0,0 +1,390 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// TempSSHConfigPrefix is the prefix of the ssh_config file generated for each run.
+const TempSSHConfigPrefix = "vela-plugin-openssh-ssh-config-"
+
+var (
+	// ErrInvalidSSHConfig is returned when the ssh_config parameter can't be parsed.
+	ErrInvalidSSHConfig = errors.New("invalid ssh_config")
+
+	// ErrUnknownSSHConfigOption is returned when the ssh_config parameter has an option that isn't supported.
+	ErrUnknownSSHConfigOption = errors.New("unknown ssh_config option")
+)
+
+// sshConfigOptions are the options the ssh_config parameter accepts.
+var sshConfigOptions = []string{
+	"port",
+	"user",
+	"connect_timeout",
+	"server_alive_interval",
+	"ciphers",
+	"kex",
+	"host_key_algorithms",
+	"compression",
+}
+
+// sshConfigAliases are the other names options are known by, such as the keywords from the
+// ssh_config manual, after they've been lowercased and had their underscores and dashes removed.
+var sshConfigAliases = map[string]string{
+	"kexalgorithms": "kex",
+}
+
+// SSHConfig is the structured form of the options from the ssh_config manual the plugins
+// understand, which is rendered into an ssh_config file for the binaries to use with -F
+// and applied directly by the native backend.
+type SSHConfig struct {
+	// Port is the port to connect to when a destination doesn't include one.
+	Port int
+
+	// User is the user to log in as when a destination doesn't include one.
+	User string
+
+	// ConnectTimeout bounds how long connecting to a remote system can take.
+	ConnectTimeout time.Duration
+
+	// ServerAliveInterval is how often to check the connection is still alive when it's idle.
+	ServerAliveInterval time.Duration
+
+	// Ciphers, KexAlgorithms and HostKeyAlgorithms are the algorithms to allow, in order of preference.
+	Ciphers           []string
+	KexAlgorithms     []string
+	HostKeyAlgorithms []string
+
+	// Compression turns compression on or off, leaving the default when nil.
+	Compression *bool
+
+	// JumpHosts are hopped through in order on the way to every remote system. They
+	// come from the jump_hosts parameter rather than the ssh_config parameter.
+	JumpHosts []JumpHost
+}
+
+// ParseSSHConfig parses the ssh_config parameter, which is a map of options given as either
+// JSON or YAML. Options the plugins don't understand are rejected, suggesting the closest
+// supported option, rather than being handed to ssh to fail on in a less obvious way.
+func ParseSSHConfig(raw string) (SSHConfig, error) {
+	config := SSHConfig{}
+
+	if strings.TrimSpace(raw) == "" {
+		return config, nil
+	}
+
+	options := map[string]any{}
+	if err := yaml.Unmarshal([]byte(raw), &options); err != nil {
+		return config, fmt.Errorf("%w: %w", ErrInvalidSSHConfig, err)
+	}
+
+	names := make([]string, 0, len(options))
+	for name := range options {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		option, err := lookupOption(name, sshConfigOptions, sshConfigAliases)
+		if err != nil {
+			return config, fmt.Errorf("%w %w", ErrUnknownSSHConfigOption, err)
+		}
+
+		if err := config.set(option, options[name]); err != nil {
+			return config, fmt.Errorf("%w: %s: %w", ErrInvalidSSHConfig, name, err)
+		}
+	}
+
+	return config, nil
+}
+
+// lookupOption returns which of the options the name is, or an error suggesting the closest one.
+func lookupOption(name string, options []string, aliases map[string]string) (string, error) {
+	normalized := normalizeOption(name)
+
+	if alias, ok := aliases[normalized]; ok {
+		return alias, nil
+	}
+
+	closest, distance := "", math.MaxInt
+
+	for _, option := range options {
+		d := levenshtein(normalized, normalizeOption(option))
+		if d == 0 {
+			return option, nil
+		}
+
+		if d < distance {
+			closest, distance = option, d
+		}
+	}
+
+	if distance <= len(normalized)/3+1 {
+		return "", fmt.Errorf("%q, did you mean %q?", name, closest)
+	}
+
+	return "", fmt.Errorf("%q, expected one of %s", name, strings.Join(options, ", "))
+}
+
+// normalizeOption makes connect_timeout, connect-timeout and ConnectTimeout all the same.
+func normalizeOption(name string) string {
+	return strings.NewReplacer("_", "", "-", "").Replace(strings.ToLower(strings.TrimSpace(name)))
+}
+
+// set parses the value of a single option into the config.
+func (c *SSHConfig) set(option string, value any) error {
+	var err error
+
+	switch option {
+	case "port":
+		c.Port, err = configInt(value)
+		if err == nil && (c.Port < 1 || c.Port > math.MaxUint16) {
+			err = fmt.Errorf("port %d out of range", c.Port)
+		}
+	case "user":
+		c.User, err = configString(value)
+	case "connect_timeout":
+		c.ConnectTimeout, err = configDuration(value)
+	case "server_alive_interval":
+		c.ServerAliveInterval, err = configDuration(value)
+	case "ciphers":
+		c.Ciphers, err = configList(value)
+	case "kex":
+		c.KexAlgorithms, err = configList(value)
+	case "host_key_algorithms":
+		c.HostKeyAlgorithms, err = configList(value)
+	case "compression":
+		var compression bool
+
+		compression, err = configBool(value)
+		c.Compression = &compression
+	}
+
+	return err
+}
+
+// Empty returns true if none of the options have been set.
+func (c SSHConfig) Empty() bool {
+	return c.Port == 0 && c.User == "" && c.ConnectTimeout == 0 && c.ServerAliveInterval == 0 &&
+		len(c.Ciphers)+len(c.KexAlgorithms)+len(c.HostKeyAlgorithms)+len(c.JumpHosts) == 0 && c.Compression == nil
+}
+
+// Render returns the config in the ssh_config file format. Each of the jump hosts gets a host
+// alias of its own, every other host jumps through them with ProxyJump, and the options apply
+// to every host that doesn't set them itself since ssh uses the first value it finds.
+func (c SSHConfig) Render() string {
+	blocks := []string{}
+	aliases := []string{}
+
+	for i, jumpHost := range c.JumpHosts {
+		blocks = append(blocks, strings.Join(jumpHost.render(i), "\n"))
+		aliases = append(aliases, JumpHostAliasPrefix+strconv.Itoa(i))
+	}
+
+	if len(aliases) > 0 {
+		blocks = append(blocks, fmt.Sprintf("Host * !%s*\n  ProxyJump %s", JumpHostAliasPrefix, strings.Join(aliases, ",")))
+	}
+
+	if options := c.options(); len(options) > 0 {
+		blocks = append(blocks, strings.Join(append([]string{"Host *"}, options...), "\n"))
+	}
+
+	return strings.Join(blocks, "\n\n") + "\n"
+}
+
+// options returns the lines of the ssh_config file for the options.
+func (c SSHConfig) options() []string {
+	lines := []string{}
+
+	add := func(keyword, value string) {
+		lines = append(lines, fmt.Sprintf("  %s %s", keyword, value))
+	}
+
+	if c.Port != 0 {
+		add("Port", strconv.Itoa(c.Port))
+	}
+
+	if c.User != "" {
+		add("User", c.User)
+	}
+
+	if c.ConnectTimeout != 0 {
+		add("ConnectTimeout", strconv.Itoa(seconds(c.ConnectTimeout)))
+	}
+
+	if c.ServerAliveInterval != 0 {
+		add("ServerAliveInterval", strconv.Itoa(seconds(c.ServerAliveInterval)))
+	}
+
+	if len(c.Ciphers) > 0 {
+		add("Ciphers", strings.Join(c.Ciphers, ","))
+	}
+
+	if len(c.KexAlgorithms) > 0 {
+		add("KexAlgorithms", strings.Join(c.KexAlgorithms, ","))
+	}
+
+	if len(c.HostKeyAlgorithms) > 0 {
+		add("HostKeyAlgorithms", strings.Join(c.HostKeyAlgorithms, ","))
+	}
+
+	if c.Compression != nil {
+		add("Compression", map[bool]string{true: "yes", false: "no"}[*c.Compression])
+	}
+
+	return lines
+}
+
+// seconds rounds a duration up to whole seconds since that's all ssh_config understands.
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
+
+// configString accepts a single word, since anything with whitespace
+// could sneak other options into the rendered ssh_config file.
+func configString(value any) (string, error) {
+	var s string
+
+	switch v := value.(type) {
+	case string:
+		s = v
+	case int:
+		s = strconv.Itoa(v)
+	default:
+		return "", fmt.Errorf("expected a string but got %v", value)
+	}
+
+	if s == "" || strings.ContainsAny(s, " \t\r\n\"'#") {
+		return "", fmt.Errorf("%q must be a single word", s)
+	}
+
+	return s, nil
+}
+
+// configInt accepts a number or a string holding one.
+func configInt(value any) (int, error) {
+	switch v := value.(type) {
+	case int:
+		return v, nil
+	case string:
+		return strconv.Atoi(strings.TrimSpace(v))
+	default:
+		return 0, fmt.Errorf("expected a number but got %v", value)
+	}
+}
+
+// configDuration accepts a duration like 30s or 5m, or a number of seconds like ssh_config does.
+func configDuration(value any) (time.Duration, error) {
+	var d time.Duration
+
+	switch v := value.(type) {
+	case int:
+		d = time.Duration(v) * time.Second
+	case string:
+		if n, err := strconv.Atoi(strings.TrimSpace(v)); err == nil {
+			d = time.Duration(n) * time.Second
+		} else if d, err = time.ParseDuration(strings.TrimSpace(v)); err != nil {
+			return 0, err
+		}
+	default:
+		return 0, fmt.Errorf("expected a duration but got %v", value)
+	}
+
+	if d <= 0 {
+		return 0, fmt.Errorf("duration %s must be positive", d)
+	}
+
+	return d, nil
+}
+
+// configList accepts a list, or a single string with the items separated by commas.
+func configList(value any) ([]string, error) {
+	items := []string{}
+
+	switch v := value.(type) {
+	case string:
+		items = strings.Split(v, ",")
+	case []any:
+		for _, item := range v {
+			s, err := configString(item)
+			if err != nil {
+				return nil, err
+			}
+
+			items = append(items, s)
+		}
+	default:
+		return nil, fmt.Errorf("expected a list but got %v", value)
+	}
+
+	list := make([]string, 0, len(items))
+
+	for _, item := range items {
+		item, err := configString(strings.TrimSpace(item))
+		if err != nil {
+			return nil, err
+		}
+
+		if strings.Contains(item, ",") {
+			return nil, fmt.Errorf("%q must not contain commas", item)
+		}
+
+		list = append(list, item)
+	}
+
+	return list, nil
+}
+
+// configBool accepts a boolean or the yes and no ssh_config uses.
+func configBool(value any) (bool, error) {
+	switch v := value.(type) {
+	case bool:
+		return v, nil
+	case string:
+		switch strings.ToLower(strings.TrimSpace(v)) {
+		case "yes", "true":
+			return true, nil
+		case "no", "false":
+			return false, nil
+		}
+	}
+
+	return false, fmt.Errorf("expected yes or no but got %v", value)
+}
+
+// levenshtein returns the number of single character edits needed to turn a into b.
+func levenshtein(a, b string) int {
+	previous := make([]int, len(b)+1)
+	for j := range previous {
+		previous[j] = j
+	}
+
+	for i := 1; i <= len(a); i++ {
+		current := make([]int, len(b)+1)
+		current[0] = i
+
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+
+			current[j] = slices.Min([]int{previous[j] + 1, current[j-1] + 1, previous[j-1] + cost})
+		}
+
+		previous = current
+	}
+
+	return previous[len(b)]
+}
@@ -0,0 +1,170 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSSHConfig(t *testing.T) {
+	compression := true
+
+	tests := map[string]struct {
+		raw  string
+		want SSHConfig
+	}{
+		"empty config": {
+			raw:  "",
+			want: SSHConfig{},
+		},
+		"json from vela parameters": {
+			raw: `{"port": 2222, "user": "deploy", "connect_timeout": "1m", "ciphers": ["aes256-gcm@openssh.com", "aes128-ctr"]}`,
+			want: SSHConfig{
+				Port:           2222,
+				User:           "deploy",
+				ConnectTimeout: time.Minute,
+				Ciphers:        []string{"aes256-gcm@openssh.com", "aes128-ctr"},
+			},
+		},
+		"yaml with ssh_config keywords": {
+			raw: "Port: \"2222\"\nServerAliveInterval: 15\nKexAlgorithms: curve25519-sha256,diffie-hellman-group14-sha256\nHostKeyAlgorithms: [ssh-ed25519]\nCompression: yes\n",
+			want: SSHConfig{
+				Port:                2222,
+				ServerAliveInterval: 15 * time.Second,
+				KexAlgorithms:       []string{"curve25519-sha256", "diffie-hellman-group14-sha256"},
+				HostKeyAlgorithms:   []string{"ssh-ed25519"},
+				Compression:         &compression,
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseSSHConfig(test.raw)
+			if err != nil {
+				t.Errorf("ParseSSHConfig() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseSSHConfig() mismatch\ngot:    %+v\nwanted: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseSSHConfigErrors(t *testing.T) {
+	tests := map[string]struct {
+		raw         string
+		wantErr     error
+		wantMessage string
+	}{
+		"unknown option suggests the closest": {
+			raw:         `{"conect_timeout": 10}`,
+			wantErr:     ErrUnknownSSHConfigOption,
+			wantMessage: `did you mean "connect_timeout"?`,
+		},
+		"unknown option lists supported options": {
+			raw:         `{"ProxyCommand": "nc %h %p"}`,
+			wantErr:     ErrUnknownSSHConfigOption,
+			wantMessage: "expected one of port, user",
+		},
+		"not a map": {
+			raw:     `["port", 22]`,
+			wantErr: ErrInvalidSSHConfig,
+		},
+		"port out of range": {
+			raw:     `{"port": 65536}`,
+			wantErr: ErrInvalidSSHConfig,
+		},
+		"value sneaking in another option": {
+			raw:     `{"user": "deploy\nProxyCommand nc %h %p"}`,
+			wantErr: ErrInvalidSSHConfig,
+		},
+		"bad duration": {
+			raw:     `{"connect_timeout": "soon"}`,
+			wantErr: ErrInvalidSSHConfig,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseSSHConfig(test.raw)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("ParseSSHConfig() returned wrong error\ngot:    %s\nwanted: %s", err, test.wantErr)
+				t.FailNow()
+			}
+
+			if !strings.Contains(err.Error(), test.wantMessage) {
+				t.Errorf("ParseSSHConfig() error mismatch\ngot:    %s\nwanted: %s", err, test.wantMessage)
+			}
+		})
+	}
+}
+
+func TestSSHConfigRender(t *testing.T) {
+	compression := false
+	config := SSHConfig{
+		Port:                2222,
+		User:                "deploy",
+		ConnectTimeout:      1500 * time.Millisecond,
+		ServerAliveInterval: time.Minute,
+		Ciphers:             []string{"aes256-gcm@openssh.com", "aes128-ctr"},
+		KexAlgorithms:       []string{"+diffie-hellman-group14-sha1"},
+		HostKeyAlgorithms:   []string{"ssh-ed25519"},
+		Compression:         &compression,
+	}
+
+	want := `Host *
+  Port 2222
+  User deploy
+  ConnectTimeout 2
+  ServerAliveInterval 60
+  Ciphers aes256-gcm@openssh.com,aes128-ctr
+  KexAlgorithms +diffie-hellman-group14-sha1
+  HostKeyAlgorithms ssh-ed25519
+  Compression no
+`
+
+	if got := config.Render(); got != want {
+		t.Errorf("Render() mismatch\ngot:\n%s\nwanted:\n%s", got, want)
+	}
+
+	if config.Empty() || !(SSHConfig{}).Empty() {
+		t.Errorf("Empty() mismatch")
+	}
+}
+
+func TestSSHConfigParseDestination(t *testing.T) {
+	config := SSHConfig{Port: 2222, User: "deploy"}
+
+	tests := map[string]Destination{
+		"some-host":                          {User: "deploy", Host: "some-host", Port: 2222},
+		"some-user@some-host":                {User: "some-user", Host: "some-host", Port: 2222},
+		"ssh://some-user@some-host:12345":    {User: "some-user", Host: "some-host", Port: 12345},
+		"scp://some-host/path/to/some-file":  {User: "deploy", Host: "some-host", Port: 2222},
+		"some-host:path/to/some-other-file":  {User: "deploy", Host: "some-host", Port: 2222},
+		"scp://some-user@some-host:12345/hi": {User: "some-user", Host: "some-host", Port: 12345},
+	}
+
+	for location, want := range tests {
+		var (
+			got Destination
+			err error
+		)
+
+		if strings.HasPrefix(location, "ssh://") || !strings.ContainsAny(location, ":/") {
+			got, err = config.ParseDestination(location)
+		} else {
+			got, _, _, err = config.ParseLocation(location)
+		}
+
+		if err != nil || got != want {
+			t.Errorf("parsing %q mismatch\ngot:    %+v (%v)\nwanted: %+v", location, got, err, want)
+		}
+	}
+}
@@ -0,0 +1,178 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// DefaultVaultMount is where the SSH secrets engine is mounted in Vault unless told otherwise.
+const DefaultVaultMount = "ssh"
+
+var (
+	// ErrInvalidVault is returned when the vault parameter can't be parsed.
+	ErrInvalidVault = errors.New("invalid vault")
+
+	// ErrAmbiguousIdentity is returned when vault is used along with identity file or certificate contents.
+	ErrAmbiguousIdentity = errors.New("can't use vault along with identity file contents, identities or certificate contents")
+)
+
+// vaultOptions are the options the vault parameter accepts.
+var vaultOptions = []string{
+	"address",
+	"mount",
+	"role",
+	"token",
+	"role_id",
+	"secret_id",
+	"namespace",
+	"valid_principals",
+	"ttl",
+	"ca_cert",
+}
+
+// vaultAliases are the other names the vault options are known by.
+var vaultAliases = map[string]string{
+	"addr":       "address",
+	"path":       "mount",
+	"principals": "valid_principals",
+}
+
+// VaultConfig is where to have the ephemeral identity of each run signed by the SSH secrets
+// engine of HashiCorp Vault, and how to log in to do so with either a token or AppRole.
+type VaultConfig struct {
+	// Address is the URL of the Vault server, defaulting to $VAULT_ADDR.
+	Address string
+
+	// Mount is where the SSH secrets engine is mounted, defaulting to DefaultVaultMount.
+	Mount string
+
+	// Role is the role of the SSH secrets engine to sign with.
+	Role string
+
+	// Token logs in to Vault, defaulting to $VAULT_TOKEN when AppRole isn't used instead.
+	Token string
+
+	// RoleID and SecretID log in to Vault with AppRole.
+	RoleID   string
+	SecretID string
+
+	// Namespace is the Vault Enterprise namespace, if any.
+	Namespace string
+
+	// ValidPrincipals and TTL are requested for the certificate, leaving the role defaults when empty.
+	ValidPrincipals []string
+	TTL             string
+
+	// CACert is the PEM encoded certificate authority to trust the Vault server with,
+	// for when it isn't signed by one of the system certificate authorities.
+	CACert string
+}
+
+// ParseVault parses the vault parameter, which is a map of options given as either JSON or YAML.
+// It returns nil when the parameter isn't set. Values are expanded with any environmental
+// variables so that the token and secret ID can be given using secrets.
+func ParseVault(raw string) (*VaultConfig, error) {
+	if strings.TrimSpace(raw) == "" {
+		return nil, nil
+	}
+
+	options := map[string]any{}
+	if err := yaml.Unmarshal([]byte(raw), &options); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidVault, err)
+	}
+
+	config := &VaultConfig{}
+
+	for name, value := range options {
+		option, err := lookupOption(name, vaultOptions, vaultAliases)
+		if err != nil {
+			return nil, fmt.Errorf("%w: unknown option %w", ErrInvalidVault, err)
+		}
+
+		if err := config.set(option, value); err != nil {
+			return nil, fmt.Errorf("%w: %s: %w", ErrInvalidVault, name, err)
+		}
+	}
+
+	if config.Address == "" {
+		config.Address = os.Getenv("VAULT_ADDR")
+	}
+
+	if config.Mount == "" {
+		config.Mount = DefaultVaultMount
+	}
+
+	if config.Token == "" && config.RoleID == "" {
+		config.Token = os.Getenv("VAULT_TOKEN")
+	}
+
+	switch {
+	case config.Address == "":
+		return nil, fmt.Errorf("%w: missing address", ErrInvalidVault)
+	case config.Role == "":
+		return nil, fmt.Errorf("%w: missing role", ErrInvalidVault)
+	case config.Token == "" && (config.RoleID == "" || config.SecretID == ""):
+		return nil, fmt.Errorf("%w: missing token, or role_id and secret_id for AppRole", ErrInvalidVault)
+	}
+
+	return config, nil
+}
+
+// set parses the value of a single option into the config.
+func (c *VaultConfig) set(option string, value any) error {
+	if option == "valid_principals" {
+		principals, err := configList(value)
+		c.ValidPrincipals = principals
+
+		return err
+	}
+
+	s, ok := value.(string)
+	if !ok {
+		return fmt.Errorf("expected a string but got %v", value)
+	}
+
+	s = strings.TrimSpace(os.ExpandEnv(s))
+
+	switch option {
+	case "address":
+		c.Address = strings.TrimRight(s, "/")
+	case "mount":
+		c.Mount = strings.Trim(s, "/")
+	case "role":
+		c.Role = s
+	case "token":
+		c.Token = s
+	case "role_id":
+		c.RoleID = s
+	case "secret_id":
+		c.SecretID = s
+	case "namespace":
+		c.Namespace = s
+	case "ttl":
+		c.TTL = s
+	case "ca_cert":
+		c.CACert = s
+	}
+
+	return nil
+}
+
+// Secrets returns the credentials used to log in to Vault so they can be redacted.
+func (c *VaultConfig) Secrets() []string {
+	secrets := []string{}
+
+	for _, secret := range []string{c.Token, c.SecretID} {
+		if secret != "" {
+			secrets = append(secrets, secret)
+		}
+	}
+
+	return secrets
+}
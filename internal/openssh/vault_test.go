@@ -0,0 +1,104 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package openssh
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseVault(t *testing.T) {
+	t.Setenv("MOCK_VAULT_SECRET_ID", "some-secret-id")
+	t.Setenv("VAULT_ADDR", "https://vault.example.com")
+	t.Setenv("VAULT_TOKEN", "hvs.some-token")
+
+	tests := map[string]struct {
+		raw  string
+		want *VaultConfig
+	}{
+		"no vault": {
+			raw: "",
+		},
+		"token from the environment": {
+			raw: `{"role": "deploy"}`,
+			want: &VaultConfig{
+				Address: "https://vault.example.com",
+				Mount:   DefaultVaultMount,
+				Role:    "deploy",
+				Token:   "hvs.some-token",
+			},
+		},
+		"yaml with AppRole from secrets": {
+			raw: "address: https://vault.internal:8200/\nmount: /ssh-client-signer/\nrole: deploy\nrole_id: some-role-id\nsecret_id: $MOCK_VAULT_SECRET_ID\nprincipals: [deploy, admin]\nttl: 10m\n",
+			want: &VaultConfig{
+				Address:         "https://vault.internal:8200",
+				Mount:           "ssh-client-signer",
+				Role:            "deploy",
+				RoleID:          "some-role-id",
+				SecretID:        "some-secret-id",
+				ValidPrincipals: []string{"deploy", "admin"},
+				TTL:             "10m",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			got, err := ParseVault(test.raw)
+			if err != nil {
+				t.Errorf("ParseVault() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("ParseVault() mismatch\ngot:    %+v\nwanted: %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseVaultErrors(t *testing.T) {
+	t.Setenv("VAULT_ADDR", "")
+	t.Setenv("VAULT_TOKEN", "")
+
+	tests := map[string]struct {
+		raw         string
+		wantMessage string
+	}{
+		"unknown option suggests the closest": {
+			raw:         `{"address": "https://vault.example.com", "role": "deploy", "tokne": "hvs.some-token"}`,
+			wantMessage: `did you mean "token"?`,
+		},
+		"missing address": {
+			raw:         `{"role": "deploy", "token": "hvs.some-token"}`,
+			wantMessage: "missing address",
+		},
+		"missing role": {
+			raw:         `{"address": "https://vault.example.com", "token": "hvs.some-token"}`,
+			wantMessage: "missing role",
+		},
+		"missing credentials": {
+			raw:         `{"address": "https://vault.example.com", "role": "deploy", "role_id": "some-role-id"}`,
+			wantMessage: "missing token",
+		},
+		"not a map": {
+			raw: `["https://vault.example.com"]`,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, err := ParseVault(test.raw)
+			if !errors.Is(err, ErrInvalidVault) {
+				t.Errorf("ParseVault() returned wrong error\ngot:    %s\nwanted: %s", err, ErrInvalidVault)
+				t.FailNow()
+			}
+
+			if !strings.Contains(err.Error(), test.wantMessage) {
+				t.Errorf("ParseVault() error mismatch\ngot:    %s\nwanted: %s", err, test.wantMessage)
+			}
+		})
+	}
+}
@@ -6,12 +6,22 @@
 package scp
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
+	"strings"
 
+	"github.com/pkg/sftp"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 
+	"github.com/go-vela/vela-openssh/internal/auth"
+	"github.com/go-vela/vela-openssh/internal/native"
 	"github.com/go-vela/vela-openssh/internal/openssh"
+	"github.com/go-vela/vela-openssh/pkg/binarywrapper"
 )
 
 var (
@@ -20,6 +30,10 @@ var (
 
 	// ErrMissingTarget is a returned when the plugin is missing the target parameter.
 	ErrMissingTarget = errors.New("missing target parameter")
+
+	// ErrUnsupportedTransfer is returned when the native backend is asked to copy
+	// anything other than between the local file system and a single remote system.
+	ErrUnsupportedTransfer = errors.New("native backend only copies between the local file system and a single remote system")
 )
 
 type Config struct {
@@ -34,44 +48,47 @@ type Config struct {
 	// Source files above to be placed.
 	Target string
 
-	// IdentityFilePath is the path to the identity file to use
-	// for authenticating against remote systems. You can specify
-	// multiple files to use each one in turn if needed.
-	IdentityFilePath []string
+	// Destinations are several remote systems to copy the Source files to rather than just
+	// the one in Target. Each is either a whole remote location like user@host:/path, or only
+	// a host in the [user@]host or ssh://[user@]host[:port] form, which is combined with the
+	// remote path given as the Target. A Target that's remote itself is copied to as well.
+	// How many are copied to at once and how many may fail are up to the binarywrapper.Plugin.
+	Destinations []string
 
-	// IdentityFileContents is a string representation of an identity
-	// file. This is used since the plugin needs to consume secrets
-	// and those sometimes come through as environmental variables
-	// so we'll need to take the raw contents and place them into a file
-	// so that the binaries later can use them.
-	IdentityFileContents string
+	// InventoryContents is an Ansible-style inventory in either the INI or YAML format, usually
+	// given as a secret, and InventoryPath is the path to one, usually in the workspace. Each of
+	// the hosts selected from it is copied to, at the remote path given as the Target, connected
+	// to with the user, port and identity file from its variables. The Target can reference the
+	// variables of each host like {{ app_version }}.
+	InventoryContents string
+	InventoryPath     string
 
-	// SCPFlags is for setting or overriding any sort of scp features.
-	SCPFlags []string
+	// Hosts is the pattern selecting the hosts from the inventory, like "web:&prod:!canary",
+	// which selects all of them when it isn't set.
+	Hosts string
 
-	// SSHPassword is used for authenticating against systems with a password
-	// instead of an identity file. Since this is passed to sshpass it's
-	// limited to only one password for whatever remote systems are in use.
-	// Prefer to use identity files if possible since you can specify quite a bit more.
-	SSHPassword string
+	// Credentials are how remote systems are authenticated against and have their host keys verified.
+	auth.Credentials
 
-	// SSHPassphrase is used for the identity files specified. Just like with SSHPassword
-	// this is handed off to sshpass to use in authentication and it only supports
-	// one parameter, so this passphrase needs to be viable for all identity files
-	// that contain a passphrase. If needing multiple identity files be sure
-	// they all use the same passphrase for the remote systems.
-	SSHPassphrase string
+	// SCPFlags is for setting or overriding any sort of scp features.
+	SCPFlags []string
 
 	// SSHPASSFlags is for setting or overriding any sort of sshpass features.
 	SSHPASSFlags []string
 
+	// Backend picks how the plugin copies files, either by executing the OpenSSH
+	// binaries (the default) or natively in process over SFTP without any binaries.
+	// The native backend only understands the -r and -p flags from SCPFlags and
+	// ignores the rest along with SSHPASSFlags.
+	Backend string
+
 	// Internal flags & data
-	fs                     afero.Fs
-	locationSCPbinary      string
-	locationSSHbinary      string
-	locationSSHPASSbinary  string
-	locationPassphraseFile string
-	locationPasswordFile   string
+	fs                    afero.Fs
+	locationSCPbinary     string
+	locationSSHbinary     string
+	locationSSHPASSbinary string
+	targets               []string
+	inventoryHosts        map[string]openssh.InventoryHost
 }
 
 // Validate checks some basic plugin configuration parameters
@@ -86,21 +103,136 @@ func (c *Config) Validate() error {
 		return ErrMissingSource
 	}
 
-	if len(c.Target) == 0 {
+	if c.fs == nil {
+		c.fs = afero.NewOsFs()
+	}
+
+	if err := c.loadInventory(); err != nil {
+		return err
+	}
+
+	if err := c.validateTargets(); err != nil {
+		return err
+	}
+
+	if err := openssh.ValidateBackend(c.Backend); err != nil {
+		return err
+	}
+
+	if err := c.Credentials.Validate(c.fs); err != nil {
+		return err
+	}
+
+	return c.validateBackend()
+}
+
+// validateTargets settles on whether the sources are copied to a lone
+// target or fanned out to several of them, making sure there's at least one.
+func (c *Config) validateTargets() error {
+	if len(c.Target) == 0 && len(c.Destinations) == 0 {
 		return ErrMissingTarget
 	}
 
-	if len(c.SSHPassword) > 0 && len(c.SSHPassphrase) > 0 {
-		return openssh.ErrAmbiguousAuth
+	targets, err := c.expandTargets()
+	if err != nil {
+		return err
+	}
+
+	if len(targets) == 1 {
+		c.Target, c.Destinations = targets[0], nil
+		c.applyInventoryHost(c.Target)
+	} else {
+		c.targets = targets
+	}
+
+	return nil
+}
+
+// validateBackend checks the targets can be copied to by the native backend
+// and warns about the parameters the chosen backend ignores.
+func (c *Config) validateBackend() error {
+	if !c.HostKeys().Enabled() && (c.Backend == openssh.BackendNative || len(c.SCPFlags) == 0) {
+		logrus.Warn("host keys aren't being verified, set known_hosts.contents, known_hosts.path or host_key.fingerprint to verify them")
+	}
+
+	if c.Backend != openssh.BackendNative {
+		if c.SSHPassphrase != "" && len(c.SSHPASSFlags) > 0 {
+			logrus.Warn("sshpass flags are ignored since passphrases are handled by the built-in agent")
+		}
+
+		return nil
+	}
+
+	for _, target := range c.everyTarget() {
+		if _, err := c.plan(target); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadInventory adds each of the hosts selected from the inventory to the Destinations,
+// combined with the Target rendered with its variables, which has to be a remote path.
+// Hosts copied to the same location are rejected since there'd be no telling which
+// of their variables to use.
+func (c *Config) loadInventory() error {
+	inventory, err := openssh.LoadInventory(c.fs, c.InventoryContents, c.InventoryPath)
+	if err != nil {
+		return err
+	}
+
+	if inventory == nil {
+		if c.Hosts != "" {
+			return openssh.ErrMissingInventory
+		}
+
+		return nil
+	}
+
+	if c.Target == "" || isRemote(c.Target) {
+		return fmt.Errorf("%w: the target has to be the remote path the inventory hosts are copied to", ErrMissingTarget)
 	}
 
+	hosts, err := inventory.Select(c.Hosts)
+	if err != nil {
+		return err
+	}
+
+	c.inventoryHosts = map[string]openssh.InventoryHost{}
+
+	for _, host := range hosts {
+		path, err := host.Render(c.Target)
+		if err != nil {
+			return err
+		}
+
+		location := combineLocation(host.Destination(), path)
+		if other, ok := c.inventoryHosts[location]; ok {
+			return fmt.Errorf("%w: %s and %s are both copied to %s", openssh.ErrInvalidInventory, other.Name, host.Name, location)
+		}
+
+		c.inventoryHosts[location] = host
+		c.Destinations = append(c.Destinations, location)
+	}
+
+	logrus.Infof("selected %d hosts from the inventory", len(hosts))
+
 	return nil
 }
 
+// applyInventoryHost adds the identity file of the host from the inventory
+// that the target came from, if it came from one at all.
+func (c *Config) applyInventoryHost(target string) {
+	if file := c.inventoryHosts[target].IdentityFile(); file != "" {
+		c.IdentityFilePath = append(slices.Clone(c.IdentityFilePath), file)
+	}
+}
+
 // Setup will make sure all of the internal configuration of
 // the plugin is set and ready to go along with any sorts of
 // file system side effects and preparations are done.
-func (c *Config) Setup() error {
+func (c *Config) Setup(ctx context.Context) error {
 	// This wouldn't be nil in testing situations but in
 	// general it will be nil for most runtime scenarios.
 	// This allows us to mock the filesystem in testing
@@ -110,10 +242,33 @@ func (c *Config) Setup() error {
 		c.fs = afero.NewOsFs()
 	}
 
-	// Pickup the scp & sshpass binaries from whatever location
-	// they might be currently installed into. Inside a plugin this
-	// should stay static, but when debugging and running this
-	// outside of the container it's nice if it picks up user binaries.
+	if err := c.SetupVault(ctx); err != nil {
+		return err
+	}
+
+	// The native backend doesn't need any binaries, and it keeps
+	// secrets in memory rather than placing them into files.
+	if c.Backend == openssh.BackendNative {
+		return nil
+	}
+
+	if err := c.findBinaries(); err != nil {
+		return err
+	}
+
+	destinations, err := c.pinnedDestinations()
+	if err != nil {
+		return err
+	}
+
+	return c.Credentials.Setup(ctx, c.fs, destinations)
+}
+
+// findBinaries picks up the scp, ssh & sshpass binaries from whatever
+// location they might be currently installed into. Inside a plugin this
+// should stay static, but when debugging and running this outside of
+// the container it's nice if it picks up user binaries.
+func (c *Config) findBinaries() error {
 	for _, path := range openssh.BinSearchLocations {
 		tempSCPPath := fmt.Sprintf("%s/scp", path)
 		tempSSHPath := fmt.Sprintf("%s/ssh", path)
@@ -140,38 +295,272 @@ func (c *Config) Setup() error {
 		return openssh.ErrMissingSSH
 	}
 
-	if c.locationSSHPASSbinary == "" {
+	if c.useSSHPass() && c.locationSSHPASSbinary == "" {
 		return openssh.ErrMissingSSHPASS
 	}
 
-	if c.IdentityFileContents != "" {
-		filename, err := openssh.CreateRestrictedFile(c.fs, openssh.TempIdentityFilePrefix, c.IdentityFileContents)
+	return nil
+}
+
+// pinnedDestinations returns the remote systems to pin the host keys of, which is all
+// of those the files are copied to or from when there's a fingerprint to pin them to.
+func (c *Config) pinnedDestinations() ([]openssh.Destination, error) {
+	destinations := []openssh.Destination{}
+
+	if len(c.HostKeyFingerprint) == 0 {
+		return destinations, nil
+	}
+
+	for _, location := range append(c.everyTarget(), c.Source...) {
+		destination, _, remote, err := c.Options().ParseLocation(os.ExpandEnv(location))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		c.IdentityFilePath = append([]string{filename}, c.IdentityFilePath...)
+		if remote && !slices.Contains(destinations, destination) {
+			destinations = append(destinations, destination)
+		}
 	}
 
-	if c.SSHPassword != "" {
-		filename, err := openssh.CreateRestrictedFile(c.fs, openssh.TempPasswordPrefix, c.SSHPassword)
+	return destinations, nil
+}
+
+// Redactions returns every secret the plugin knows of so that they can be
+// masked in the logs, which are those in the credentials.
+func (c *Config) Redactions() []string {
+	if c.fs == nil {
+		c.fs = afero.NewOsFs()
+	}
+
+	return c.Credentials.Redactions(c.fs)
+}
+
+// transferPlan is what the native backend works out it needs to do from the sources and target.
+type transferPlan struct {
+	destination openssh.Destination
+	sources     []string
+	target      string
+	upload      bool
+}
+
+// plan works out which remote system to connect to and which way the files are going.
+// Either every source is local and the target is remote, or every source is on the
+// same remote system and the target is local.
+func (c *Config) plan(location string) (transferPlan, error) {
+	plan := transferPlan{}
+
+	targetDestination, target, targetRemote, err := c.Options().ParseLocation(os.ExpandEnv(location))
+	if err != nil {
+		return plan, err
+	}
+
+	plan.target = target
+	plan.upload = targetRemote
+	plan.destination = targetDestination
+
+	for i, source := range c.Source {
+		sourceDestination, path, sourceRemote, err := c.Options().ParseLocation(os.ExpandEnv(source))
 		if err != nil {
-			return err
+			return plan, err
 		}
 
-		c.locationPasswordFile = filename
+		if sourceRemote == targetRemote {
+			return plan, fmt.Errorf("%w: %s to %s", ErrUnsupportedTransfer, source, location)
+		}
+
+		if sourceRemote {
+			if i > 0 && sourceDestination != plan.destination {
+				return plan, fmt.Errorf("%w: sources are on different systems", ErrUnsupportedTransfer)
+			}
+
+			plan.destination = sourceDestination
+		}
+
+		plan.sources = append(plan.sources, path)
 	}
 
-	if c.SSHPassphrase != "" {
-		filename, err := openssh.CreateRestrictedFile(c.fs, openssh.TempPassphrasePrefix, c.SSHPassphrase)
-		if err != nil {
-			return err
+	return plan, nil
+}
+
+// Run connects to the remote system natively and copies the files over SFTP,
+// logging each file as it's copied. It's only used by the native backend.
+func (c *Config) Run(ctx context.Context, stdout, _ io.Writer) error {
+	plan, err := c.plan(c.Target)
+	if err != nil {
+		return err
+	}
+
+	logrus.Infof("connecting to %s", plan.destination)
+
+	client, err := native.Dial(ctx, c.DialConfig(c.fs, plan.destination))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	sftpClient, err := sftp.NewClient(client)
+	if err != nil {
+		return fmt.Errorf("couldn't start sftp: %w", err)
+	}
+	defer sftpClient.Close()
+
+	// Closing the connection is the only way to interrupt a transfer in the middle of a file.
+	stop := context.AfterFunc(ctx, func() {
+		client.Close()
+	})
+	defer stop()
+
+	transfer := &native.Transfer{
+		Client:    sftpClient,
+		Fs:        c.fs,
+		Recursive: c.hasFlag('r'),
+		Preserve:  c.hasFlag('p'),
+		Progress:  stdout,
+		Remote:    plan.destination.Host,
+	}
+
+	if plan.upload {
+		err = transfer.Upload(ctx, plan.sources, plan.target)
+	} else {
+		err = transfer.Download(ctx, plan.sources, plan.target)
+	}
+
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("transfer interrupted: %w", ctx.Err())
+	}
+
+	return err
+}
+
+// hasFlag checks if the single letter scp flag was given in SCPFlags,
+// either on its own or combined with others like -rp.
+func (c *Config) hasFlag(flag rune) bool {
+	for _, f := range c.SCPFlags {
+		if len(f) < 2 || f[0] != '-' || f[1] == '-' || strings.ContainsAny(f, " =") {
+			continue
 		}
 
-		c.locationPassphraseFile = filename
+		if strings.ContainsRune(f[1:], flag) {
+			return true
+		}
 	}
 
-	return nil
+	return false
+}
+
+// expandTargets works out every target the sources are copied to. Destinations that are only a
+// host are combined with the Target, which is the remote path they're copied to, while the ones
+// that are a whole remote location are used as they are, along with a Target that's remote.
+func (c *Config) expandTargets() ([]string, error) {
+	if len(c.Destinations) == 0 {
+		return []string{c.Target}, nil
+	}
+
+	path := c.Target
+	targets := []string{}
+
+	if isRemote(c.Target) {
+		targets = append(targets, c.Target)
+		path = ""
+	}
+
+	for _, destination := range c.Destinations {
+		switch {
+		case isRemote(destination):
+			targets = append(targets, destination)
+		case path == "":
+			return nil, fmt.Errorf("%w for destination %s", ErrMissingTarget, destination)
+		default:
+			targets = append(targets, combineLocation(destination, path))
+		}
+	}
+
+	return targets, nil
+}
+
+// combineLocation combines a host in the [user@]host or ssh://[user@]host[:port]
+// form with the remote path into a location on that host.
+func combineLocation(destination, path string) string {
+	if host, ok := strings.CutPrefix(destination, "ssh://"); ok {
+		return "scp://" + strings.TrimSuffix(host, "/") + "/" + path
+	}
+
+	return destination + ":" + path
+}
+
+// isRemote checks if the location is on a remote system, as opposed to being a local
+// path or a host in the ssh:// form, which scp would otherwise mistake for a host of ssh.
+func isRemote(location string) bool {
+	if strings.HasPrefix(location, "ssh://") {
+		return false
+	}
+
+	_, _, remote, _ := openssh.ParseLocation(os.ExpandEnv(location))
+
+	return remote
+}
+
+// everyTarget returns each of the targets the sources are copied to.
+func (c *Config) everyTarget() []string {
+	if len(c.targets) > 0 {
+		return c.targets
+	}
+
+	return []string{c.Target}
+}
+
+// Targets returns a copy of the configuration for each of the targets when there are several,
+// which share everything Setup created, or none when there's a single target. Each is named
+// after the host of its target, or its host and port when the host is used more than once,
+// falling back to the whole target when that isn't enough to tell them apart either.
+// Those selected from the inventory are named as they are in it instead.
+func (c *Config) Targets() []binarywrapper.Target {
+	if len(c.targets) == 0 {
+		return nil
+	}
+
+	hosts := make([]string, 0, len(c.targets))
+	addresses := make([]string, 0, len(c.targets))
+	counts := map[string]int{}
+
+	for _, t := range c.targets {
+		host, address := os.ExpandEnv(t), os.ExpandEnv(t)
+
+		if destination, _, remote, err := c.Options().ParseLocation(host); err == nil && remote {
+			host, address = destination.Host, destination.Address()
+		}
+
+		hosts = append(hosts, host)
+		addresses = append(addresses, address)
+		counts["host "+host]++
+		counts["address "+address]++
+	}
+
+	targets := make([]binarywrapper.Target, 0, len(c.targets))
+
+	for i, t := range c.targets {
+		target := *c
+		target.Target = t
+		target.Destinations = nil
+		target.targets = nil
+		target.applyInventoryHost(t)
+
+		name := hosts[i]
+
+		switch {
+		case c.inventoryHosts[t].Name != "":
+			name = c.inventoryHosts[t].Name
+		case counts["host "+hosts[i]] == 1:
+		case counts["address "+addresses[i]] == 1:
+			name = addresses[i]
+		default:
+			name = strings.TrimPrefix(os.ExpandEnv(t), "scp://")
+		}
+
+		targets = append(targets, binarywrapper.Target{Name: name, PluginConfig: &target})
+	}
+
+	return targets
 }
 
 // Binary returns the system path location for either the scp binary (by default)
@@ -204,11 +593,7 @@ func (c *Config) Arguments() []string {
 
 		if len(c.SSHPassword) > 0 {
 			args = append(args, "-f")
-			args = append(args, c.locationPasswordFile)
-		} else if len(c.SSHPassphrase) > 0 {
-			args = append(args, "-Passphrase")
-			args = append(args, "-f")
-			args = append(args, c.locationPassphraseFile)
+			args = append(args, c.PasswordFile())
 		}
 
 		args = append(args, c.locationSCPbinary)
@@ -216,7 +601,13 @@ func (c *Config) Arguments() []string {
 		args = append(args, c.locationSCPbinary)
 	}
 
-	if len(c.SCPFlags) == 0 {
+	if c.SSHConfigFile() != "" {
+		args = append(args, "-F", c.SSHConfigFile())
+	}
+
+	args = append(args, c.HostKeyFlags()...)
+
+	if len(c.SCPFlags) == 0 && len(c.HostKeyFlags()) == 0 {
 		args = append(args, openssh.DefaultSCPFlags...)
 	} else {
 		args = append(args, c.SCPFlags...)
@@ -229,6 +620,10 @@ func (c *Config) Arguments() []string {
 		}
 	}
 
+	for _, file := range c.CertificateFiles() {
+		args = append(args, fmt.Sprintf("-o CertificateFile=%q", file))
+	}
+
 	args = append(args, c.Source...)
 	args = append(args, c.Target)
 
@@ -240,17 +635,24 @@ func (c *Config) Arguments() []string {
 // require anything in particular, but a few env vars are provided so that users
 // can place that in their pipeline for diagnostic purposes.
 func (c *Config) Environment() map[string]string {
-	return map[string]string{
+	environment := map[string]string{
 		"VELA_SCP_PLUGIN_VERSION": openssh.PluginVersion,
 		"VELA_SCP_PLUGIN_COMMIT":  openssh.GitCommit,
 	}
+
+	// Jump hosts are connected to by their own ssh process, which
+	// finds the agent through the environment just the same.
+	if c.Agent() != nil {
+		environment["SSH_AUTH_SOCK"] = c.Agent().Socket
+	}
+
+	return environment
 }
 
 // useSSHPass returns true if the plugin configuration requires the use of the sshpass binary.
-// This typically only happens if a password or passphrase is provided but if a user also wants
-// to override the sshpass flags then we also will inject sshpass into the mix.
+// This typically only happens if a password is provided but if a user also wants to override
+// the sshpass flags then we also will inject sshpass into the mix, unless a passphrase is
+// provided since those are handled by the built-in agent rather than sshpass.
 func (c *Config) useSSHPass() bool {
-	return len(c.SSHPASSFlags)+
-		len(c.SSHPassword)+
-		len(c.SSHPassphrase) > 0
+	return len(c.SSHPassword) > 0 || (len(c.SSHPASSFlags) > 0 && !c.UseAgent())
 }
@@ -0,0 +1,89 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package ssh
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// envName matches the names the remote shell accepts for environmental variables.
+var envName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+// parseEnv parses the environmental variables for the remote commands, which are a map
+// given as either JSON or YAML. Values are expanded with the environmental variables
+// of the plugin, so secrets can be referenced like $DEPLOY_TOKEN.
+func parseEnv(raw string) (map[string]string, error) {
+	env := map[string]string{}
+
+	if strings.TrimSpace(raw) == "" {
+		return env, nil
+	}
+
+	values := map[string]any{}
+	if err := yaml.Unmarshal([]byte(raw), &values); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidEnv, err)
+	}
+
+	for name, value := range values {
+		if !envName.MatchString(name) {
+			return nil, fmt.Errorf("%w: %q isn't a valid variable name", ErrInvalidEnv, name)
+		}
+
+		switch v := value.(type) {
+		case nil:
+			env[name] = ""
+		case string:
+			env[name] = os.ExpandEnv(v)
+		case int, float64, bool:
+			env[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("%w: %s has to be a string, number or boolean", ErrInvalidEnv, name)
+		}
+	}
+
+	return env, nil
+}
+
+// envScript returns the shell script exporting the environmental variables, in order of their names.
+func envScript(env map[string]string) string {
+	var script strings.Builder
+
+	names := make([]string, 0, len(env))
+	for name := range env {
+		names = append(names, name)
+	}
+
+	slices.Sort(names)
+
+	for _, name := range names {
+		fmt.Fprintf(&script, "export %s=%s\n", name, quote(env[name]))
+	}
+
+	return script.String()
+}
+
+// envCommand wraps the remote command so it first reads the script exporting the environmental
+// variables from stdin, which is sent ahead of anything else. The script is read with dd one byte
+// at a time so none of the input meant for the command itself is taken along with it, and the
+// values never appear in the arguments of any process where they could be seen with ps.
+func envCommand(script, command string) string {
+	return fmt.Sprintf(`eval "$(dd bs=1 count=%d 2>/dev/null)" && %s`, len(script), command)
+}
+
+// expandEnv expands the environmental variables of the plugin in the command like os.ExpandEnv,
+// except for those exported on the remote system which are left for the remote shell to expand.
+func expandEnv(command string, env map[string]string) string {
+	return os.Expand(command, func(name string) string {
+		if _, ok := env[name]; ok {
+			return "${" + name + "}"
+		}
+
+		return os.Getenv(name)
+	})
+}
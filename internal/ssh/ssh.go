@@ -6,13 +6,21 @@
 package ssh
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"io"
+	"os"
+	"slices"
 	"strings"
 
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/afero"
 
+	"github.com/go-vela/vela-openssh/internal/auth"
+	"github.com/go-vela/vela-openssh/internal/native"
 	"github.com/go-vela/vela-openssh/internal/openssh"
+	"github.com/go-vela/vela-openssh/pkg/binarywrapper"
 )
 
 var (
@@ -21,6 +29,39 @@ var (
 
 	// ErrMissingCommand is a returned when the plugin is missing the command parameter.
 	ErrMissingCommand = errors.New("missing command parameter")
+
+	// ErrUnknownCommandMode is returned when the plugin is configured with a command mode that doesn't exist.
+	ErrUnknownCommandMode = fmt.Errorf("unknown command mode, use %q, %q or %q", CommandModeJoin, CommandModeScript, CommandModeSteps)
+
+	// ErrContinueOnError is returned when continuing on error is asked for outside of the steps command mode.
+	ErrContinueOnError = fmt.Errorf("continue on error needs the %q command mode", CommandModeSteps)
+
+	// ErrInvalidEnv is returned when the environmental variables for the remote commands can't be parsed.
+	ErrInvalidEnv = errors.New("invalid env")
+)
+
+// These are the ways the commands can be run on the remote system.
+const (
+	// CommandModeJoin joins the commands with && into a single command
+	// for the login shell of the remote user, which is the default.
+	CommandModeJoin = "join"
+
+	// CommandModeScript sends the commands as a script over stdin to the interpreter,
+	// exactly as they were written, so multi-line commands and shell state work.
+	CommandModeScript = "script"
+
+	// CommandModeSteps runs the commands one after another in the same shell like they are
+	// when joined, reporting on each one with a header before it starts and a summary of
+	// their exit codes and durations at the end.
+	CommandModeSteps = "steps"
+
+	// DefaultInterpreter runs the script when no interpreter is given,
+	// stopping at the first command that fails.
+	DefaultInterpreter = "bash -euo pipefail"
+
+	// DefaultStepsInterpreter runs the commands in the steps command mode when no interpreter
+	// is given, which has to be a POSIX shell since the commands are wrapped in shell script.
+	DefaultStepsInterpreter = "sh"
 )
 
 type Config struct {
@@ -30,46 +71,69 @@ type Config struct {
 	// to execute on the remote system
 	Command []string
 
+	// CommandMode picks how the commands are run on the remote system, either joined
+	// with && for the login shell (the default), sent as a script to the Interpreter,
+	// or run as steps that are each reported on.
+	CommandMode string
+
+	// Interpreter is the remote command that the script is sent to over stdin in the
+	// script command mode, like "sh -e" or "python3", defaulting to DefaultInterpreter.
+	// In the steps command mode it has to be a POSIX shell, defaulting to DefaultStepsInterpreter.
+	Interpreter string
+
+	// ContinueOnError keeps running the rest of the commands in the steps command mode
+	// when one of them fails, failing the plugin once they've all run instead.
+	ContinueOnError bool
+
+	// Env is a map of environmental variables given as JSON or YAML that are exported before
+	// the commands run on the remote system, with values expanded so they can reference secrets
+	// like $DEPLOY_TOKEN. They're sent over stdin ahead of anything else rather than on the
+	// command line, so they don't show up in ps on the remote system or need AcceptEnv set
+	// in its sshd_config, and their values are redacted from the logs.
+	Env string
+
 	// Destination is the machine where the plugin will execute the command.
 	Destination string
 
-	// IdentityFilePath is the path to the identity file to use
-	// for authenticating against remote systems. You can specify
-	// multiple files to use each one in turn if needed.
-	IdentityFilePath []string
+	// Destinations are several machines to execute the command on rather than just the one,
+	// with a Destination set being the first of them. The output from each is prefixed with
+	// its host, and a summary of how each went is given once the command has finished on all
+	// of them. How many run at once and how many may fail are up to the binarywrapper.Plugin.
+	Destinations []string
 
-	// IdentityFileContents is a string representation of an identity
-	// file. This is used since the plugin needs to consume secrets
-	// and those sometimes come through as environmental variables
-	// so we'll need to take the raw contents and place them into a file
-	// so that the binaries later can use them.
-	IdentityFileContents string
+	// InventoryContents is an Ansible-style inventory in either the INI or YAML format, usually
+	// given as a secret, and InventoryPath is the path to one, usually in the workspace. Each of
+	// the hosts selected from it is added to the Destinations, connected to with the user, port
+	// and identity file from its variables, which the commands can reference like {{ app_version }}.
+	InventoryContents string
+	InventoryPath     string
 
-	// SSHFlags is for setting or overriding any sort of SSH features.
-	SSHFlags []string
+	// Hosts is the pattern selecting the hosts from the inventory, like "web:&prod:!canary",
+	// which selects all of them when it isn't set.
+	Hosts string
 
-	// SSHPassword is used for authenticating against systems with a password
-	// instead of an identity file. Since this is passed to sshpass it's
-	// limited to only one password for whatever remote systems are in use.
-	// Prefer to use identity files if possible since you can specify quite a bit more.
-	SSHPassword string
+	// Credentials are how remote systems are authenticated against and have their host keys verified.
+	auth.Credentials
 
-	// SSHPassphrase is used for the identity files specified. Just like with SSHPassword
-	// this is handed off to sshpass to use in authentication and it only supports
-	// one parameter, so this passphrase needs to be viable for all identity files
-	// that contain a passphrase. If needing multiple identity files be sure
-	// they all use the same passphrase for the remote systems.
-	SSHPassphrase string
+	// SSHFlags is for setting or overriding any sort of SSH features.
+	SSHFlags []string
 
 	// SSHPASSFlags is for setting or overriding any sort of sshpass features.
 	SSHPASSFlags []string
 
+	// Backend picks how the plugin connects to the remote system, either by executing
+	// the OpenSSH binaries (the default) or natively in process without any binaries.
+	// The native backend ignores SSHFlags and SSHPASSFlags since there's no binary to pass them to.
+	Backend string
+
 	// Internal flags & data
-	fs                     afero.Fs
-	locationSSHbinary      string
-	locationSSHPASSbinary  string
-	locationPassphraseFile string
-	locationPasswordFile   string
+	fs                    afero.Fs
+	locationSSHbinary     string
+	locationSSHPASSbinary string
+	stepMarker            string
+	stepReporter          *stepReporter
+	inventoryHosts        map[string]openssh.InventoryHost
+	env                   map[string]string
 }
 
 // Validate checks some basic plugin configuration parameters
@@ -80,25 +144,181 @@ type Config struct {
 // errors by using the binary itself. Why duplicate that validation
 // logic when the binaries can do that for us?
 func (c *Config) Validate() error {
-	if len(c.Destination) == 0 {
+	if c.fs == nil {
+		c.fs = afero.NewOsFs()
+	}
+
+	if err := c.loadInventory(); err != nil {
+		return err
+	}
+
+	if err := c.validateDestinations(); err != nil {
+		return err
+	}
+
+	if err := c.validateCommand(); err != nil {
+		return err
+	}
+
+	if err := openssh.ValidateBackend(c.Backend); err != nil {
+		return err
+	}
+
+	if err := c.Credentials.Validate(c.fs); err != nil {
+		return err
+	}
+
+	return c.validateBackend()
+}
+
+// validateDestinations settles on whether the command is executed on a lone
+// destination or fanned out to several of them, making sure there's at least one.
+func (c *Config) validateDestinations() error {
+	if c.Destination != "" && len(c.Destinations) > 0 {
+		c.Destinations = append([]string{c.Destination}, c.Destinations...)
+		c.Destination = ""
+	}
+
+	if len(c.Destinations) == 1 {
+		c.Destination, c.Destinations = c.Destinations[0], nil
+	}
+
+	if len(c.destinations()) == 0 {
 		return ErrMissingDestination
 	}
 
+	c.applyInventoryHost(c.Destination)
+
+	return nil
+}
+
+// validateCommand checks the commands along with how they're run
+// and parses the environmental variables exported before them.
+func (c *Config) validateCommand() error {
 	if len(c.Command) == 0 {
 		return ErrMissingCommand
 	}
 
-	if len(c.SSHPassword) > 0 && len(c.SSHPassphrase) > 0 {
-		return openssh.ErrAmbiguousAuth
+	switch c.CommandMode {
+	case "", CommandModeJoin, CommandModeScript:
+	case CommandModeSteps:
+		c.stepMarker = newStepMarker()
+	default:
+		return fmt.Errorf("%w: %q", ErrUnknownCommandMode, c.CommandMode)
+	}
+
+	if c.ContinueOnError && c.CommandMode != CommandModeSteps {
+		return ErrContinueOnError
 	}
 
+	env, err := parseEnv(c.Env)
+	if err != nil {
+		return err
+	}
+
+	c.env = env
+
+	return nil
+}
+
+// validateBackend checks the destinations can be connected to by the native
+// backend and warns about the parameters the chosen backend ignores.
+func (c *Config) validateBackend() error {
+	if !c.HostKeys().Enabled() && (c.Backend == openssh.BackendNative || len(c.SSHFlags) == 0) {
+		logrus.Warn("host keys aren't being verified, set known_hosts.contents, known_hosts.path or host_key.fingerprint to verify them")
+	}
+
+	if c.Backend != openssh.BackendNative {
+		if c.SSHPassphrase != "" && len(c.SSHPASSFlags) > 0 {
+			logrus.Warn("sshpass flags are ignored since passphrases are handled by the built-in agent")
+		}
+
+		return nil
+	}
+
+	for _, destination := range c.destinations() {
+		if _, err := c.Options().ParseDestination(destination); err != nil {
+			return err
+		}
+	}
+
+	if len(c.SSHFlags)+len(c.SSHPASSFlags) > 0 {
+		logrus.Warn("ssh and sshpass flags are ignored by the native backend")
+	}
+
+	return nil
+}
+
+// loadInventory adds the hosts selected from the inventory to the Destinations, checking that
+// the commands only reference variables each of them has. Hosts connecting to the same
+// destination are rejected since there'd be no telling which of their variables to use.
+func (c *Config) loadInventory() error {
+	inventory, err := openssh.LoadInventory(c.fs, c.InventoryContents, c.InventoryPath)
+	if err != nil {
+		return err
+	}
+
+	if inventory == nil {
+		if c.Hosts != "" {
+			return openssh.ErrMissingInventory
+		}
+
+		return nil
+	}
+
+	hosts, err := inventory.Select(c.Hosts)
+	if err != nil {
+		return err
+	}
+
+	c.inventoryHosts = map[string]openssh.InventoryHost{}
+
+	for _, host := range hosts {
+		for _, command := range c.Command {
+			if _, err := host.Render(command); err != nil {
+				return err
+			}
+		}
+
+		destination := host.Destination()
+		if other, ok := c.inventoryHosts[destination]; ok {
+			return fmt.Errorf("%w: %s and %s both connect to %s", openssh.ErrInvalidInventory, other.Name, host.Name, destination)
+		}
+
+		c.inventoryHosts[destination] = host
+		c.Destinations = append(c.Destinations, destination)
+	}
+
+	logrus.Infof("selected %d hosts from the inventory", len(hosts))
+
 	return nil
 }
 
+// applyInventoryHost renders the commands with the variables of the host from the inventory
+// that the destination came from and adds its identity file, if it came from one at all.
+func (c *Config) applyInventoryHost(destination string) {
+	host, ok := c.inventoryHosts[destination]
+	if !ok {
+		return
+	}
+
+	commands := make([]string, 0, len(c.Command))
+	for _, command := range c.Command {
+		rendered, _ := host.Render(command)
+		commands = append(commands, rendered)
+	}
+
+	c.Command = commands
+
+	if file := host.IdentityFile(); file != "" {
+		c.IdentityFilePath = append(slices.Clone(c.IdentityFilePath), file)
+	}
+}
+
 // Setup will make sure all of the internal configuration of
 // the plugin is set and ready to go along with any sorts of
 // file system side effects and preparations are done.
-func (c *Config) Setup() error {
+func (c *Config) Setup(ctx context.Context) error {
 	// This wouldn't be nil in testing situations but in
 	// general it will be nil for most runtime scenarios.
 	// This allows us to mock the filesystem in testing
@@ -108,10 +328,33 @@ func (c *Config) Setup() error {
 		c.fs = afero.NewOsFs()
 	}
 
-	// Pickup the SSH & sshpass binaries from whatever location
-	// they might be currently installed into. Inside a plugin this
-	// should stay static, but when debugging and running this
-	// outside of the container it's nice if it picks up user binaries.
+	if err := c.SetupVault(ctx); err != nil {
+		return err
+	}
+
+	// The native backend doesn't need any binaries, and it keeps
+	// secrets in memory rather than placing them into files.
+	if c.Backend == openssh.BackendNative {
+		return nil
+	}
+
+	if err := c.findBinaries(); err != nil {
+		return err
+	}
+
+	destinations, err := c.pinnedDestinations()
+	if err != nil {
+		return err
+	}
+
+	return c.Credentials.Setup(ctx, c.fs, destinations)
+}
+
+// findBinaries picks up the SSH & sshpass binaries from whatever
+// location they might be currently installed into. Inside a plugin this
+// should stay static, but when debugging and running this outside of
+// the container it's nice if it picks up user binaries.
+func (c *Config) findBinaries() error {
 	for _, path := range openssh.BinSearchLocations {
 		tempSSHPath := fmt.Sprintf("%s/ssh", path)
 		tempSSHPassPath := fmt.Sprintf("%s/sshpass", path)
@@ -129,38 +372,140 @@ func (c *Config) Setup() error {
 		return openssh.ErrMissingSSH
 	}
 
-	if c.locationSSHPASSbinary == "" {
+	if c.useSSHPass() && c.locationSSHPASSbinary == "" {
 		return openssh.ErrMissingSSHPASS
 	}
 
-	if c.IdentityFileContents != "" {
-		filename, err := openssh.CreateRestrictedFile(c.fs, openssh.TempIdentityFilePrefix, c.IdentityFileContents)
+	return nil
+}
+
+// pinnedDestinations returns the destinations to pin the host keys of,
+// which is all of them when there's a fingerprint to pin them to.
+func (c *Config) pinnedDestinations() ([]openssh.Destination, error) {
+	destinations := []openssh.Destination{}
+
+	if len(c.HostKeyFingerprint) == 0 {
+		return destinations, nil
+	}
+
+	for _, d := range c.destinations() {
+		destination, err := c.Options().ParseDestination(os.ExpandEnv(d))
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		c.IdentityFilePath = append([]string{filename}, c.IdentityFilePath...)
+		destinations = append(destinations, destination)
 	}
 
-	if c.SSHPassword != "" {
-		filename, err := openssh.CreateRestrictedFile(c.fs, openssh.TempPasswordPrefix, c.SSHPassword)
-		if err != nil {
-			return err
+	return destinations, nil
+}
+
+// Redactions returns every secret the plugin knows of so that they can be
+// masked in the logs. That's those in the credentials along with the values
+// of the environmental variables.
+func (c *Config) Redactions() []string {
+	if c.fs == nil {
+		c.fs = afero.NewOsFs()
+	}
+
+	secrets := c.Credentials.Redactions(c.fs)
+
+	// Any of the environmental variables could be a secret, so all of their values are redacted.
+	env, _ := parseEnv(c.Env)
+	for _, value := range env {
+		if value != "" {
+			secrets = append(secrets, value)
 		}
+	}
 
-		c.locationPasswordFile = filename
+	return secrets
+}
+
+// Run connects to the destination natively and executes the command there,
+// streaming the output as it arrives. It's only used by the native backend.
+func (c *Config) Run(ctx context.Context, stdout, stderr io.Writer) error {
+	destination, err := c.Options().ParseDestination(os.ExpandEnv(c.Destination))
+	if err != nil {
+		return err
 	}
 
-	if c.SSHPassphrase != "" {
-		filename, err := openssh.CreateRestrictedFile(c.fs, openssh.TempPassphrasePrefix, c.SSHPassphrase)
-		if err != nil {
-			return err
+	logrus.Infof("connecting to %s", destination)
+
+	client, err := native.Dial(ctx, c.DialConfig(c.fs, destination))
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	command := expandEnv(strings.Join(c.Command, " && "), c.env)
+	if c.CommandMode == CommandModeScript || c.CommandMode == CommandModeSteps {
+		command = c.interpreter()
+	}
+
+	return native.Run(ctx, client, c.withEnv(command), c.Input(), stdout, stderr)
+}
+
+// Targets returns a copy of the configuration for each of the destinations when there are
+// several, which share everything Setup created, or none when there's a single destination.
+// Each is named after the host of its destination, or its host and port when the host is
+// used more than once, falling back to the whole destination when that isn't enough either.
+// Those selected from the inventory are named as they are in it instead.
+func (c *Config) Targets() []binarywrapper.Target {
+	if len(c.Destinations) == 0 {
+		return nil
+	}
+
+	hosts := make([]string, 0, len(c.Destinations))
+	addresses := make([]string, 0, len(c.Destinations))
+	counts := map[string]int{}
+
+	for _, d := range c.Destinations {
+		host, address := os.ExpandEnv(d), os.ExpandEnv(d)
+
+		if destination, err := c.Options().ParseDestination(host); err == nil {
+			host, address = destination.Host, destination.Address()
 		}
 
-		c.locationPassphraseFile = filename
+		hosts = append(hosts, host)
+		addresses = append(addresses, address)
+		counts["host "+host]++
+		counts["address "+address]++
 	}
 
-	return nil
+	targets := make([]binarywrapper.Target, 0, len(c.Destinations))
+
+	for i, d := range c.Destinations {
+		target := *c
+		target.Destination = d
+		target.Destinations = nil
+		target.stepReporter = nil
+		target.applyInventoryHost(d)
+
+		name := hosts[i]
+
+		switch {
+		case c.inventoryHosts[d].Name != "":
+			name = c.inventoryHosts[d].Name
+		case counts["host "+hosts[i]] == 1:
+		case counts["address "+addresses[i]] == 1:
+			name = addresses[i]
+		default:
+			name = strings.TrimPrefix(os.ExpandEnv(d), "ssh://")
+		}
+
+		targets = append(targets, binarywrapper.Target{Name: name, PluginConfig: &target})
+	}
+
+	return targets
+}
+
+// destinations returns every destination the command is executed on.
+func (c *Config) destinations() []string {
+	if c.Destination != "" {
+		return []string{c.Destination}
+	}
+
+	return c.Destinations
 }
 
 // Binary returns the system path location for either the ssh binary (by default)
@@ -193,11 +538,7 @@ func (c *Config) Arguments() []string {
 
 		if len(c.SSHPassword) > 0 {
 			args = append(args, "-f")
-			args = append(args, c.locationPasswordFile)
-		} else if len(c.SSHPassphrase) > 0 {
-			args = append(args, "-Passphrase")
-			args = append(args, "-f")
-			args = append(args, c.locationPassphraseFile)
+			args = append(args, c.PasswordFile())
 		}
 
 		args = append(args, c.locationSSHbinary)
@@ -205,7 +546,13 @@ func (c *Config) Arguments() []string {
 		args = append(args, c.locationSSHbinary)
 	}
 
-	if len(c.SSHFlags) == 0 {
+	if c.SSHConfigFile() != "" {
+		args = append(args, "-F", c.SSHConfigFile())
+	}
+
+	args = append(args, c.HostKeyFlags()...)
+
+	if len(c.SSHFlags) == 0 && len(c.HostKeyFlags()) == 0 {
 		args = append(args, openssh.DefaultSSHFlags...)
 	} else {
 		args = append(args, c.SSHFlags...)
@@ -218,31 +565,123 @@ func (c *Config) Arguments() []string {
 		}
 	}
 
+	for _, file := range c.CertificateFiles() {
+		args = append(args, fmt.Sprintf("-o CertificateFile=%q", file))
+	}
+
 	args = append(args, c.Destination)
 
-	args = append(args, strings.Join(c.Command, " && "))
+	if c.CommandMode == CommandModeScript || c.CommandMode == CommandModeSteps {
+		args = append(args, c.withEnv(c.interpreter()))
+	} else {
+		args = append(args, c.withEnv(strings.Join(c.Command, " && ")))
+	}
 
 	return args
 }
 
+// Input returns the script for the interpreter in the script command mode, which is
+// the commands exactly as they were written, each on a line of its own. It's not
+// expanded with environmental variables so those are left for the remote system.
+// In the steps command mode it's the commands wrapped with their markers instead.
+// Either way, the script exporting the environmental variables is sent ahead of it.
+func (c *Config) Input() io.Reader {
+	script := envScript(c.env)
+
+	switch c.CommandMode {
+	case CommandModeSteps:
+		commands := make([]string, 0, len(c.Command))
+		for _, command := range c.Command {
+			commands = append(commands, expandEnv(command, c.env))
+		}
+
+		script += stepsScript(c.stepMarker, commands, c.ContinueOnError)
+	case CommandModeScript:
+		for _, command := range c.Command {
+			script += strings.TrimSuffix(command, "\n") + "\n"
+		}
+	default:
+		if script == "" {
+			return nil
+		}
+	}
+
+	return strings.NewReader(script)
+}
+
+// withEnv wraps the remote command to export the environmental variables first, if there are any.
+func (c *Config) withEnv(command string) string {
+	if len(c.env) == 0 {
+		return command
+	}
+
+	return envCommand(envScript(c.env), command)
+}
+
+// Expand implements binarywrapper.Expander so the environmental variables exported on the
+// remote system are left for the remote shell to expand in the arguments, like they are when
+// joining the commands for the native backend, rather than being expanded to nothing locally.
+func (c *Config) Expand(arg string) string {
+	return expandEnv(arg, c.env)
+}
+
+// interpreter returns the remote command that the script is sent to.
+func (c *Config) interpreter() string {
+	switch {
+	case c.Interpreter != "":
+		return c.Interpreter
+	case c.CommandMode == CommandModeSteps:
+		return DefaultStepsInterpreter
+	default:
+		return DefaultInterpreter
+	}
+}
+
+// Watch picks the markers out of the output in the steps command mode to report on each
+// of the commands, otherwise the output is left alone.
+func (c *Config) Watch(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if c.CommandMode != CommandModeSteps {
+		return stdout, stderr
+	}
+
+	c.stepReporter = newStepReporter(c.stepMarker, c.Command, stdout)
+
+	return c.stepReporter, stderr
+}
+
+// Done writes the summary of the commands in the steps command mode.
+func (c *Config) Done(code int) {
+	if c.stepReporter != nil {
+		c.stepReporter.Done(code)
+		c.stepReporter = nil
+	}
+}
+
 // Environment returns a mapping of key/value strings representing any additional
 // environmental variables a particular plugin might need. This plugin doesn't
 // require anything in particular, but a few env vars are provided so that users
 // can place that in their pipeline for diagnostic purposes.
 
 func (c *Config) Environment() map[string]string {
-	return map[string]string{
+	environment := map[string]string{
 		"VELA_SSH_PLUGIN_VERSION": openssh.PluginVersion,
 		"VELA_SSH_PLUGIN_COMMIT":  openssh.GitCommit,
 	}
+
+	// Jump hosts are connected to by their own ssh process, which
+	// finds the agent through the environment just the same.
+	if c.Agent() != nil {
+		environment["SSH_AUTH_SOCK"] = c.Agent().Socket
+	}
+
+	return environment
 }
 
 // useSSHPass returns true if the plugin configuration requires the use of the sshpass binary.
-// This typically only happens if a password or passphrase is provided but if a user also wants
-// to override the sshpass flags then we also will inject sshpass into the mix.
+// This typically only happens if a password is provided but if a user also wants to override
+// the sshpass flags then we also will inject sshpass into the mix, unless a passphrase is
+// provided since those are handled by the built-in agent rather than sshpass.
 
 func (c *Config) useSSHPass() bool {
-	return len(c.SSHPASSFlags)+
-		len(c.SSHPassword)+
-		len(c.SSHPassphrase) > 0
+	return len(c.SSHPassword) > 0 || (len(c.SSHPASSFlags) > 0 && !c.UseAgent())
 }
@@ -0,0 +1,209 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package ssh
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+)
+
+// stepsScript returns the shell script for the steps command mode, which runs each of the
+// commands in turn in the same shell, like they would be when joined with &&, and prints
+// a marker before and after each one so they can be reported on as the output arrives.
+// With continueOnError a command failing doesn't stop the rest, but the script still
+// exits with the code of the first command that failed once they've all run. The script
+// itself is read by the shell from stdin, so each command gets /dev/null as its stdin instead
+// to keep anything reading from it from swallowing the commands after it. The commands are
+// expected to have been expanded with environmental variables already.
+func stepsScript(marker string, commands []string, continueOnError bool) string {
+	var script strings.Builder
+
+	script.WriteString("set +e\n__vela_failed=0\n")
+
+	for i, command := range commands {
+		fmt.Fprintf(&script, "printf '%%s\\n' %s\n", quote(fmt.Sprintf("%sbegin %d", marker, i+1)))
+		fmt.Fprintf(&script, "eval %s </dev/null\n", quote(command))
+		fmt.Fprintf(&script, "__vela_status=$?\n")
+		fmt.Fprintf(&script, "printf '%%s %%s\\n' %s \"$__vela_status\"\n", quote(fmt.Sprintf("%send %d", marker, i+1)))
+
+		if continueOnError {
+			script.WriteString("[ \"$__vela_status\" -eq 0 ] || [ \"$__vela_failed\" -ne 0 ] || __vela_failed=$__vela_status\n")
+		} else {
+			script.WriteString("[ \"$__vela_status\" -eq 0 ] || exit \"$__vela_status\"\n")
+		}
+	}
+
+	script.WriteString("exit \"$__vela_failed\"\n")
+
+	return script.String()
+}
+
+// quote single quotes the string for the shell.
+func quote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+// firstLine shortens a multi-line command down to its first line for the headers and summary.
+func firstLine(command string) string {
+	command = strings.TrimSpace(command)
+
+	if i := strings.IndexByte(command, '\n'); i >= 0 {
+		return strings.TrimSpace(command[:i]) + " ..."
+	}
+
+	return command
+}
+
+// newStepMarker returns a marker that's unique to the run, so the output
+// of the commands can't be mistaken for one, or pretend to be one.
+func newStepMarker() string {
+	nonce := make([]byte, 8)
+	_, _ = rand.Read(nonce)
+
+	return "::vela-ssh-" + hex.EncodeToString(nonce) + "::"
+}
+
+// stepResult is how one of the commands went in the steps command mode.
+type stepResult struct {
+	command  string
+	ran      bool
+	code     int
+	started  time.Time
+	duration time.Duration
+}
+
+// stepReporter is an io.Writer for the stdout of the steps script, which passes the output
+// of the commands along while picking the markers out of it. A header is written before each
+// command starts, and a summary of how each one went is written once the script has finished.
+type stepReporter struct {
+	mu      sync.Mutex
+	marker  string
+	out     io.Writer
+	buf     []byte
+	current int
+	results []stepResult
+}
+
+// newStepReporter creates a reporter for the commands, writing to out.
+func newStepReporter(marker string, commands []string, out io.Writer) *stepReporter {
+	results := make([]stepResult, 0, len(commands))
+	for _, command := range commands {
+		results = append(results, stepResult{command: firstLine(command)})
+	}
+
+	return &stepReporter{
+		marker:  marker,
+		out:     out,
+		current: -1,
+		results: results,
+	}
+}
+
+// Write implements io.Writer by handling every complete line
+// and holding onto any trailing partial line for the next write.
+func (r *stepReporter) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.buf = append(r.buf, p...)
+
+	for {
+		i := bytes.IndexByte(r.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		r.line(string(r.buf[:i+1]))
+		r.buf = r.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// line passes a line of output along unless it ends with a marker, in which case any
+// output in front of the marker is passed along on a line of its own and the marker handled.
+func (r *stepReporter) line(line string) {
+	i := strings.Index(line, r.marker)
+	if i < 0 {
+		_, _ = io.WriteString(r.out, line)
+		return
+	}
+
+	if i > 0 {
+		_, _ = io.WriteString(r.out, line[:i]+"\n")
+	}
+
+	fields := strings.Fields(line[i+len(r.marker):])
+	if len(fields) < 2 {
+		return
+	}
+
+	step, err := strconv.Atoi(fields[1])
+	if err != nil || step < 1 || step > len(r.results) {
+		return
+	}
+
+	result := &r.results[step-1]
+
+	switch fields[0] {
+	case "begin":
+		r.current = step - 1
+		result.ran = true
+		result.started = time.Now()
+
+		fmt.Fprintf(r.out, "==> [%d/%d] %s\n", step, len(r.results), result.command)
+	case "end":
+		if len(fields) < 3 {
+			return
+		}
+
+		result.code, _ = strconv.Atoi(fields[2])
+		result.duration = time.Since(result.started)
+		r.current = -1
+	}
+}
+
+// Done passes along any partial line still being held, then writes the summary. A command
+// that never reached its end marker, because it exited the shell or the connection was lost,
+// is given the exit code of the binary.
+func (r *stepReporter) Done(code int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if len(r.buf) > 0 {
+		r.line(string(r.buf) + "\n")
+		r.buf = nil
+	}
+
+	if r.current >= 0 {
+		r.results[r.current].code = code
+		r.results[r.current].duration = time.Since(r.results[r.current].started)
+		r.current = -1
+	}
+
+	var summary bytes.Buffer
+
+	table := tabwriter.NewWriter(&summary, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(table, "#\tEXIT CODE\tDURATION\t  COMMAND")
+
+	for i, result := range r.results {
+		if !result.ran {
+			fmt.Fprintf(table, "%d\t-\tnot run\t  %s\n", i+1, result.command)
+			continue
+		}
+
+		fmt.Fprintf(table, "%d\t%d\t%s\t  %s\n", i+1, result.code, result.duration.Round(time.Millisecond), result.command)
+	}
+
+	_ = table.Flush()
+
+	_, _ = r.out.Write(summary.Bytes())
+}
@@ -0,0 +1,66 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package ssh
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestStepReporter(t *testing.T) {
+	marker := newStepMarker()
+
+	tests := map[string]struct {
+		writes     []string
+		code       int
+		wantOutput string
+	}{
+		"passes output along with a header before each command": {
+			writes: []string{
+				marker + "begin 1\nfirst\n" + marker + "end 1 0\n",
+				marker + "begin 2\nsecond\n" + marker + "end 2 0\n",
+			},
+			wantOutput: "==> [1/2] echo first\nfirst\n==> [2/2] if true; then ...\nsecond\n",
+		},
+		"handles markers split across writes and output without a trailing newline": {
+			writes: []string{
+				marker[:5], marker[5:] + "begin 1\nno newline" + marker, "end 1 0\n",
+				marker + "begin 2\n", "partial",
+			},
+			code:       3,
+			wantOutput: "==> [1/2] echo first\nno newline\n==> [2/2] if true; then ...\npartial\n",
+		},
+		"leaves markers from another run alone": {
+			writes: []string{
+				marker + "begin 1\n::vela-ssh-0000000000000000::end 1 0\n" + marker + "end 1 0\n",
+			},
+			wantOutput: "==> [1/2] echo first\n::vela-ssh-0000000000000000::end 1 0\n",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var output bytes.Buffer
+
+			reporter := newStepReporter(marker, []string{"echo first", "if true; then\n  echo second\nfi"}, &output)
+
+			for _, write := range test.writes {
+				if _, err := reporter.Write([]byte(write)); err != nil {
+					t.Errorf("Write() should not have raised error %q", err)
+				}
+			}
+
+			reporter.Done(test.code)
+
+			got, summary, _ := strings.Cut(output.String(), "  #  EXIT CODE")
+			if got != test.wantOutput {
+				t.Errorf("stepReporter mismatch\ngot:    %q\nwanted: %q", got, test.wantOutput)
+			}
+
+			if !strings.Contains(summary, "echo first") || !strings.Contains(summary, "if true; then ...") {
+				t.Errorf("Done() should have written the summary\ngot:    %s", summary)
+			}
+		})
+	}
+}
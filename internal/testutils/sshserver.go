@@ -0,0 +1,432 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package testutils
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strconv"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+// MockSSHUser is the only user the in process SSH server lets in.
+const MockSSHUser = "vela"
+
+// ExecHandler handles a command executed on the in process SSH server
+// and returns the exit status to send back to the client.
+type ExecHandler func(command string, stdin io.Reader, stdout, stderr io.Writer) int
+
+// ShellHandler runs commands with the local shell, feeding them the stdin of the session,
+// so the server behaves like a real remote system would for scripts and exit codes.
+func ShellHandler(command string, stdin io.Reader, stdout, stderr io.Writer) int {
+	cmd := exec.Command("sh", "-c", command) // #nosec G204
+	cmd.Stdin = stdin
+	cmd.Stdout = stdout
+	cmd.Stderr = stderr
+
+	var exitErr *exec.ExitError
+	if err := cmd.Run(); errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	} else if err != nil {
+		fmt.Fprintln(stderr, err)
+		return 255
+	}
+
+	return 0
+}
+
+// SSHServer is an SSH server running in process so the native
+// backends can be tested without needing a real remote system.
+type SSHServer struct {
+	// Destination is where to connect to the server in the ssh:// form.
+	Destination string
+
+	// Host and Port are where the server is listening.
+	Host string
+	Port int
+
+	// HostKey is the public key the server presents to clients.
+	HostKey ssh.PublicKey
+
+	// Handler is called for every command executed on the server,
+	// by default it writes the command back to stdout and exits 0.
+	Handler ExecHandler
+
+	// SFTPRoot is the home directory of the sftp subsystem,
+	// which is only available when this is set.
+	SFTPRoot string
+
+	// CertificateAuthority lets in any user certificate it has signed for the MockSSHUser.
+	CertificateAuthority ssh.PublicKey
+
+	mu             sync.Mutex
+	authorizedKeys []ssh.PublicKey
+	commands       []string
+	forwards       []string
+	listener       net.Listener
+	config         *ssh.ServerConfig
+}
+
+// NewSSHServer starts an in process SSH server that accepts the MockSSHPassword or
+// any of the authorized keys for the MockSSHUser. It's shut down when the test ends.
+func NewSSHServer(t *testing.T, authorizedKeys ...ssh.PublicKey) *SSHServer {
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate host key: %s", err)
+	}
+
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	if err != nil {
+		t.Fatalf("couldn't create host signer: %s", err)
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("couldn't listen for ssh server: %s", err)
+	}
+
+	address := listener.Addr().(*net.TCPAddr)
+
+	server := &SSHServer{
+		Destination:    fmt.Sprintf("ssh://%s@%s", MockSSHUser, address),
+		Host:           address.IP.String(),
+		Port:           address.Port,
+		HostKey:        hostSigner.PublicKey(),
+		authorizedKeys: authorizedKeys,
+		listener:       listener,
+		Handler: func(command string, _ io.Reader, stdout, _ io.Writer) int {
+			fmt.Fprintln(stdout, command)
+			return 0
+		},
+	}
+
+	server.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == MockSSHUser && string(password) == MockSSHPassword {
+				return nil, nil
+			}
+
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == MockSSHUser && server.isAuthorized(key) {
+				return nil, nil
+			}
+
+			if _, ok := key.(*ssh.Certificate); ok && server.CertificateAuthority != nil {
+				checker := &ssh.CertChecker{
+					IsUserAuthority: func(authority ssh.PublicKey) bool {
+						return bytes.Equal(authority.Marshal(), server.CertificateAuthority.Marshal())
+					},
+				}
+
+				return checker.Authenticate(conn, key)
+			}
+
+			return nil, fmt.Errorf("public key rejected for %s", conn.User())
+		},
+	}
+	server.config.AddHostKey(hostSigner)
+
+	go server.serve()
+
+	t.Cleanup(func() {
+		listener.Close()
+	})
+
+	return server
+}
+
+// Commands returns every command that has been executed on the server so far.
+func (s *SSHServer) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.commands...)
+}
+
+// Forwards returns every address the server has been used as a jump host to connect to so far.
+func (s *SSHServer) Forwards() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]string{}, s.forwards...)
+}
+
+// isAuthorized checks if the key is one of the authorized keys.
+func (s *SSHServer) isAuthorized(key ssh.PublicKey) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, authorized := range s.authorizedKeys {
+		if bytes.Equal(authorized.Marshal(), key.Marshal()) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// serve accepts connections until the listener is closed.
+func (s *SSHServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+
+		go s.handleConn(conn)
+	}
+}
+
+// handleConn performs the handshake and serves the sessions of a single connection.
+func (s *SSHServer) handleConn(conn net.Conn) {
+	defer conn.Close()
+
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() == "direct-tcpip" {
+			go s.handleForward(newChannel)
+			continue
+		}
+
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "only sessions and forwarding are supported")
+			continue
+		}
+
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			continue
+		}
+
+		go s.handleSession(channel, channelRequests)
+	}
+}
+
+// handleForward connects a direct-tcpip channel to the address the client asked for,
+// which is how clients connect through the server when using it as a jump host.
+func (s *SSHServer) handleForward(newChannel ssh.NewChannel) {
+	var payload struct {
+		Host       string
+		Port       uint32
+		OriginHost string
+		OriginPort uint32
+	}
+
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, "bad forwarding request")
+		return
+	}
+
+	conn, err := net.Dial("tcp", net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	if err != nil {
+		_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+	defer conn.Close()
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		return
+	}
+	defer channel.Close()
+
+	go ssh.DiscardRequests(requests)
+
+	s.mu.Lock()
+	s.forwards = append(s.forwards, net.JoinHostPort(payload.Host, strconv.Itoa(int(payload.Port))))
+	s.mu.Unlock()
+
+	go func() {
+		_, _ = io.Copy(conn, channel)
+		_ = conn.(*net.TCPConn).CloseWrite()
+	}()
+
+	_, _ = io.Copy(channel, conn)
+}
+
+// handleSession serves the requests of a single session until a command is executed.
+func (s *SSHServer) handleSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var payload struct{ Command string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil {
+				_ = request.Reply(false, nil)
+				continue
+			}
+
+			_ = request.Reply(true, nil)
+
+			s.mu.Lock()
+			s.commands = append(s.commands, payload.Command)
+			s.mu.Unlock()
+
+			status := s.Handler(payload.Command, channel, channel, channel.Stderr())
+
+			exitStatus := make([]byte, 4)
+			binary.BigEndian.PutUint32(exitStatus, uint32(status)) // #nosec G115
+
+			_, _ = channel.SendRequest("exit-status", false, exitStatus)
+
+			return
+		case "subsystem":
+			var payload struct{ Name string }
+			if err := ssh.Unmarshal(request.Payload, &payload); err != nil || payload.Name != "sftp" || s.SFTPRoot == "" {
+				_ = request.Reply(false, nil)
+				continue
+			}
+
+			_ = request.Reply(true, nil)
+
+			server, err := sftp.NewServer(channel, sftp.WithServerWorkingDirectory(s.SFTPRoot))
+			if err != nil {
+				return
+			}
+
+			_ = server.Serve()
+
+			return
+		default:
+			_ = request.Reply(request.WantReply, nil)
+		}
+	}
+}
+
+// UnreachableAddress returns an address that never answers attempts to connect to it, just like
+// a non-routable one would. It's a listener whose backlog is already full, so that the kernel
+// drops any more attempts to connect rather than refusing them. It's closed when the test ends.
+func UnreachableAddress(t *testing.T) string {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_STREAM, 0)
+	if err != nil {
+		t.Fatalf("couldn't create socket: %s", err)
+	}
+	t.Cleanup(func() { syscall.Close(fd) })
+
+	if err := syscall.Bind(fd, &syscall.SockaddrInet4{Addr: [4]byte{127, 0, 0, 1}}); err != nil {
+		t.Fatalf("couldn't bind socket: %s", err)
+	}
+
+	if err := syscall.Listen(fd, 0); err != nil {
+		t.Fatalf("couldn't listen: %s", err)
+	}
+
+	sockaddr, err := syscall.Getsockname(fd)
+	if err != nil {
+		t.Fatalf("couldn't get address of socket: %s", err)
+	}
+
+	address := net.JoinHostPort("127.0.0.1", strconv.Itoa(sockaddr.(*syscall.SockaddrInet4).Port))
+
+	// This is never accepted, filling up the backlog.
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		t.Fatalf("couldn't fill up the backlog: %s", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	return address
+}
+
+// GenerateIdentity creates a new ed25519 identity file in the OpenSSH format, encrypted
+// with the passphrase if one is given, and returns its contents and public key.
+func GenerateIdentity(t *testing.T, passphrase string) (string, ssh.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %s", err)
+	}
+
+	var block *pem.Block
+	if passphrase == "" {
+		block, err = ssh.MarshalPrivateKey(privateKey, "vela-test")
+	} else {
+		block, err = ssh.MarshalPrivateKeyWithPassphrase(privateKey, "vela-test", []byte(passphrase))
+	}
+
+	if err != nil {
+		t.Fatalf("couldn't marshal identity: %s", err)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("couldn't create public key: %s", err)
+	}
+
+	return string(pem.EncodeToMemory(block)), sshPublicKey
+}
+
+// GeneratePKCS8Identity creates a new ed25519 identity file in the PKCS#8 format, like the ones
+// generated by OpenSSL and Java tooling, and returns its contents and public key.
+func GeneratePKCS8Identity(t *testing.T) (string, ssh.PublicKey) {
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate identity: %s", err)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(privateKey)
+	if err != nil {
+		t.Fatalf("couldn't marshal identity: %s", err)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		t.Fatalf("couldn't create public key: %s", err)
+	}
+
+	return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), sshPublicKey
+}
+
+// GenerateCertificate signs a user certificate for the public key that's valid for the
+// MockSSHUser until the given time, returning its contents along with the public key
+// of the certificate authority that signed it.
+func GenerateCertificate(t *testing.T, publicKey ssh.PublicKey, validBefore time.Time) (string, ssh.PublicKey) {
+	_, authorityKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate certificate authority: %s", err)
+	}
+
+	authority, err := ssh.NewSignerFromKey(authorityKey)
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority signer: %s", err)
+	}
+
+	certificate := &ssh.Certificate{
+		Key:             publicKey,
+		Serial:          42,
+		CertType:        ssh.UserCert,
+		KeyId:           "vela-test",
+		ValidPrincipals: []string{MockSSHUser},
+		ValidAfter:      uint64(time.Now().Add(-time.Hour).Unix()), // #nosec G115
+		ValidBefore:     uint64(validBefore.Unix()),                // #nosec G115
+	}
+
+	if err := certificate.SignCert(rand.Reader, authority); err != nil {
+		t.Fatalf("couldn't sign certificate: %s", err)
+	}
+
+	return string(ssh.MarshalAuthorizedKey(certificate)), authority.PublicKey()
+}
@@ -0,0 +1,133 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package testutils
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// The constants here are what the in process Vault server accepts.
+const (
+	MockVaultMount    = "ssh-client-signer"
+	MockVaultRole     = "deploy"
+	MockVaultToken    = "hvs.mock-vault-token" // #nosec G101
+	MockVaultRoleID   = "mock-role-id"
+	MockVaultSecretID = "mock-secret-id" // #nosec G101
+)
+
+// VaultServer is a stand-in for the SSH secrets engine of HashiCorp Vault, mounted at
+// MockVaultMount, which signs user certificates for the MockVaultRole that are valid for
+// an hour. It accepts the MockVaultToken or logging in with the mock AppRole credentials.
+type VaultServer struct {
+	// Address is the URL of the server.
+	Address string
+
+	// CertificateAuthority is the public key certificates are signed with.
+	CertificateAuthority ssh.PublicKey
+
+	authority ssh.Signer
+}
+
+// NewVaultServer starts an in process Vault server. It's shut down when the test ends.
+func NewVaultServer(t *testing.T) *VaultServer {
+	_, authorityKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatalf("couldn't generate certificate authority: %s", err)
+	}
+
+	authority, err := ssh.NewSignerFromKey(authorityKey)
+	if err != nil {
+		t.Fatalf("couldn't create certificate authority signer: %s", err)
+	}
+
+	vault := &VaultServer{
+		CertificateAuthority: authority.PublicKey(),
+		authority:            authority,
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(vault.handle))
+	vault.Address = server.URL
+
+	t.Cleanup(server.Close)
+
+	return vault
+}
+
+// handle serves the AppRole login and SSH signing endpoints of the Vault HTTP API.
+func (v *VaultServer) handle(w http.ResponseWriter, r *http.Request) {
+	request := map[string]string{}
+	if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&request) != nil {
+		vaultError(w, http.StatusBadRequest, "invalid request")
+		return
+	}
+
+	switch r.URL.Path {
+	case "/v1/auth/approle/login":
+		if request["role_id"] != MockVaultRoleID || request["secret_id"] != MockVaultSecretID {
+			vaultError(w, http.StatusBadRequest, "invalid role or secret ID")
+			return
+		}
+
+		vaultRespond(w, map[string]any{"auth": map[string]string{"client_token": MockVaultToken}})
+	case "/v1/" + MockVaultMount + "/sign/" + MockVaultRole:
+		if r.Header.Get("X-Vault-Token") != MockVaultToken {
+			vaultError(w, http.StatusForbidden, "permission denied")
+			return
+		}
+
+		publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(request["public_key"]))
+		if err != nil {
+			vaultError(w, http.StatusBadRequest, "failed to parse public_key as SSH key")
+			return
+		}
+
+		principals := []string{MockSSHUser}
+		if request["valid_principals"] != "" {
+			principals = strings.Split(request["valid_principals"], ",")
+		}
+
+		certificate := &ssh.Certificate{
+			Key:             publicKey,
+			Serial:          uint64(time.Now().UnixNano()), // #nosec G115
+			CertType:        ssh.UserCert,
+			KeyId:           "vault-" + MockVaultRole,
+			ValidPrincipals: principals,
+			ValidAfter:      uint64(time.Now().Add(-time.Minute).Unix()), // #nosec G115
+			ValidBefore:     uint64(time.Now().Add(time.Hour).Unix()),    // #nosec G115
+		}
+
+		if err := certificate.SignCert(rand.Reader, v.authority); err != nil {
+			vaultError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+
+		vaultRespond(w, map[string]any{"data": map[string]string{
+			"serial_number": "mock",
+			"signed_key":    string(ssh.MarshalAuthorizedKey(certificate)),
+		}})
+	default:
+		vaultError(w, http.StatusNotFound, "no handler for route "+r.URL.Path)
+	}
+}
+
+// vaultRespond writes a successful response the way Vault does.
+func vaultRespond(w http.ResponseWriter, response any) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(response)
+}
+
+// vaultError writes an error response the way Vault does.
+func vaultError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string][]string{"errors": {message}})
+}
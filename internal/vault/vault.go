@@ -0,0 +1,196 @@
+// SPDX-License-Identifier: Apache-2.0
+
+// Package vault has an ephemeral identity signed by the SSH secrets engine of HashiCorp Vault
+// so the plugins can authenticate with a short-lived certificate rather than a long-lived key.
+// It talks to the Vault HTTP API directly rather than pulling in the whole Vault client.
+package vault
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+)
+
+// DefaultTimeout bounds how long each request to Vault can take.
+const DefaultTimeout = 30 * time.Second
+
+// ErrVault is returned when Vault can't be logged in to or won't sign the identity.
+var ErrVault = errors.New("vault request failed")
+
+// Sign generates an ephemeral ed25519 identity in memory and has Vault sign its public key,
+// logging in with AppRole first if there isn't a token. It returns the identity in the OpenSSH
+// format along with the signed certificate, neither of which is ever stored by Vault.
+func Sign(ctx context.Context, config openssh.VaultConfig) (string, string, error) {
+	client, err := newClient(config)
+	if err != nil {
+		return "", "", err
+	}
+
+	publicKey, privateKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't generate identity: %w", err)
+	}
+
+	sshPublicKey, err := ssh.NewPublicKey(publicKey)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't generate identity: %w", err)
+	}
+
+	block, err := ssh.MarshalPrivateKey(privateKey, "vela-"+config.Role)
+	if err != nil {
+		return "", "", fmt.Errorf("couldn't generate identity: %w", err)
+	}
+
+	token := config.Token
+	if token == "" {
+		token, err = client.login(ctx, config.RoleID, config.SecretID)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	request := map[string]string{
+		"public_key": string(ssh.MarshalAuthorizedKey(sshPublicKey)),
+		"cert_type":  "user",
+	}
+
+	if len(config.ValidPrincipals) > 0 {
+		request["valid_principals"] = strings.Join(config.ValidPrincipals, ",")
+	}
+
+	if config.TTL != "" {
+		request["ttl"] = config.TTL
+	}
+
+	response := struct {
+		Data struct {
+			SignedKey string `json:"signed_key"`
+		} `json:"data"`
+	}{}
+
+	path := fmt.Sprintf("%s/sign/%s", config.Mount, url.PathEscape(config.Role))
+	if err := client.post(ctx, path, token, request, &response); err != nil {
+		return "", "", err
+	}
+
+	if response.Data.SignedKey == "" {
+		return "", "", fmt.Errorf("%w: %s didn't return a signed key", ErrVault, path)
+	}
+
+	return string(pem.EncodeToMemory(block)), response.Data.SignedKey, nil
+}
+
+// client makes requests to the Vault HTTP API.
+type client struct {
+	http      *http.Client
+	address   string
+	namespace string
+}
+
+// newClient creates a client for the Vault server, trusting the certificate authority if there is one.
+func newClient(config openssh.VaultConfig) (*client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.CACert != "" {
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM([]byte(config.CACert)) {
+			return nil, fmt.Errorf("%w: ca_cert doesn't hold any PEM encoded certificates", openssh.ErrInvalidVault)
+		}
+
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool, MinVersion: tls.VersionTLS12}
+	}
+
+	return &client{
+		http:      &http.Client{Transport: transport, Timeout: DefaultTimeout},
+		address:   config.Address,
+		namespace: config.Namespace,
+	}, nil
+}
+
+// login logs in with AppRole and returns the resulting token.
+func (c *client) login(ctx context.Context, roleID, secretID string) (string, error) {
+	response := struct {
+		Auth struct {
+			ClientToken string `json:"client_token"`
+		} `json:"auth"`
+	}{}
+
+	request := map[string]string{"role_id": roleID, "secret_id": secretID}
+	if err := c.post(ctx, "auth/approle/login", "", request, &response); err != nil {
+		return "", err
+	}
+
+	if response.Auth.ClientToken == "" {
+		return "", fmt.Errorf("%w: AppRole login didn't return a token", ErrVault)
+	}
+
+	return response.Auth.ClientToken, nil
+}
+
+// post sends the request to the path of the Vault HTTP API and decodes the response,
+// turning any errors Vault sends back into an error.
+func (c *client) post(ctx context.Context, path, token string, request, response any) error {
+	body, err := json.Marshal(request)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVault, err)
+	}
+
+	endpoint := fmt.Sprintf("%s/v1/%s", c.address, path)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVault, err)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if token != "" {
+		req.Header.Set("X-Vault-Token", token)
+	}
+
+	if c.namespace != "" {
+		req.Header.Set("X-Vault-Namespace", c.namespace)
+	}
+
+	res, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVault, err)
+	}
+	defer res.Body.Close()
+
+	contents, err := io.ReadAll(io.LimitReader(res.Body, 1024*1024))
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrVault, err)
+	}
+
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		failure := struct {
+			Errors []string `json:"errors"`
+		}{}
+		_ = json.Unmarshal(contents, &failure)
+
+		return fmt.Errorf("%w: %s returned %s: %s", ErrVault, path, res.Status, strings.Join(failure.Errors, ", "))
+	}
+
+	if err := json.Unmarshal(contents, response); err != nil {
+		return fmt.Errorf("%w: couldn't decode response from %s: %w", ErrVault, path, err)
+	}
+
+	return nil
+}
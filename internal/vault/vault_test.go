@@ -0,0 +1,155 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package vault
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/ssh"
+
+	"github.com/go-vela/vela-openssh/internal/openssh"
+	"github.com/go-vela/vela-openssh/internal/testutils"
+)
+
+func TestSign(t *testing.T) {
+	server := testutils.NewVaultServer(t)
+
+	tests := map[string]struct {
+		config         openssh.VaultConfig
+		wantPrincipals []string
+	}{
+		"signs with token": {
+			config: openssh.VaultConfig{
+				Token: testutils.MockVaultToken,
+			},
+			wantPrincipals: []string{testutils.MockSSHUser},
+		},
+		"signs after logging in with AppRole": {
+			config: openssh.VaultConfig{
+				RoleID:   testutils.MockVaultRoleID,
+				SecretID: testutils.MockVaultSecretID,
+			},
+			wantPrincipals: []string{testutils.MockSSHUser},
+		},
+		"requests valid principals": {
+			config: openssh.VaultConfig{
+				Token:           testutils.MockVaultToken,
+				ValidPrincipals: []string{"deploy", "admin"},
+			},
+			wantPrincipals: []string{"deploy", "admin"},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			test.config.Address = server.Address
+			test.config.Mount = testutils.MockVaultMount
+			test.config.Role = testutils.MockVaultRole
+
+			identity, contents, err := Sign(context.Background(), test.config)
+			if err != nil {
+				t.Errorf("Sign() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			signer, err := ssh.ParsePrivateKey([]byte(identity))
+			if err != nil {
+				t.Errorf("Sign() should have returned an identity file: %s", err)
+				t.FailNow()
+			}
+
+			publicKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(contents))
+			if err != nil {
+				t.Errorf("Sign() should have returned a certificate: %s", err)
+				t.FailNow()
+			}
+
+			certificate, ok := publicKey.(*ssh.Certificate)
+			if !ok {
+				t.Errorf("Sign() should have returned a certificate rather than a %s public key", publicKey.Type())
+				t.FailNow()
+			}
+
+			if !bytes.Equal(certificate.Key.Marshal(), signer.PublicKey().Marshal()) {
+				t.Errorf("Sign() should have returned a certificate for the identity")
+			}
+
+			if !bytes.Equal(certificate.SignatureKey.Marshal(), server.CertificateAuthority.Marshal()) {
+				t.Errorf("Sign() should have returned a certificate signed by vault")
+			}
+
+			if strings.Join(certificate.ValidPrincipals, ",") != strings.Join(test.wantPrincipals, ",") {
+				t.Errorf("Sign() principals mismatch\ngot:    %v\nwanted: %v", certificate.ValidPrincipals, test.wantPrincipals)
+			}
+		})
+	}
+}
+
+func TestSignErrors(t *testing.T) {
+	server := testutils.NewVaultServer(t)
+
+	tests := map[string]struct {
+		config      openssh.VaultConfig
+		wantErr     error
+		wantMessage string
+	}{
+		"with wrong token": {
+			config: openssh.VaultConfig{
+				Address: server.Address,
+				Mount:   testutils.MockVaultMount,
+				Role:    testutils.MockVaultRole,
+				Token:   "hvs.some-other-token",
+			},
+			wantErr:     ErrVault,
+			wantMessage: "permission denied",
+		},
+		"with wrong AppRole secret ID": {
+			config: openssh.VaultConfig{
+				Address:  server.Address,
+				Mount:    testutils.MockVaultMount,
+				Role:     testutils.MockVaultRole,
+				RoleID:   testutils.MockVaultRoleID,
+				SecretID: "some-other-secret-id",
+			},
+			wantErr:     ErrVault,
+			wantMessage: "invalid role or secret ID",
+		},
+		"with unknown role": {
+			config: openssh.VaultConfig{
+				Address: server.Address,
+				Mount:   testutils.MockVaultMount,
+				Role:    "some-other-role",
+				Token:   testutils.MockVaultToken,
+			},
+			wantErr:     ErrVault,
+			wantMessage: "404",
+		},
+		"with invalid ca cert": {
+			config: openssh.VaultConfig{
+				Address: server.Address,
+				Role:    testutils.MockVaultRole,
+				Token:   testutils.MockVaultToken,
+				CACert:  "not a certificate",
+			},
+			wantErr: openssh.ErrInvalidVault,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			_, _, err := Sign(context.Background(), test.config)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("Sign() returned wrong error\ngot:    %s\nwanted: %s", err, test.wantErr)
+				t.FailNow()
+			}
+
+			if !strings.Contains(err.Error(), test.wantMessage) {
+				t.Errorf("Sign() error mismatch\ngot:    %s\nwanted: %s", err, test.wantMessage)
+			}
+		})
+	}
+}
@@ -11,9 +11,13 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"os/exec"
+	"os/signal"
+	"sync"
 	"syscall"
+	"time"
 
 	"github.com/sirupsen/logrus"
 )
@@ -34,6 +38,10 @@ var (
 
 	// ErrExec is returned for any generic execution based error.
 	ErrExec = errors.New("execution error")
+
+	// ErrTargets is returned when a plugin fanning out to several targets
+	// fails on more of them than its MaxFailures threshold allows.
+	ErrTargets = errors.New("failed on too many targets")
 )
 
 // PluginConfig holds the key methods required for a binarywrapper.Plugin to
@@ -46,7 +54,9 @@ type PluginConfig interface {
 
 	// Setup is responsible to create all required files are in
 	// place before any executable or shell actions are created.
-	Setup() error
+	// Anything it does over the network should give up once the
+	// context is done, which also covers the Timeout of the plugin.
+	Setup(ctx context.Context) error
 
 	// Binary should return the absolute path to the binary that should take
 	// over when this plugin has been validated for execution. This should
@@ -63,6 +73,50 @@ type PluginConfig interface {
 	Environment() map[string]string
 }
 
+// Cleaner can optionally be implemented by a PluginConfig that leaves anything behind
+// during Setup, like temporary files holding secrets, which shouldn't outlive the plugin.
+type Cleaner interface {
+
+	// Cleanup is responsible for removing anything created by Setup. It's called
+	// once the binary has finished when using any of the subprocess execution styles,
+	// or when Setup or Exec fails. It should be safe to call more than once.
+	Cleanup() error
+}
+
+// Inputter can optionally be implemented by a PluginConfig that has something to feed
+// the binary, like a script for it to pass along to a remote interpreter.
+type Inputter interface {
+
+	// Input returns what's written to the standard input of the binary. It's only used by the
+	// subprocess execution styles, a nil reader leaves the binary without any input at all.
+	Input() io.Reader
+}
+
+// Watcher can optionally be implemented by a PluginConfig that follows along with the output
+// of the binary as it arrives, like to report on the progress it makes. It's used by all of
+// the execution styles other than SyscallExec.
+type Watcher interface {
+
+	// Watch returns the writers that the output of the binary is written through
+	// on its way to the given stdout and stderr, which log it.
+	Watch(stdout, stderr io.Writer) (io.Writer, io.Writer)
+
+	// Done is called with the exit code once the binary has finished, or -1 if it never
+	// started or was killed, so anything still being held back can be written out.
+	Done(code int)
+}
+
+// Expander can optionally be implemented by a PluginConfig that needs some say in how its
+// arguments are expanded with environmental variables, like when some of them are meant to
+// be left for a remote system to expand. It's used by all of the execution styles other
+// than InProcess, which has no arguments.
+type Expander interface {
+
+	// Expand returns the argument expanded with environmental variables, which are
+	// already set to include those from Environment by the time it's called.
+	Expand(arg string) string
+}
+
 // ExecStyle defines the types of execution paradims exists for the plugin.
 type ExecStyle int
 
@@ -75,8 +129,25 @@ const (
 
 	// OSExecCommand sets the execution style such that when the binary is called it is
 	// done using a subprocess command. The output of the command is captured when finished
-	// and not streamed, so if you desire streaming based output you should use SyscallExec for now.
+	// and not streamed, so if you desire streaming based output you should use OSExecStream.
 	OSExecCommand
+
+	// OSExecStream sets the execution style such that the binary is called as a subprocess
+	// just like OSExecCommand, but each line of output is logged as soon as it arrives
+	// rather than once the binary has finished. Stdout lines are logged at the info level
+	// and stderr lines at the error level, in the order they were received.
+	OSExecStream
+
+	// Supervised sets the execution style such that the binary is streamed as a subprocess
+	// just like OSExecStream while the plugin stays around to look after it. Interrupt,
+	// termination and hangup signals are caught and passed along to the binary's process
+	// group, and a PluginConfig implementing Cleaner is always cleaned up afterwards.
+	Supervised
+
+	// InProcess sets the execution style such that no binary is executed at all, instead the
+	// PluginConfig must implement Runner and does the work itself. It's otherwise looked after
+	// the same as Supervised, with output streamed, signals caught and cleanup guaranteed.
+	InProcess
 )
 
 // Plugin holds the configuration required for a binarywrapper.Plugin to operate.
@@ -85,25 +156,107 @@ const (
 type Plugin struct {
 	ExecStyle
 	PluginConfig
+
+	// TailLines is how many of the last lines of output the OSExecStream style
+	// holds onto so they can be included in the returned error if the binary fails.
+	// Zero, the default, keeps nothing beyond what has already been logged.
+	TailLines int
+
+	// Timeout bounds how long Setup and the binary are allowed to run when executed as
+	// a subprocess. Zero, the default, lets them run for as long as the context allows.
+	Timeout time.Duration
+
+	// KillGracePeriod is how long the binary is given to exit after being sent
+	// SIGTERM before its process group is killed. Defaults to DefaultKillGracePeriod.
+	KillGracePeriod time.Duration
+
+	// Parallelism bounds how many targets are executed at once when the PluginConfig
+	// implements Fanner. Zero, the default, executes all of them at once.
+	Parallelism int
+
+	// MaxFailures is how many targets are allowed to fail when the PluginConfig implements
+	// Fanner before the plugin fails. The zero value, the default, allows none of them to.
+	MaxFailures Threshold
+
+	// FailFast stops executing targets as soon as more of them have failed than MaxFailures
+	// allows, terminating the ones still running and skipping the rest. By default every
+	// target is executed regardless of how many others have failed.
+	FailFast bool
+
+	// Canary executes the first of the targets on its own before any of the others when the
+	// PluginConfig implements Fanner, stopping the rollout there if it fails.
+	Canary bool
+
+	// BatchSize rolls the targets out in batches of this many, either as a count or as a
+	// percentage of them all, with each batch finishing before the next starts. The rollout
+	// stops once more of the targets have failed than MaxFailures allows. The zero value,
+	// the default, executes all of them as a single batch.
+	BatchSize Threshold
+
+	// BatchPause is how long to wait between the batches of a rollout.
+	BatchPause time.Duration
+
+	// target is the name of the target this plugin is executing for when fanning out,
+	// which the output of its binary is prefixed with.
+	target string
 }
 
 // Exec will call the plugin Validate, Setup and Exec methods
-// This uses syscall.Exec to take over the processing.
+// By default this uses syscall.Exec to take over the processing.
 // What this means is whatever binary is defined in the plugin will
 // take over execution and if there are no errors this is the end of the
 // relevant go code and handling required for the plugin. Think of this
 // like the binary taking the place of the go code if the binary is found.
-func (p *Plugin) Exec() error {
+// For the subprocess execution styles the binary is terminated if the
+// context is done or the Timeout elapses before it finishes.
+// A PluginConfig implementing Fanner has its binary executed for each of its
+// targets instead, with the Timeout covering all of them together.
+func (p *Plugin) Exec(ctx context.Context) error {
 	if p == nil {
 		return ErrExec
 	}
 
+	// Secrets are registered before anything else has a chance to log them
+	// and once more after Setup in case it came across anything new.
+	p.redact()
+
 	if err := p.Validate(); err != nil {
-		return ErrValidation
+		return fmt.Errorf("%w: %w", ErrValidation, err)
 	}
 
-	if err := p.Setup(); err != nil {
-		return ErrSetup
+	// Setup might have created some things before failing, so cleaning up
+	// is deferred regardless. With SyscallExec this only ever runs when the
+	// binary couldn't take over since nothing is left to run it otherwise.
+	defer p.cleanup()
+
+	ctx, cancel := p.context(ctx)
+	defer cancel()
+
+	if err := p.Setup(ctx); err != nil {
+		return fmt.Errorf("%w: %w", ErrSetup, p.timeoutError(err))
+	}
+
+	p.redact()
+
+	if targets := p.targets(); len(targets) > 0 {
+		return p.timeoutError(p.execTargets(ctx, targets))
+	}
+
+	return p.timeoutError(p.execute(ctx))
+}
+
+// execute runs the binary for the plugin configuration in the ExecStyle,
+// or the plugin configuration itself when it's executed InProcess.
+func (p *Plugin) execute(ctx context.Context) error {
+	// Runners do all of the work themselves, so there's
+	// no binary or arguments to prepare for them.
+	if p.ExecStyle == InProcess {
+		runner, ok := p.PluginConfig.(Runner)
+		if !ok {
+			return fmt.Errorf("%w: InProcess requires the plugin to implement Runner", ErrUnknownExecStyle)
+		}
+
+		return p.execRunner(ctx, runner)
 	}
 
 	// Log some good debugging information here. There is a purposeful choice
@@ -111,10 +264,16 @@ func (p *Plugin) Exec() error {
 	// as those might contain secrets or other information we don't want to leak.
 	pluginArguments := p.Arguments()
 
-	logrus.WithFields(logrus.Fields{
+	fields := logrus.Fields{
 		"binary":    p.Binary(),
 		"arguments": p.Arguments(),
-	}).Info()
+	}
+
+	if p.target != "" {
+		fields["target"] = p.target
+	}
+
+	logrus.WithFields(fields).Info()
 
 	// The subprocess call later expects that the first argument is always the binary
 	// that is being called, so if the arguments don't contain the binary as the first
@@ -137,56 +296,217 @@ func (p *Plugin) Exec() error {
 	// all unexpanded arguments above.
 	var expandedArgs []string
 	for _, arg := range pluginArguments {
-		expandedArgs = append(expandedArgs, os.ExpandEnv(arg))
+		expandedArgs = append(expandedArgs, p.expand(arg))
 	}
 
 	// Having the option of execution styles allows users of this wrapper
 	// to specify if they want the takeover style of syscall.Exec or the
 	// subprocess behavior of exec.Command since they have their own nuances.
-	if p.ExecStyle == OSExecCommand {
-		var outBuffer, errorBuffer bytes.Buffer
+	switch p.ExecStyle {
+	case OSExecCommand:
+		return p.execCommand(ctx, expandedArgs)
+	case OSExecStream, Supervised:
+		return p.execStream(ctx, expandedArgs)
+	case SyscallExec:
+		if p.Timeout > 0 {
+			logrus.Warnf("timeout of %s can't be enforced with the SyscallExec style", p.Timeout)
+		}
 
-		// #nosec G204
-		cmd := exec.CommandContext(context.Background(), p.Binary(), expandedArgs...)
-		cmd.Env = os.Environ()
-		cmd.Stdout = &outBuffer
-		cmd.Stderr = &errorBuffer
+		if _, ok := p.PluginConfig.(Cleaner); ok {
+			logrus.Debug("files created during setup can't be cleaned up with the SyscallExec style")
+		}
 
-		if err := cmd.Run(); err != nil {
-			if outBuffer.Len() > 0 {
-				logrus.Info(outBuffer.String())
-			}
+		if p.input() != nil {
+			logrus.Warn("input can't be given to the binary with the SyscallExec style")
+		}
 
-			if errorBuffer.Len() > 0 {
-				logrus.Error(errorBuffer.String())
-			}
+		return p.execSyscall(expandedArgs)
+	default:
+		return fmt.Errorf("%w: %d", ErrUnknownExecStyle, p.ExecStyle)
+	}
+}
 
-			return fmt.Errorf("%w: %w", ErrExec, err)
-		}
+// context returns the context the plugin should run with, which is done when the Timeout
+// elapses or, for the supervised styles, when the plugin receives a termination signal.
+func (p *Plugin) context(ctx context.Context) (context.Context, context.CancelFunc) {
+	stop := context.CancelFunc(func() {})
 
-		if outBuffer.Len() > 0 {
-			logrus.Info(outBuffer.String())
-		}
+	if p.ExecStyle == Supervised || p.ExecStyle == InProcess {
+		ctx, stop = signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM, syscall.SIGHUP)
+	}
 
-		if errorBuffer.Len() > 0 {
-			logrus.Error(errorBuffer.String())
-		}
-	} else if p.ExecStyle == SyscallExec {
-		// This portion of the code will replace the running go code with
-		// whatever the binary by the specified plugin happens to be, but only
-		// if the binary is found, otherwise it'll raise a file not found error.
-		// If this does exist, and no other execve errors occur, we'll never reach
-		// the return (or any code) past this function call (even in tests).
-		// #nosec G204
-		if err := syscall.Exec(p.Binary(), expandedArgs, os.Environ()); err != nil {
-			if errors.Is(err, os.ErrNotExist) {
-				return fmt.Errorf("%w: %s", ErrMissingBinary, p.Binary())
-			}
-
-			return fmt.Errorf("%w: %w", ErrExec, err)
+	if p.Timeout <= 0 {
+		return ctx, stop
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, p.Timeout)
+
+	return ctx, func() {
+		cancel()
+		stop()
+	}
+}
+
+// timeoutError adds the timeout to the error when it was the reason for failing.
+func (p *Plugin) timeoutError(err error) error {
+	if errors.Is(err, context.DeadlineExceeded) && p.Timeout > 0 {
+		return fmt.Errorf("%w (timed out after %s)", err, p.Timeout)
+	}
+
+	return err
+}
+
+// redact registers the secrets from the plugin configuration
+// with the logger if it implements Redactor.
+func (p *Plugin) redact() {
+	if redactor, ok := p.PluginConfig.(Redactor); ok {
+		AddRedactions(redactor.Redactions()...)
+	}
+}
+
+// input returns the input for the binary if the plugin configuration implements Inputter.
+func (p *Plugin) input() io.Reader {
+	if inputter, ok := p.PluginConfig.(Inputter); ok {
+		return inputter.Input()
+	}
+
+	return nil
+}
+
+// expand returns the argument expanded with environmental variables, which is
+// left to the plugin configuration if it implements Expander.
+func (p *Plugin) expand(arg string) string {
+	if expander, ok := p.PluginConfig.(Expander); ok {
+		return expander.Expand(arg)
+	}
+
+	return os.ExpandEnv(arg)
+}
+
+// watch returns the writers for the output of the binary, which go through
+// the plugin configuration first if it implements Watcher.
+func (p *Plugin) watch(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	if watcher, ok := p.PluginConfig.(Watcher); ok {
+		return watcher.Watch(stdout, stderr)
+	}
+
+	return stdout, stderr
+}
+
+// done lets the plugin configuration know the binary has finished if it implements Watcher.
+func (p *Plugin) done(code int) {
+	if watcher, ok := p.PluginConfig.(Watcher); ok {
+		watcher.Done(code)
+	}
+}
+
+// cleanup calls Cleanup on the plugin configuration if it implements Cleaner.
+// Failing to clean up is only logged so it doesn't mask how the binary did.
+func (p *Plugin) cleanup() {
+	cleaner, ok := p.PluginConfig.(Cleaner)
+	if !ok {
+		return
+	}
+
+	if err := cleaner.Cleanup(); err != nil {
+		logrus.Warnf("plugin failed cleanup: %s", err)
+	}
+}
+
+// execCommand runs the binary as a subprocess and logs
+// all of the captured output once it has finished.
+func (p *Plugin) execCommand(ctx context.Context, args []string) error {
+	var outBuffer, errorBuffer bytes.Buffer
+
+	// The arguments start with the binary itself, which exec.Command adds on its own.
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, p.Binary(), args[1:]...)
+	cmd.Env = os.Environ()
+	stop := setKillPolicy(cmd, p.KillGracePeriod)
+	cmd.Stdin = p.input()
+	cmd.Stdout, cmd.Stderr = p.watch(&outBuffer, &errorBuffer)
+
+	start := time.Now()
+	err := contextError(ctx, cmd.Run())
+
+	stop()
+
+	p.done(cmd.ProcessState.ExitCode())
+
+	if outBuffer.Len() > 0 {
+		logrus.Info(p.prefixLines(outBuffer.String()))
+	}
+
+	if errorBuffer.Len() > 0 {
+		logrus.Error(p.prefixLines(errorBuffer.String()))
+	}
+
+	if err != nil {
+		return newExecError(cmd, err, time.Since(start), nil)
+	}
+
+	return nil
+}
+
+// execStream runs the binary as a subprocess and logs each line of
+// output as it arrives, optionally keeping the last few lines around
+// so they can be reported back if the binary fails.
+func (p *Plugin) execStream(ctx context.Context, args []string) error {
+	var mu sync.Mutex
+
+	tail := newTailBuffer(p.TailLines)
+	stdout := &lineLogger{mu: &mu, level: logrus.InfoLevel, tail: tail, prefix: p.prefix()}
+	stderr := &lineLogger{mu: &mu, level: logrus.ErrorLevel, tail: tail, prefix: p.prefix()}
+
+	// The arguments start with the binary itself, which exec.Command adds on its own.
+	// #nosec G204
+	cmd := exec.CommandContext(ctx, p.Binary(), args[1:]...)
+	cmd.Env = os.Environ()
+	cmd.Stdin = p.input()
+	cmd.Stdout, cmd.Stderr = p.watch(stdout, stderr)
+	stop := setKillPolicy(cmd, p.KillGracePeriod)
+
+	start := time.Now()
+	err := contextError(ctx, cmd.Run())
+
+	stop()
+
+	p.done(cmd.ProcessState.ExitCode())
+
+	stdout.Flush()
+	stderr.Flush()
+
+	if err != nil {
+		return newExecError(cmd, err, time.Since(start), tail.Lines())
+	}
+
+	return nil
+}
+
+// contextError makes sure that a binary which failed because it was terminated
+// for the context being done reports that as the reason rather than just the signal.
+func contextError(ctx context.Context, err error) error {
+	if err != nil && ctx.Err() != nil {
+		return fmt.Errorf("%w: %w", ctx.Err(), err)
+	}
+
+	return err
+}
+
+// execSyscall replaces the running go code with the binary.
+func (p *Plugin) execSyscall(args []string) error {
+	// This portion of the code will replace the running go code with
+	// whatever the binary by the specified plugin happens to be, but only
+	// if the binary is found, otherwise it'll raise a file not found error.
+	// If this does exist, and no other execve errors occur, we'll never reach
+	// the return (or any code) past this function call (even in tests).
+	// #nosec G204
+	if err := syscall.Exec(p.Binary(), args, os.Environ()); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("%w: %s", ErrMissingBinary, p.Binary())
 		}
-	} else {
-		return fmt.Errorf("%w: %d", ErrUnknownExecStyle, p.ExecStyle)
+
+		return fmt.Errorf("%w: %w", ErrExec, err)
 	}
 
 	return nil
@@ -8,11 +8,18 @@ package binarywrapper_test
 
 import (
 	"bytes"
+	"context"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"os"
+	"os/signal"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/sirupsen/logrus"
 
@@ -23,6 +30,10 @@ const (
 	testMainEnvVar        = "env-var"
 	testMainSuccessOutput = "success-output"
 	testMainFailOutput    = "fail-output"
+	testMainMultiline     = "multiline-output"
+	testMainHang          = "hang"
+	testMainIgnoreTerm    = "ignore-term"
+	testMainEchoInput     = "echo-input"
 )
 
 // TestMain is used so that we can mock calls to binaries that need
@@ -38,23 +49,42 @@ func TestMain(m *testing.M) {
 
 		os.Exit(0)
 	case testMainSuccessOutput:
-		if len(os.Args) != 4 {
+		if len(os.Args) != 3 {
 			fmt.Printf("invalid os.Args: %s", strings.Join(os.Args, " "))
 			os.Exit(2)
 		}
 
-		fmt.Println(os.Args[2])
-		fmt.Fprint(os.Stderr, os.Args[3])
+		fmt.Println(os.Args[1])
+		fmt.Fprint(os.Stderr, os.Args[2])
 		os.Exit(0)
 	case testMainFailOutput:
-		if len(os.Args) != 4 {
+		if len(os.Args) != 3 {
 			fmt.Printf("invalid os.Args: %s", strings.Join(os.Args, " "))
 			os.Exit(3)
 		}
 
-		fmt.Println(os.Args[2])
-		fmt.Fprint(os.Stderr, os.Args[3])
+		fmt.Println(os.Args[1])
+		fmt.Fprint(os.Stderr, os.Args[2])
 		os.Exit(4)
+	case testMainMultiline:
+		fmt.Println("first line")
+		fmt.Println("second line")
+		fmt.Println("third line")
+		fmt.Print("fourth line")
+		os.Exit(5)
+	case testMainHang:
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	case testMainIgnoreTerm:
+		signal.Ignore(syscall.SIGTERM)
+		time.Sleep(time.Minute)
+		os.Exit(0)
+	case testMainEchoInput:
+		if _, err := io.Copy(os.Stdout, os.Stdin); err != nil {
+			os.Exit(6)
+		}
+
+		os.Exit(0)
 	}
 }
 
@@ -64,6 +94,8 @@ type mockExecConfig struct {
 	binaryPath      string
 	arguments       []string
 	environment     map[string]string
+	cleanupCalls    int
+	redactions      []string
 }
 
 func (m *mockExecConfig) Validate() error {
@@ -74,7 +106,7 @@ func (m *mockExecConfig) Validate() error {
 	return nil
 }
 
-func (m *mockExecConfig) Setup() error {
+func (m *mockExecConfig) Setup(_ context.Context) error {
 	if m.setupError != "" {
 		return errors.New(m.setupError)
 	}
@@ -82,6 +114,16 @@ func (m *mockExecConfig) Setup() error {
 	return nil
 }
 
+func (m *mockExecConfig) Cleanup() error {
+	m.cleanupCalls++
+
+	return nil
+}
+
+func (m *mockExecConfig) Redactions() []string {
+	return m.redactions
+}
+
 func (m *mockExecConfig) Binary() string {
 	return m.binaryPath
 }
@@ -134,6 +176,20 @@ func TestExecSuccess(t *testing.T) {
 			wantStdOut: "stdout",
 			wantStdErr: "stderr",
 		},
+		"OSExecStream logs stdout and stderr of successful run": {
+			execStyle: binarywrapper.OSExecStream,
+			config: &mockExecConfig{
+				binaryPath: os.Args[0],
+				arguments:  []string{"$VAR1", "$VAR2"},
+				environment: map[string]string{
+					"GO_MAIN_TEST_CASE": testMainSuccessOutput,
+					"VAR1":              "stdout",
+					"VAR2":              "stderr",
+				},
+			},
+			wantStdOut: "level=info msg=stdout",
+			wantStdErr: "level=error msg=stderr",
+		},
 	}
 
 	for name, test := range tests {
@@ -156,7 +212,7 @@ func TestExecSuccess(t *testing.T) {
 			var outputBuffer bytes.Buffer
 			logrus.SetOutput(&outputBuffer)
 
-			if err := p.Exec(); err != nil {
+			if err := p.Exec(context.Background()); err != nil {
 				t.Errorf("Exec() should not have raised error %q", err)
 				t.FailNow()
 			}
@@ -173,12 +229,704 @@ func TestExecSuccess(t *testing.T) {
 	}
 }
 
-func TestExecError(t *testing.T) {
+func TestExecStreamTail(t *testing.T) {
+	p := binarywrapper.Plugin{
+		ExecStyle: binarywrapper.OSExecStream,
+		TailLines: 2,
+		PluginConfig: &mockExecConfig{
+			binaryPath: os.Args[0],
+			environment: map[string]string{
+				"GO_MAIN_TEST_CASE": testMainMultiline,
+			},
+		},
+	}
+
+	var outputBuffer bytes.Buffer
+	logrus.SetOutput(&outputBuffer)
+
+	err := p.Exec(context.Background())
+	if err == nil {
+		t.Errorf("Exec() should have raised an error")
+		t.FailNow()
+	}
+
+	if strings.Contains(err.Error(), "second line") || !strings.Contains(err.Error(), "third line\nfourth line") {
+		t.Errorf("Exec() error should only contain the last two lines\ngot:    %s", err)
+	}
+}
+
+type mockInputConfig struct {
+	mockExecConfig
+	input string
+}
+
+func (m *mockInputConfig) Input() io.Reader {
+	return strings.NewReader(m.input)
+}
+
+func TestExecInput(t *testing.T) {
+	for _, style := range []binarywrapper.ExecStyle{binarywrapper.OSExecCommand, binarywrapper.OSExecStream, binarywrapper.Supervised} {
+		t.Run(fmt.Sprintf("style %d", style), func(t *testing.T) {
+			p := binarywrapper.Plugin{
+				ExecStyle: style,
+				PluginConfig: &mockInputConfig{
+					mockExecConfig: mockExecConfig{
+						binaryPath: os.Args[0],
+						environment: map[string]string{
+							"GO_MAIN_TEST_CASE": testMainEchoInput,
+						},
+					},
+					input: "if true; then\n  echo first line\nfi\n",
+				},
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			if err := p.Exec(context.Background()); err != nil {
+				t.Errorf("Exec() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			if !strings.Contains(outputBuffer.String(), "echo first line") {
+				t.Errorf("Exec() should have given the input to the binary\ngot:    %s", outputBuffer.String())
+			}
+		})
+	}
+}
+
+type mockWatchConfig struct {
+	mockRunnerConfig
+	doneCode int
+}
+
+func (m *mockWatchConfig) Watch(stdout, stderr io.Writer) (io.Writer, io.Writer) {
+	return &prefixWriter{prefix: "watched ", out: stdout}, stderr
+}
+
+func (m *mockWatchConfig) Done(code int) {
+	m.doneCode = code
+}
+
+type prefixWriter struct {
+	prefix string
+	out    io.Writer
+}
+
+func (w *prefixWriter) Write(p []byte) (int, error) {
+	if _, err := io.WriteString(w.out, w.prefix+string(p)); err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+type mockExpandConfig struct {
+	mockExecConfig
+}
+
+func (m *mockExpandConfig) Expand(arg string) string {
+	return strings.ReplaceAll(arg, "$", "remote-")
+}
+
+func TestExecExpand(t *testing.T) {
+	p := binarywrapper.Plugin{
+		ExecStyle: binarywrapper.OSExecStream,
+		PluginConfig: &mockExpandConfig{
+			mockExecConfig: mockExecConfig{
+				binaryPath: os.Args[0],
+				arguments:  []string{"$VAR1", "$VAR2"},
+				environment: map[string]string{
+					"GO_MAIN_TEST_CASE": testMainSuccessOutput,
+					"VAR1":              "local-stdout",
+				},
+			},
+		},
+	}
+
+	var outputBuffer bytes.Buffer
+	logrus.SetOutput(&outputBuffer)
+
+	if err := p.Exec(context.Background()); err != nil {
+		t.Errorf("Exec() should not have raised error %q", err)
+		t.FailNow()
+	}
+
+	for _, want := range []string{"msg=remote-VAR1", "msg=remote-VAR2"} {
+		if !strings.Contains(outputBuffer.String(), want) {
+			t.Errorf("Exec() should have expanded the arguments with Expand()\ngot:    %s\nwanted: %s", outputBuffer.String(), want)
+		}
+	}
+}
+
+func TestExecWatch(t *testing.T) {
+	tests := map[string]struct {
+		style    binarywrapper.ExecStyle
+		env      string
+		wantCode int
+	}{
+		"binary": {
+			style:    binarywrapper.Supervised,
+			env:      testMainMultiline,
+			wantCode: 5,
+		},
+		"binary with captured output": {
+			style:    binarywrapper.OSExecCommand,
+			env:      testMainMultiline,
+			wantCode: 5,
+		},
+		"in process": {
+			style:    binarywrapper.InProcess,
+			wantCode: 7,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := &mockWatchConfig{
+				mockRunnerConfig: mockRunnerConfig{
+					mockExecConfig: mockExecConfig{
+						binaryPath: os.Args[0],
+						environment: map[string]string{
+							"GO_MAIN_TEST_CASE": test.env,
+						},
+					},
+					run: func(_ context.Context, stdout, _ io.Writer) error {
+						fmt.Fprintln(stdout, "first line")
+						return mockExitStatusError(7)
+					},
+				},
+			}
+
+			p := binarywrapper.Plugin{
+				ExecStyle:    test.style,
+				PluginConfig: config,
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			_ = p.Exec(context.Background())
+
+			if !strings.Contains(outputBuffer.String(), "watched first line") {
+				t.Errorf("Exec() should have written the output through the watcher\ngot:    %s", outputBuffer.String())
+			}
+
+			if config.doneCode != test.wantCode {
+				t.Errorf("Exec() gave the watcher the wrong exit code\ngot:    %d\nwanted: %d", config.doneCode, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestExecTimeout(t *testing.T) {
+	tests := map[string]struct {
+		execStyle binarywrapper.ExecStyle
+		testCase  string
+	}{
+		"OSExecCommand terminates binary after timeout": {
+			execStyle: binarywrapper.OSExecCommand,
+			testCase:  testMainHang,
+		},
+		"OSExecStream terminates binary after timeout": {
+			execStyle: binarywrapper.OSExecStream,
+			testCase:  testMainHang,
+		},
+		"kills binary that ignores termination after grace period": {
+			execStyle: binarywrapper.OSExecStream,
+			testCase:  testMainIgnoreTerm,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := binarywrapper.Plugin{
+				ExecStyle:       test.execStyle,
+				Timeout:         200 * time.Millisecond,
+				KillGracePeriod: 200 * time.Millisecond,
+				PluginConfig: &mockExecConfig{
+					binaryPath: os.Args[0],
+					environment: map[string]string{
+						"GO_MAIN_TEST_CASE": test.testCase,
+					},
+				},
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			start := time.Now()
+
+			err := p.Exec(context.Background())
+			if err == nil {
+				t.Errorf("Exec() should have raised an error")
+				t.FailNow()
+			}
+
+			if !errors.Is(err, binarywrapper.ErrExec) || !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Exec() returned wrong error\ngot:    %s\nwanted: %s", err, context.DeadlineExceeded)
+			}
+
+			if elapsed := time.Since(start); elapsed > 10*time.Second {
+				t.Errorf("Exec() took too long to terminate the binary: %s", elapsed)
+			}
+		})
+	}
+}
+
+func TestExecContextCanceled(t *testing.T) {
+	p := binarywrapper.Plugin{
+		ExecStyle:       binarywrapper.OSExecStream,
+		KillGracePeriod: 200 * time.Millisecond,
+		PluginConfig: &mockExecConfig{
+			binaryPath: os.Args[0],
+			environment: map[string]string{
+				"GO_MAIN_TEST_CASE": testMainHang,
+			},
+		},
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+
+	if err := p.Exec(ctx); !errors.Is(err, context.Canceled) {
+		t.Errorf("Exec() returned wrong error\ngot:    %s\nwanted: %s", err, context.Canceled)
+	}
+}
+
+func TestExecCleanup(t *testing.T) {
+	tests := map[string]struct {
+		execStyle binarywrapper.ExecStyle
+		config    *mockExecConfig
+	}{
+		"cleans up after successful run": {
+			execStyle: binarywrapper.Supervised,
+			config: &mockExecConfig{
+				binaryPath:  os.Args[0],
+				environment: map[string]string{"GO_MAIN_TEST_CASE": testMainEnvVar},
+			},
+		},
+		"cleans up after failed run": {
+			execStyle: binarywrapper.OSExecStream,
+			config: &mockExecConfig{
+				binaryPath:  os.Args[0],
+				environment: map[string]string{"GO_MAIN_TEST_CASE": testMainMultiline},
+			},
+		},
+		"cleans up after failed setup": {
+			execStyle: binarywrapper.Supervised,
+			config: &mockExecConfig{
+				setupError: "setup has failed",
+			},
+		},
+		"cleans up when SyscallExec can't find binary": {
+			execStyle: binarywrapper.SyscallExec,
+			config: &mockExecConfig{
+				binaryPath: "this-should-not-exist",
+			},
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := binarywrapper.Plugin{
+				ExecStyle:    test.execStyle,
+				PluginConfig: test.config,
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			_ = p.Exec(context.Background())
+
+			if test.config.cleanupCalls != 1 {
+				t.Errorf("Exec() should have called Cleanup() once, called %d times", test.config.cleanupCalls)
+			}
+		})
+	}
+}
+
+func TestExecSupervisedSignal(t *testing.T) {
+	config := &mockExecConfig{
+		binaryPath:  os.Args[0],
+		environment: map[string]string{"GO_MAIN_TEST_CASE": testMainHang},
+	}
+
+	p := binarywrapper.Plugin{
+		ExecStyle:       binarywrapper.Supervised,
+		KillGracePeriod: 200 * time.Millisecond,
+		PluginConfig:    config,
+	}
+
+	var outputBuffer bytes.Buffer
+	logrus.SetOutput(&outputBuffer)
+
+	// The supervised style catches the signal so this is delivered
+	// to the binary instead of terminating the test itself.
+	time.AfterFunc(300*time.Millisecond, func() {
+		_ = syscall.Kill(os.Getpid(), syscall.SIGTERM)
+	})
+
+	if err := p.Exec(context.Background()); !errors.Is(err, context.Canceled) {
+		t.Errorf("Exec() returned wrong error\ngot:    %s\nwanted: %s", err, context.Canceled)
+	}
+
+	if config.cleanupCalls != 1 {
+		t.Errorf("Exec() should have called Cleanup() once, called %d times", config.cleanupCalls)
+	}
+}
+
+func TestExecRedaction(t *testing.T) {
+	const (
+		secret          = "super-secret-token"
+		shortSecret     = "pa55"
+		multilineSecret = "first-secret-line\nsecond-secret-line"
+	)
+
+	p := binarywrapper.Plugin{
+		ExecStyle: binarywrapper.OSExecStream,
+		PluginConfig: &mockExecConfig{
+			binaryPath: os.Args[0],
+			arguments: []string{
+				"--token=" + secret,
+				"encoded " + base64.StdEncoding.EncodeToString([]byte(secret)) + " second-secret-line --password=" + shortSecret,
+			},
+			environment: map[string]string{
+				"GO_MAIN_TEST_CASE": testMainSuccessOutput,
+			},
+			redactions: []string{secret, shortSecret, multilineSecret},
+		},
+	}
+
+	var outputBuffer bytes.Buffer
+	logrus.SetOutput(&outputBuffer)
+
+	if err := p.Exec(context.Background()); err != nil {
+		t.Errorf("Exec() should not have raised error %q", err)
+		t.FailNow()
+	}
+
+	for _, leaked := range []string{
+		secret,
+		base64.StdEncoding.EncodeToString([]byte(secret)),
+		"second-secret-line",
+		shortSecret,
+	} {
+		if strings.Contains(outputBuffer.String(), leaked) {
+			t.Errorf("Exec() leaked %q into the logs\ngot:    %s", leaked, outputBuffer.String())
+		}
+	}
+
+	if !strings.Contains(outputBuffer.String(), "--token="+binarywrapper.RedactedText) {
+		t.Errorf("Exec() should have redacted the secret\ngot:    %s", outputBuffer.String())
+	}
+}
+
+func TestAddRedactions(t *testing.T) {
+	binarywrapper.AddRedactions("Host example.com\n  User deploy\n  IdentityFile /vela/secrets/key\nAAAAC3NzaC1lZDI1\n")
+
 	tests := map[string]struct {
-		plugin     *binarywrapper.Plugin
-		wantErr    error
+		message string
+		want    string
+	}{
+		"redacts lines that look random": {
+			message: "key AAAAC3NzaC1lZDI1",
+			want:    "key " + binarywrapper.RedactedText,
+		},
+		"leaves short lines alone": {
+			message: "logging in as User deploy",
+			want:    "logging in as User deploy",
+		},
+		"leaves lines with whitespace alone": {
+			message: "IdentityFile /vela/secrets/key",
+			want:    "IdentityFile /vela/secrets/key",
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			logrus.Info(test.message)
+
+			if !strings.Contains(outputBuffer.String(), fmt.Sprintf("msg=%q", test.want)) {
+				t.Errorf("AddRedactions() mismatch\ngot:    %s\nwanted: %s", outputBuffer.String(), test.want)
+			}
+		})
+	}
+}
+
+func TestExecLongOutput(t *testing.T) {
+	const secret = "super-secret-token"
+
+	p := binarywrapper.Plugin{
+		ExecStyle: binarywrapper.InProcess,
+		PluginConfig: &mockRunnerConfig{
+			mockExecConfig: mockExecConfig{redactions: []string{secret}},
+			run: func(_ context.Context, stdout, _ io.Writer) error {
+				// A single write well past the line buffer without any newlines.
+				_, err := io.WriteString(stdout, strings.Repeat("a", 64*1024)+secret+strings.Repeat("b", 1024))
+
+				return err
+			},
+		},
+	}
+
+	var outputBuffer bytes.Buffer
+	logrus.SetOutput(&outputBuffer)
+
+	if err := p.Exec(context.Background()); err != nil {
+		t.Errorf("Exec() should not have raised error %q", err)
+		t.FailNow()
+	}
+
+	chunks := 0
+	for _, line := range strings.Split(outputBuffer.String(), "\n") {
+		if strings.Contains(line, "aaaa") || strings.Contains(line, "bbbb") {
+			chunks++
+		}
+	}
+
+	if chunks != 2 {
+		t.Errorf("Exec() should have split the output into 2 lines\ngot:    %d", chunks)
+	}
+
+	if strings.Contains(outputBuffer.String(), secret) {
+		t.Errorf("Exec() leaked %q into the logs", secret)
+	}
+}
+
+func TestExecLongOutputSplitSecret(t *testing.T) {
+	const secret = "super-secret-token"
+
+	// The output is split into lines of 64KiB with the secret straddling the split.
+	prefix := strings.Repeat("a", 64*1024-len(secret)/2)
+
+	tests := map[string][]string{
+		"in a single write": {prefix + secret + strings.Repeat("b", 1024)},
+		"across two writes": {prefix + secret[:len(secret)/2], secret[len(secret)/2:] + strings.Repeat("b", 1024)},
+		"in a single line":  {prefix + secret + strings.Repeat("b", 1024) + "\n"},
+	}
+
+	for name, writes := range tests {
+		t.Run(name, func(t *testing.T) {
+			p := binarywrapper.Plugin{
+				ExecStyle: binarywrapper.InProcess,
+				PluginConfig: &mockRunnerConfig{
+					mockExecConfig: mockExecConfig{redactions: []string{secret}},
+					run: func(_ context.Context, stdout, _ io.Writer) error {
+						for _, write := range writes {
+							if _, err := io.WriteString(stdout, write); err != nil {
+								return err
+							}
+						}
+
+						return nil
+					},
+				},
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			if err := p.Exec(context.Background()); err != nil {
+				t.Errorf("Exec() should not have raised error %q", err)
+				t.FailNow()
+			}
+
+			for _, leaked := range []string{secret[:len(secret)/2], secret[len(secret)/2:]} {
+				if strings.Contains(outputBuffer.String(), leaked) {
+					t.Errorf("Exec() leaked %q of the secret into the logs", leaked)
+				}
+			}
+		})
+	}
+}
+
+func TestExecExitCode(t *testing.T) {
+	tests := map[string]struct {
+		plugin     binarywrapper.Plugin
+		wantCode   int
+		wantSignal syscall.Signal
+	}{
+		"OSExecCommand reports exit code of binary": {
+			plugin: binarywrapper.Plugin{
+				ExecStyle: binarywrapper.OSExecCommand,
+				PluginConfig: &mockExecConfig{
+					binaryPath:  os.Args[0],
+					arguments:   []string{"stdout", "stderr"},
+					environment: map[string]string{"GO_MAIN_TEST_CASE": testMainFailOutput},
+				},
+			},
+			wantCode: 4,
+		},
+		"OSExecStream reports exit code of binary": {
+			plugin: binarywrapper.Plugin{
+				ExecStyle: binarywrapper.OSExecStream,
+				PluginConfig: &mockExecConfig{
+					binaryPath:  os.Args[0],
+					environment: map[string]string{"GO_MAIN_TEST_CASE": testMainMultiline},
+				},
+			},
+			wantCode: 5,
+		},
+		"reports signal of terminated binary": {
+			plugin: binarywrapper.Plugin{
+				ExecStyle:       binarywrapper.Supervised,
+				Timeout:         200 * time.Millisecond,
+				KillGracePeriod: 200 * time.Millisecond,
+				PluginConfig: &mockExecConfig{
+					binaryPath:  os.Args[0],
+					environment: map[string]string{"GO_MAIN_TEST_CASE": testMainHang},
+				},
+			},
+			wantCode:   128 + int(syscall.SIGTERM),
+			wantSignal: syscall.SIGTERM,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			err := test.plugin.Exec(context.Background())
+
+			var execErr *binarywrapper.ExecError
+			if !errors.As(err, &execErr) {
+				t.Errorf("Exec() should have returned an ExecError, got %q", err)
+				t.FailNow()
+			}
+
+			if execErr.Signal != test.wantSignal {
+				t.Errorf("ExecError has wrong signal\ngot:    %s\nwanted: %s", execErr.Signal, test.wantSignal)
+			}
+
+			if execErr.Duration <= 0 {
+				t.Errorf("ExecError should have recorded the duration")
+			}
+
+			if code := binarywrapper.ExitCode(err); code != test.wantCode {
+				t.Errorf("ExitCode() mismatch\ngot:    %d\nwanted: %d", code, test.wantCode)
+			}
+		})
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	tests := map[string]struct {
+		err      error
+		wantCode int
+	}{
+		"no error":            {wantCode: 0},
+		"generic error":       {err: binarywrapper.ErrSetup, wantCode: 1},
+		"exec error":          {err: &binarywrapper.ExecError{Code: 255}, wantCode: 255},
+		"wrapped exec error":  {err: fmt.Errorf("wrapped: %w", &binarywrapper.ExecError{Code: 6}), wantCode: 6},
+		"signaled exec error": {err: &binarywrapper.ExecError{Code: -1, Signal: syscall.SIGKILL}, wantCode: 137},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if code := binarywrapper.ExitCode(test.err); code != test.wantCode {
+				t.Errorf("ExitCode() mismatch\ngot:    %d\nwanted: %d", code, test.wantCode)
+			}
+		})
+	}
+}
+
+type mockRunnerConfig struct {
+	mockExecConfig
+	run func(ctx context.Context, stdout, stderr io.Writer) error
+}
+
+func (m *mockRunnerConfig) Run(ctx context.Context, stdout, stderr io.Writer) error {
+	return m.run(ctx, stdout, stderr)
+}
+
+type mockExitStatusError int
+
+func (m mockExitStatusError) Error() string {
+	return fmt.Sprintf("exited with %d", int(m))
+}
+
+func (m mockExitStatusError) ExitStatus() int {
+	return int(m)
+}
+
+func TestExecInProcess(t *testing.T) {
+	tests := map[string]struct {
+		run        func(ctx context.Context, stdout, stderr io.Writer) error
+		timeout    time.Duration
+		wantCode   int
 		wantStdOut string
 		wantStdErr string
+	}{
+		"streams output of runner": {
+			run: func(_ context.Context, stdout, stderr io.Writer) error {
+				fmt.Fprintln(stdout, "stdout")
+				fmt.Fprintln(stderr, "stderr")
+
+				return nil
+			},
+			wantStdOut: "level=info msg=stdout",
+			wantStdErr: "level=error msg=stderr",
+		},
+		"reports exit status of runner": {
+			run: func(_ context.Context, _, _ io.Writer) error {
+				return mockExitStatusError(42)
+			},
+			wantCode: 42,
+		},
+		"cancels runner after timeout": {
+			run: func(ctx context.Context, _, _ io.Writer) error {
+				<-ctx.Done()
+				return ctx.Err()
+			},
+			timeout:  100 * time.Millisecond,
+			wantCode: 1,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			config := &mockRunnerConfig{run: test.run}
+			p := binarywrapper.Plugin{
+				ExecStyle:    binarywrapper.InProcess,
+				Timeout:      test.timeout,
+				PluginConfig: config,
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			err := p.Exec(context.Background())
+			if code := binarywrapper.ExitCode(err); code != test.wantCode {
+				t.Errorf("Exec() returned wrong exit code\ngot:    %d (%v)\nwanted: %d", code, err, test.wantCode)
+			}
+
+			if test.timeout > 0 && !errors.Is(err, context.DeadlineExceeded) {
+				t.Errorf("Exec() returned wrong error\ngot:    %s\nwanted: %s", err, context.DeadlineExceeded)
+			}
+
+			if !strings.Contains(outputBuffer.String(), test.wantStdOut) || !strings.Contains(outputBuffer.String(), test.wantStdErr) {
+				t.Errorf("Exec() mismatch output\ngot:    %s\nwanted: %s and %s", outputBuffer.String(), test.wantStdOut, test.wantStdErr)
+			}
+
+			if config.cleanupCalls != 1 {
+				t.Errorf("Exec() should have called Cleanup() once, called %d times", config.cleanupCalls)
+			}
+		})
+	}
+}
+
+func TestExecError(t *testing.T) {
+	tests := map[string]struct {
+		plugin      *binarywrapper.Plugin
+		wantErr     error
+		wantMessage string
+		wantStdOut  string
+		wantStdErr  string
 	}{
 		"returns error when no plugin configured": {
 			wantErr: binarywrapper.ErrExec,
@@ -192,7 +940,8 @@ func TestExecError(t *testing.T) {
 				}
 				return &p
 			}(),
-			wantErr: binarywrapper.ErrValidation,
+			wantErr:     binarywrapper.ErrValidation,
+			wantMessage: "plugin failed validation: validation has failed",
 		},
 		"returns error when Setup fails": {
 			plugin: func() *binarywrapper.Plugin {
@@ -203,7 +952,8 @@ func TestExecError(t *testing.T) {
 				}
 				return &p
 			}(),
-			wantErr: binarywrapper.ErrSetup,
+			wantErr:     binarywrapper.ErrSetup,
+			wantMessage: "plugin failed setup: setup has failed",
 		},
 		"returns error with unknown ExecStyle": {
 			plugin: func() *binarywrapper.Plugin {
@@ -215,6 +965,16 @@ func TestExecError(t *testing.T) {
 			}(),
 			wantErr: binarywrapper.ErrUnknownExecStyle,
 		},
+		"returns error when InProcess used without a Runner": {
+			plugin: func() *binarywrapper.Plugin {
+				p := binarywrapper.Plugin{
+					ExecStyle:    binarywrapper.InProcess,
+					PluginConfig: &mockExecConfig{},
+				}
+				return &p
+			}(),
+			wantErr: binarywrapper.ErrUnknownExecStyle,
+		},
 		"SyscallExec returns with error if binary missing": {
 			plugin: func() *binarywrapper.Plugin {
 				p := binarywrapper.Plugin{
@@ -255,6 +1015,23 @@ func TestExecError(t *testing.T) {
 			wantStdOut: "stdout",
 			wantStdErr: "stderr",
 		},
+		"OSExecStream logs each line of failed run": {
+			plugin: func() *binarywrapper.Plugin {
+				p := binarywrapper.Plugin{
+					ExecStyle: binarywrapper.OSExecStream,
+					PluginConfig: &mockExecConfig{
+						binaryPath: os.Args[0],
+						environment: map[string]string{
+							"GO_MAIN_TEST_CASE": testMainMultiline,
+						},
+					},
+				}
+				return &p
+			}(),
+			wantErr:    binarywrapper.ErrExec,
+			wantStdOut: `msg="first line"`,
+			wantStdErr: `msg="fourth line"`,
+		},
 	}
 
 	for name, test := range tests {
@@ -264,12 +1041,14 @@ func TestExecError(t *testing.T) {
 			var outputBuffer bytes.Buffer
 			logrus.SetOutput(&outputBuffer)
 
-			if err := test.plugin.Exec(); err == nil {
+			if err := test.plugin.Exec(context.Background()); err == nil {
 				t.Errorf("Exec() should have raised an error")
 				t.FailNow()
 			} else if test.wantErr != nil && err != nil && !errors.Is(err, test.wantErr) {
 				t.Errorf("Exec() returned wrong error\ngot:    %s\nwanted: %s", err, test.wantErr)
 				t.FailNow()
+			} else if len(test.wantMessage) > 0 && err.Error() != test.wantMessage {
+				t.Errorf("Exec() mismatch error message\ngot:    %s\nwanted: %s", err, test.wantMessage)
 			}
 
 			if len(test.wantStdOut) > 0 && !strings.Contains(outputBuffer.String(), test.wantStdOut) {
@@ -283,3 +1062,286 @@ func TestExecError(t *testing.T) {
 		})
 	}
 }
+
+type mockFanConfig struct {
+	mockExecConfig
+	targets []binarywrapper.Target
+}
+
+func (m *mockFanConfig) Targets() []binarywrapper.Target {
+	return m.targets
+}
+
+func TestExecTargets(t *testing.T) {
+	var running, mostRunning atomic.Int32
+
+	runner := func(code int) *mockRunnerConfig {
+		return &mockRunnerConfig{
+			run: func(_ context.Context, stdout, _ io.Writer) error {
+				if n := running.Add(1); n > mostRunning.Load() {
+					mostRunning.Store(n)
+				}
+				defer running.Add(-1)
+
+				time.Sleep(50 * time.Millisecond)
+				fmt.Fprintf(stdout, "exiting with %d\n", code)
+
+				if code != 0 {
+					return mockExitStatusError(code)
+				}
+
+				return nil
+			},
+		}
+	}
+
+	binary := func(out, errOut string) *mockExecConfig {
+		return &mockExecConfig{
+			binaryPath:  os.Args[0],
+			arguments:   []string{out, errOut},
+			environment: map[string]string{"GO_MAIN_TEST_CASE": testMainSuccessOutput},
+		}
+	}
+
+	tests := map[string]struct {
+		execStyle      binarywrapper.ExecStyle
+		targets        []binarywrapper.Target
+		parallelism    int
+		maxFailures    binarywrapper.Threshold
+		failFast       bool
+		canary         bool
+		batchSize      binarywrapper.Threshold
+		batchPause     time.Duration
+		wantErr        error
+		wantOutput     []string
+		wantMostAtOnce int32
+	}{
+		"binaries have their output prefixed with the target": {
+			execStyle: binarywrapper.Supervised,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: binary("out-1", "err-1")},
+				{Name: "second", PluginConfig: binary("out-2", "err-2")},
+			},
+			wantOutput: []string{
+				"level=info msg=\"[first] out-1\"",
+				"level=error msg=\"[second] err-2\"",
+				"msg=\"first   ok      0",
+				"msg=\"second  ok      0",
+			},
+		},
+		"captured output is prefixed with the target": {
+			execStyle: binarywrapper.OSExecCommand,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: binary("out-1", "err-1")},
+			},
+			wantOutput: []string{"level=info msg=\"[first] out-1\"", "level=error msg=\"[first] err-1\""},
+		},
+		"fails when any target fails by default": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(0)},
+				{Name: "second", PluginConfig: runner(3)},
+				{Name: "third", PluginConfig: runner(0)},
+			},
+			wantErr:    binarywrapper.ErrTargets,
+			wantOutput: []string{"[second] exiting with 3", "msg=\"second  failed  3"},
+		},
+		"allows failures within the threshold": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(0)},
+				{Name: "second", PluginConfig: runner(3)},
+				{Name: "third", PluginConfig: runner(0)},
+			},
+			maxFailures: binarywrapper.Threshold{Percent: 50},
+			wantOutput:  []string{"failed on 1 of 3 targets, which is within the 50% allowed: second"},
+		},
+		"fails when the failures exceed the threshold": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(1)},
+				{Name: "second", PluginConfig: runner(3)},
+				{Name: "third", PluginConfig: runner(0)},
+			},
+			maxFailures: binarywrapper.Threshold{Count: 1},
+			wantErr:     binarywrapper.ErrTargets,
+		},
+		"stops early once the failures exceed the threshold when failing fast": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(3)},
+				{Name: "second", PluginConfig: runner(0)},
+				{Name: "third", PluginConfig: runner(0)},
+			},
+			parallelism: 1,
+			failFast:    true,
+			wantErr:     binarywrapper.ErrTargets,
+			wantOutput: []string{
+				"stopping after failing on 1 of 3 targets, which is more than the 0 allowed",
+				"msg=\"second  not run  -",
+				"msg=\"third   not run  -",
+			},
+		},
+		"executes at most parallelism targets at once": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(0)},
+				{Name: "second", PluginConfig: runner(0)},
+				{Name: "third", PluginConfig: runner(0)},
+				{Name: "fourth", PluginConfig: runner(0)},
+			},
+			parallelism:    2,
+			wantOutput:     []string{"executing on 4 targets, 2 at a time"},
+			wantMostAtOnce: 2,
+		},
+		"rolls out in batches": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(0)},
+				{Name: "second", PluginConfig: runner(0)},
+				{Name: "third", PluginConfig: runner(0)},
+				{Name: "fourth", PluginConfig: runner(0)},
+				{Name: "fifth", PluginConfig: runner(0)},
+			},
+			batchSize:  binarywrapper.Threshold{Percent: 40},
+			batchPause: time.Millisecond,
+			wantOutput: []string{
+				"rolling out to 5 targets in 3 batches",
+				"pausing for 1ms before the next batch",
+				"starting batch 3 of 3",
+				"msg=\"fifth   ok      0",
+			},
+			wantMostAtOnce: 2,
+		},
+		"stops the rollout when the canary fails": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(3)},
+				{Name: "second", PluginConfig: runner(0)},
+				{Name: "third", PluginConfig: runner(0)},
+			},
+			canary:      true,
+			maxFailures: binarywrapper.Threshold{Count: 1},
+			wantErr:     binarywrapper.ErrTargets,
+			wantOutput: []string{
+				"rolling out to 3 targets in 2 batches",
+				"stopping the rollout since the canary first failed",
+				"msg=\"second  not run  -",
+				"msg=\"third   not run  -",
+			},
+		},
+		"stops the rollout once the failures exceed the threshold": {
+			execStyle: binarywrapper.InProcess,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: runner(0)},
+				{Name: "second", PluginConfig: runner(3)},
+				{Name: "third", PluginConfig: runner(3)},
+				{Name: "fourth", PluginConfig: runner(0)},
+			},
+			canary:      true,
+			batchSize:   binarywrapper.Threshold{Count: 2},
+			maxFailures: binarywrapper.Threshold{Count: 1},
+			wantErr:     binarywrapper.ErrTargets,
+			wantOutput: []string{
+				"stopping the rollout after failing on 2 of 4 targets, which is more than the 1 allowed",
+				"msg=\"first   ok       0",
+				"msg=\"fourth  not run  -",
+			},
+		},
+		"SyscallExec can't fan out": {
+			execStyle: binarywrapper.SyscallExec,
+			targets: []binarywrapper.Target{
+				{Name: "first", PluginConfig: binary("out-1", "err-1")},
+			},
+			wantErr: binarywrapper.ErrUnknownExecStyle,
+		},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			mostRunning.Store(0)
+
+			config := &mockFanConfig{targets: test.targets}
+			p := binarywrapper.Plugin{
+				ExecStyle:    test.execStyle,
+				Parallelism:  test.parallelism,
+				MaxFailures:  test.maxFailures,
+				FailFast:     test.failFast,
+				Canary:       test.canary,
+				BatchSize:    test.batchSize,
+				BatchPause:   test.batchPause,
+				PluginConfig: config,
+			}
+
+			var outputBuffer bytes.Buffer
+			logrus.SetOutput(&outputBuffer)
+
+			if err := p.Exec(context.Background()); !errors.Is(err, test.wantErr) {
+				t.Errorf("Exec() returned wrong error\ngot:    %v\nwanted: %v", err, test.wantErr)
+			}
+
+			for _, want := range test.wantOutput {
+				if !strings.Contains(outputBuffer.String(), want) {
+					t.Errorf("Exec() mismatch output\ngot:    %s\nwanted: %s", outputBuffer.String(), want)
+				}
+			}
+
+			if test.wantMostAtOnce > 0 && mostRunning.Load() != test.wantMostAtOnce {
+				t.Errorf("Exec() executed the wrong number of targets at once\ngot:    %d\nwanted: %d", mostRunning.Load(), test.wantMostAtOnce)
+			}
+
+			if config.cleanupCalls != 1 {
+				t.Errorf("Exec() should have called Cleanup() once, called %d times", config.cleanupCalls)
+			}
+		})
+	}
+}
+
+func TestParseThreshold(t *testing.T) {
+	tests := map[string]struct {
+		threshold     string
+		wantThreshold binarywrapper.Threshold
+		wantErr       error
+	}{
+		"empty":               {},
+		"count":               {threshold: "2", wantThreshold: binarywrapper.Threshold{Count: 2}},
+		"percentage":          {threshold: " 10% ", wantThreshold: binarywrapper.Threshold{Percent: 10}},
+		"negative":            {threshold: "-1", wantErr: binarywrapper.ErrThreshold},
+		"over 100 percent":    {threshold: "101%", wantErr: binarywrapper.ErrThreshold},
+		"not a number at all": {threshold: "some", wantErr: binarywrapper.ErrThreshold},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			threshold, err := binarywrapper.ParseThreshold(test.threshold)
+			if !errors.Is(err, test.wantErr) {
+				t.Errorf("ParseThreshold() returned wrong error\ngot:    %v\nwanted: %v", err, test.wantErr)
+			}
+
+			if threshold != test.wantThreshold {
+				t.Errorf("ParseThreshold() mismatch\ngot:    %+v\nwanted: %+v", threshold, test.wantThreshold)
+			}
+		})
+	}
+}
+
+func TestThresholdOf(t *testing.T) {
+	tests := map[string]struct {
+		threshold binarywrapper.Threshold
+		total     int
+		want      int
+	}{
+		"zero":                 {total: 10},
+		"count":                {threshold: binarywrapper.Threshold{Count: 3}, total: 10, want: 3},
+		"percentage":           {threshold: binarywrapper.Threshold{Percent: 25}, total: 8, want: 2},
+		"percentage rounds up": {threshold: binarywrapper.Threshold{Percent: 10}, total: 3, want: 1},
+	}
+
+	for name, test := range tests {
+		t.Run(name, func(t *testing.T) {
+			if got := test.threshold.Of(test.total); got != test.want {
+				t.Errorf("Of() mismatch\ngot:    %d\nwanted: %d", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,107 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package binarywrapper
+
+import (
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// ExecError is returned when a binary was started as a subprocess but didn't finish
+// successfully. It carries enough detail about how the binary ended that callers can
+// exit with the very same code, so anything depending on that code keeps working.
+type ExecError struct {
+	// Binary is the path of the binary that was executed.
+	Binary string
+
+	// Code is the exit code of the binary, or -1 if it was killed by a signal.
+	Code int
+
+	// Signal is the signal that killed the binary, if any.
+	Signal syscall.Signal
+
+	// Duration is how long the binary ran for.
+	Duration time.Duration
+
+	// Tail holds the last lines of output if the plugin was set to keep them.
+	Tail []string
+
+	// Err is the underlying error from running the binary.
+	Err error
+}
+
+// newExecError creates an ExecError out of the error from running the
+// command if the binary was actually started, otherwise a generic one.
+func newExecError(cmd *exec.Cmd, err error, duration time.Duration, tail []string) error {
+	if cmd.ProcessState == nil {
+		return fmt.Errorf("%w: %w", ErrExec, err)
+	}
+
+	execErr := &ExecError{
+		Binary:   cmd.Path,
+		Code:     cmd.ProcessState.ExitCode(),
+		Duration: duration,
+		Tail:     tail,
+		Err:      err,
+	}
+
+	if status, ok := cmd.ProcessState.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		execErr.Signal = status.Signal()
+	}
+
+	return execErr
+}
+
+// Error returns the underlying error along with the tail of the output if any was kept.
+func (e *ExecError) Error() string {
+	msg := fmt.Sprintf("%s: %s", ErrExec, e.Err)
+
+	if len(e.Tail) > 0 {
+		msg = fmt.Sprintf("%s\n%s", msg, strings.Join(e.Tail, "\n"))
+	}
+
+	return msg
+}
+
+// Unwrap returns the underlying error from running the binary.
+func (e *ExecError) Unwrap() error {
+	return e.Err
+}
+
+// Is allows errors.Is to treat an ExecError as an ErrExec.
+func (e *ExecError) Is(target error) bool {
+	return target == ErrExec
+}
+
+// ExitCode returns the code a process wrapping the binary should exit with to mirror it.
+// Binaries killed by a signal follow the shell convention of 128 plus the signal number.
+func (e *ExecError) ExitCode() int {
+	switch {
+	case e.Signal != 0:
+		return 128 + int(e.Signal)
+	case e.Code > 0:
+		return e.Code
+	default:
+		return 1
+	}
+}
+
+// ExitCode returns the code a plugin should exit with for the given error.
+// That's the binary's own exit code for an ExecError, 1 for any other error
+// and 0 when there's no error at all.
+func ExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+
+	var execErr *ExecError
+	if errors.As(err, &execErr) {
+		return execErr.ExitCode()
+	}
+
+	return 1
+}
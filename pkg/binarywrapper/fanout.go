@@ -0,0 +1,375 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package binarywrapper
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// ErrThreshold is returned when a threshold can't be parsed.
+var ErrThreshold = errors.New("threshold must be a count like 2 or a percentage like 10%")
+
+// Fanner can optionally be implemented by a PluginConfig that executes its binary against
+// several targets rather than just the one, like running the same command on many hosts.
+// It's used by all of the execution styles other than SyscallExec, once Setup is done.
+type Fanner interface {
+
+	// Targets returns everything the binary should be executed for. Returning
+	// no targets at all executes the plugin configuration itself as usual.
+	Targets() []Target
+}
+
+// Target is one of the places a plugin fanning out executes its binary.
+type Target struct {
+	// Name identifies the target, both in front of each line of its
+	// output and in the summary of how each target went.
+	Name string
+
+	// PluginConfig is executed for the target like the plugin configuration would be,
+	// using any of the optional interfaces it implements. It's never validated, set up
+	// or cleaned up itself, which is left to the plugin configuration it came from.
+	PluginConfig
+}
+
+// Threshold is how many of the targets are allowed to fail, either as
+// a count or as a percentage of them all. The zero value allows none to.
+type Threshold struct {
+	// Count is how many targets are allowed to fail.
+	Count int
+
+	// Percent is the percentage of targets allowed to fail, which takes precedence over Count.
+	Percent int
+}
+
+// ParseThreshold parses a count like "2" or a percentage like "10%" into a Threshold.
+// An empty string is the zero Threshold, allowing none of the targets to fail.
+func ParseThreshold(s string) (Threshold, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return Threshold{}, nil
+	}
+
+	number, percent := strings.CutSuffix(s, "%")
+
+	n, err := strconv.Atoi(strings.TrimSpace(number))
+	if err != nil || n < 0 || (percent && n > 100) {
+		return Threshold{}, fmt.Errorf("%w: %q", ErrThreshold, s)
+	}
+
+	if percent {
+		return Threshold{Percent: n}, nil
+	}
+
+	return Threshold{Count: n}, nil
+}
+
+// Exceeded reports whether failing on that many of the total targets is more than allowed.
+func (t Threshold) Exceeded(failed, total int) bool {
+	if t.Percent > 0 {
+		return failed*100 > t.Percent*total
+	}
+
+	return failed > t.Count
+}
+
+// Of returns how many of the total targets the threshold amounts to, rounding percentages
+// up so that any percentage above zero amounts to at least one of them.
+func (t Threshold) Of(total int) int {
+	if t.Percent > 0 {
+		return (t.Percent*total + 99) / 100
+	}
+
+	return t.Count
+}
+
+// String returns the threshold the same way it's parsed.
+func (t Threshold) String() string {
+	if t.Percent > 0 {
+		return fmt.Sprintf("%d%%", t.Percent)
+	}
+
+	return strconv.Itoa(t.Count)
+}
+
+// targetResult is how executing one of the targets went.
+type targetResult struct {
+	name     string
+	ran      bool
+	code     int
+	duration time.Duration
+}
+
+// targets returns the targets of the plugin configuration if it implements Fanner.
+func (p *Plugin) targets() []Target {
+	if fanner, ok := p.PluginConfig.(Fanner); ok {
+		return fanner.Targets()
+	}
+
+	return nil
+}
+
+// rollout tracks how executing the targets is going across all of its batches.
+type rollout struct {
+	mu      sync.Mutex
+	targets []Target
+	results []targetResult
+	failed  int
+	stop    context.CancelFunc
+}
+
+// execTargets executes each of the targets, rolling them out in batches when there's a Canary
+// or a BatchSize, then logs a summary of how each one went. Targets failing only fail the plugin
+// once there are more of them than MaxFailures allows, at which point the rollout stops before
+// the next batch. Targets that never got to run, because the rollout stopped, the context was
+// done or FailFast stopped them, count as failures too.
+func (p *Plugin) execTargets(parent context.Context, targets []Target) error {
+	if p.ExecStyle == SyscallExec {
+		return fmt.Errorf("%w: SyscallExec can't execute more than one target", ErrUnknownExecStyle)
+	}
+
+	ctx, stop := context.WithCancel(parent)
+	defer stop()
+
+	r := &rollout{
+		targets: targets,
+		results: make([]targetResult, len(targets)),
+		stop:    stop,
+	}
+
+	for i, target := range targets {
+		r.results[i] = targetResult{name: target.Name}
+	}
+
+	batches := p.batches(len(targets))
+
+	for i, batch := range batches {
+		if i > 0 {
+			if !p.continueRollout(ctx, r) {
+				break
+			}
+
+			logrus.Infof("starting batch %d of %d", i+1, len(batches))
+		}
+
+		p.execBatch(ctx, r, batch[0], batch[1])
+	}
+
+	return contextError(parent, p.summarize(r.results))
+}
+
+// batches splits the targets into the batches they're rolled out in, as the
+// start and end of each, with the canary in a batch of its own when there is one.
+func (p *Plugin) batches(total int) [][2]int {
+	batches := [][2]int{}
+	start := 0
+
+	if p.Canary && total > 1 {
+		batches = append(batches, [2]int{0, 1})
+		start = 1
+	}
+
+	size := p.BatchSize.Of(total)
+	if size <= 0 {
+		size = total
+	}
+
+	for ; start < total; start += size {
+		batches = append(batches, [2]int{start, min(start+size, total)})
+	}
+
+	if len(batches) > 1 {
+		logrus.Infof("rolling out to %d targets in %d batches", total, len(batches))
+	}
+
+	return batches
+}
+
+// continueRollout checks whether the rollout should go on to the next batch once the last
+// one has finished, which it doesn't when the canary failed, more of the targets have failed
+// than MaxFailures allows or the context is done. It pauses for BatchPause before going on.
+func (p *Plugin) continueRollout(ctx context.Context, r *rollout) bool {
+	switch {
+	case ctx.Err() != nil:
+		return false
+	case p.Canary && r.results[0].code != 0:
+		logrus.Errorf("stopping the rollout since the canary %s failed", r.results[0].name)
+		return false
+	case p.MaxFailures.Exceeded(r.failed, len(r.targets)):
+		logrus.Errorf("stopping the rollout after failing on %d of %d targets, which is more than the %s allowed",
+			r.failed, len(r.targets), p.MaxFailures)
+		return false
+	}
+
+	if p.BatchPause <= 0 {
+		return true
+	}
+
+	logrus.Infof("pausing for %s before the next batch", p.BatchPause)
+
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(p.BatchPause):
+		return true
+	}
+}
+
+// execBatch executes the targets from start up to end, at most Parallelism of them at once.
+func (p *Plugin) execBatch(ctx context.Context, r *rollout, start, end int) {
+	parallelism := p.Parallelism
+	if parallelism <= 0 || parallelism > end-start {
+		parallelism = end - start
+	}
+
+	logrus.Infof("executing on %d targets, %d at a time", end-start, parallelism)
+
+	slots := make(chan struct{}, parallelism)
+
+	var wg sync.WaitGroup
+
+	for i := start; i < end; i++ {
+		if ctx.Err() != nil {
+			continue
+		}
+
+		select {
+		case <-ctx.Done():
+			continue
+		case slots <- struct{}{}:
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer func() {
+				<-slots
+				wg.Done()
+			}()
+
+			result := p.execTarget(ctx, r.targets[i])
+
+			r.mu.Lock()
+			defer r.mu.Unlock()
+
+			r.results[i] = result
+
+			if result.code == 0 {
+				return
+			}
+
+			r.failed++
+
+			if p.FailFast && ctx.Err() == nil && p.MaxFailures.Exceeded(r.failed, len(r.targets)) {
+				logrus.Errorf("stopping after failing on %d of %d targets, which is more than the %s allowed",
+					r.failed, len(r.targets), p.MaxFailures)
+				r.stop()
+			}
+		}()
+	}
+
+	wg.Wait()
+}
+
+// execTarget executes a single target with the same settings as the plugin,
+// other than the Timeout which applies to all of the targets together.
+func (p *Plugin) execTarget(ctx context.Context, target Target) targetResult {
+	plugin := &Plugin{
+		ExecStyle:       p.ExecStyle,
+		PluginConfig:    target.PluginConfig,
+		TailLines:       p.TailLines,
+		KillGracePeriod: p.KillGracePeriod,
+		target:          target.Name,
+	}
+
+	start := time.Now()
+	err := plugin.execute(ctx)
+
+	if err != nil {
+		logrus.Errorf("%s%s", plugin.prefix(), err)
+	}
+
+	return targetResult{
+		name:     target.Name,
+		ran:      true,
+		code:     ExitCode(err),
+		duration: time.Since(start),
+	}
+}
+
+// summarize logs how each of the targets went and returns an
+// error if more of them failed than MaxFailures allows.
+func (p *Plugin) summarize(results []targetResult) error {
+	var (
+		summary bytes.Buffer
+		failed  []string
+	)
+
+	table := tabwriter.NewWriter(&summary, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(table, "TARGET\tRESULT\tEXIT CODE\tDURATION")
+
+	for _, result := range results {
+		switch {
+		case !result.ran:
+			failed = append(failed, result.name)
+			fmt.Fprintf(table, "%s\tnot run\t-\t-\n", result.name)
+		case result.code != 0:
+			failed = append(failed, result.name)
+			fmt.Fprintf(table, "%s\tfailed\t%d\t%s\n", result.name, result.code, result.duration.Round(time.Millisecond))
+		default:
+			fmt.Fprintf(table, "%s\tok\t%d\t%s\n", result.name, result.code, result.duration.Round(time.Millisecond))
+		}
+	}
+
+	_ = table.Flush()
+
+	for _, line := range strings.Split(strings.TrimSuffix(summary.String(), "\n"), "\n") {
+		logrus.Info(line)
+	}
+
+	if len(failed) == 0 {
+		return nil
+	}
+
+	if !p.MaxFailures.Exceeded(len(failed), len(results)) {
+		logrus.Warnf("failed on %d of %d targets, which is within the %s allowed: %s",
+			len(failed), len(results), p.MaxFailures, strings.Join(failed, ", "))
+
+		return nil
+	}
+
+	return fmt.Errorf("%w: %d of %d failed: %s", ErrTargets, len(failed), len(results), strings.Join(failed, ", "))
+}
+
+// prefix returns what each line of output from the binary is prefixed with,
+// which is the name of the target when fanning out and nothing otherwise.
+func (p *Plugin) prefix() string {
+	if p.target == "" {
+		return ""
+	}
+
+	return "[" + p.target + "] "
+}
+
+// prefixLines puts the prefix in front of every line of the output.
+func (p *Plugin) prefixLines(output string) string {
+	if p.target == "" {
+		return output
+	}
+
+	lines := strings.Split(strings.TrimSuffix(output, "\n"), "\n")
+	for i, line := range lines {
+		lines[i] = p.prefix() + line
+	}
+
+	return strings.Join(lines, "\n")
+}
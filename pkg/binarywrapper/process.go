@@ -0,0 +1,68 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package binarywrapper
+
+import (
+	"errors"
+	"os/exec"
+	"syscall"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultKillGracePeriod is how long a binary is given to exit after being
+// sent SIGTERM before the whole process group is sent SIGKILL instead.
+const DefaultKillGracePeriod = 10 * time.Second
+
+// setKillPolicy places the command in its own process group and arranges for the
+// whole group to be terminated when the command's context is done. Wrapped binaries
+// like sshpass spawn children of their own (ssh) so signaling only the direct child
+// would leave those behind. The group is sent SIGTERM first and, if anything in it
+// is still around after the grace period, SIGKILL. The returned function stops that
+// from happening and has to be called once the command has been waited on, otherwise
+// the group could be killed after its id has been given to some other process.
+func setKillPolicy(cmd *exec.Cmd, grace time.Duration) (stop func()) {
+	if grace <= 0 {
+		grace = DefaultKillGracePeriod
+	}
+
+	// Wait doesn't return until Cancel has, so the timer is never used concurrently.
+	var timer *time.Timer
+
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	cmd.Cancel = func() error {
+		// A negative pid signals every process in the group
+		// that the child is the leader of rather than just the child.
+		pgid := -cmd.Process.Pid
+
+		logrus.Warnf("terminating %s, will be killed if still running in %s", cmd.Path, grace)
+
+		if err := syscall.Kill(pgid, syscall.SIGTERM); err != nil {
+			if errors.Is(err, syscall.ESRCH) {
+				return nil
+			}
+
+			return err
+		}
+
+		timer = time.AfterFunc(grace, func() {
+			if err := syscall.Kill(pgid, syscall.SIGKILL); err == nil {
+				logrus.Warnf("killed %s after it ignored termination for %s", cmd.Path, grace)
+			}
+		})
+
+		return nil
+	}
+
+	// Grandchildren that outlive the child can keep the output pipes open which
+	// would block waiting forever, so give up on them once they should be dead.
+	cmd.WaitDelay = grace + time.Second
+
+	return func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
@@ -0,0 +1,240 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package binarywrapper
+
+import (
+	"encoding/base64"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	// RedactedText replaces every secret found in the logs.
+	RedactedText = "[REDACTED]"
+
+	// minRedactionLength is the shortest line or base64 encoding of a secret that'll be
+	// redacted on its own. Anything shorter would mangle so much unrelated output that
+	// the logs would become useless. Secrets themselves are redacted whatever their length.
+	minRedactionLength = 8
+
+	// minLineRedactionLength is the shortest line of a multi-line secret that'll be
+	// redacted on its own regardless of what it looks like. Shorter lines are only
+	// redacted when they look random, since secret files like ssh configs are full
+	// of short lines that show up in all sorts of unrelated output.
+	minLineRedactionLength = 32
+
+	// minLineEntropy is the Shannon entropy, in bits per byte, that a short line
+	// without any whitespace needs to look random enough to be redacted.
+	minLineEntropy = 3.0
+)
+
+// Redactor can optionally be implemented by a PluginConfig that handles secrets
+// which must never show up in the logs, whether logged by the plugin itself or
+// output by the binary. It's checked before Validate and again after Setup.
+type Redactor interface {
+
+	// Redactions should return the raw values of every secret the plugin knows of,
+	// which are redacted no matter how short they are. The lines of multi-line secrets that are long or look random are also redacted
+	// on their own, and the base64 encodings of each secret are redacted alongside
+	// the secret itself.
+	Redactions() []string
+}
+
+// redactions is the set of every secret registered with the logger for this
+// process. Secrets are never removed since there's no telling if something
+// holding onto one might still try logging it.
+var redactions = &redactionHook{secrets: map[string]struct{}{}}
+
+// AddRedactions will mask all of the given secrets, along with their individual lines
+// and base64 encodings, in everything logged through the standard logrus logger.
+func AddRedactions(secrets ...string) {
+	redactions.add(secrets...)
+}
+
+// redactionHook is a logrus hook that masks secrets in the message and fields of
+// every entry before it is formatted, so even multi-line secrets that a formatter
+// would escape or quote are still caught.
+type redactionHook struct {
+	mu       sync.RWMutex
+	once     sync.Once
+	secrets  map[string]struct{}
+	replacer *strings.Replacer
+	longest  int
+}
+
+// add registers the secrets and all of their variants, and makes sure
+// the hook is installed on the standard logger the first time around.
+func (h *redactionHook) add(secrets ...string) {
+	h.once.Do(func() {
+		logrus.AddHook(h)
+	})
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	changed := false
+
+	for _, secret := range secrets {
+		for _, variant := range redactionVariants(secret) {
+			if _, ok := h.secrets[variant]; !ok {
+				h.secrets[variant] = struct{}{}
+				h.longest = max(h.longest, len(variant))
+				changed = true
+			}
+		}
+	}
+
+	if !changed {
+		return
+	}
+
+	// Longer secrets go first so that a secret which happens to contain
+	// another one is replaced whole rather than leaving pieces behind.
+	sorted := make([]string, 0, len(h.secrets))
+	for secret := range h.secrets {
+		sorted = append(sorted, secret)
+	}
+
+	sort.Slice(sorted, func(i, j int) bool {
+		if len(sorted[i]) != len(sorted[j]) {
+			return len(sorted[i]) > len(sorted[j])
+		}
+
+		return sorted[i] < sorted[j]
+	})
+
+	pairs := make([]string, 0, len(sorted)*2)
+	for _, secret := range sorted {
+		pairs = append(pairs, secret, RedactedText)
+	}
+
+	h.replacer = strings.NewReplacer(pairs...)
+}
+
+// Redact returns the string with every registered secret masked.
+func (h *redactionHook) Redact(s string) string {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	if h.replacer == nil {
+		return s
+	}
+
+	return h.replacer.Replace(s)
+}
+
+// Longest returns the length of the longest registered secret.
+func (h *redactionHook) Longest() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+
+	return h.longest
+}
+
+// Levels implements logrus.Hook for every log level.
+func (h *redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements logrus.Hook by masking secrets in the entry's message and fields.
+func (h *redactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.Redact(entry.Message)
+
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			entry.Data[key] = h.Redact(v)
+		case []string:
+			redacted := make([]string, len(v))
+			for i, s := range v {
+				redacted[i] = h.Redact(s)
+			}
+
+			entry.Data[key] = redacted
+		case error:
+			entry.Data[key] = h.Redact(v.Error())
+		case fmt.Stringer:
+			entry.Data[key] = h.Redact(v.String())
+		}
+	}
+
+	return nil
+}
+
+// redactionVariants returns all of the forms a secret might show up in the logs as.
+func redactionVariants(secret string) []string {
+	trimmed := strings.TrimSpace(secret)
+	if trimmed == "" {
+		return nil
+	}
+
+	variants := []string{secret, trimmed}
+
+	var candidates []string
+
+	// Multi-line secrets, like identity files, are likely to be logged a line
+	// at a time by the binary, so the lines carrying the secret bits are redacted
+	// on their own too. The armor lines of PEM blocks aren't secret and are left alone.
+	if strings.Contains(trimmed, "\n") {
+		for _, line := range strings.Split(trimmed, "\n") {
+			line = strings.TrimSpace(line)
+			if !strings.HasPrefix(line, "-----") && secretLine(line) {
+				candidates = append(candidates, line)
+			}
+		}
+	}
+
+	for _, encoding := range []*base64.Encoding{
+		base64.StdEncoding,
+		base64.URLEncoding,
+		base64.RawStdEncoding,
+		base64.RawURLEncoding,
+	} {
+		candidates = append(candidates, encoding.EncodeToString([]byte(trimmed)))
+	}
+
+	for _, candidate := range candidates {
+		if len(candidate) >= minRedactionLength {
+			variants = append(variants, candidate)
+		}
+	}
+
+	return variants
+}
+
+// secretLine reports whether a line of a multi-line secret is worth redacting on its own,
+// which it is when it's long or a single word that looks random, like the base64 lines
+// of an identity file.
+func secretLine(line string) bool {
+	if len(line) >= minLineRedactionLength {
+		return true
+	}
+
+	if strings.ContainsAny(line, " \t") {
+		return false
+	}
+
+	return entropy(line) >= minLineEntropy
+}
+
+// entropy returns the Shannon entropy of the string in bits per byte.
+func entropy(s string) float64 {
+	counts := map[byte]int{}
+	for i := 0; i < len(s); i++ {
+		counts[s[i]]++
+	}
+
+	bits := 0.0
+
+	for _, count := range counts {
+		p := float64(count) / float64(len(s))
+		bits -= p * math.Log2(p)
+	}
+
+	return bits
+}
@@ -0,0 +1,78 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package binarywrapper
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Runner can optionally be implemented by a PluginConfig that is able to do all of its
+// work in process rather than by handing off to a binary. It's only used by InProcess.
+type Runner interface {
+
+	// Run is responsible for doing the work of the plugin, writing any output to the
+	// given stdout and stderr, and returning as soon as possible once the context is done.
+	// Errors with an ExitStatus() int method are reported as an ExecError with that code.
+	Run(ctx context.Context, stdout, stderr io.Writer) error
+}
+
+// exitStatuser matches the errors runners can return to report an exit code, like
+// the ExitError from golang.org/x/crypto/ssh for the status of a remote command.
+type exitStatuser interface {
+	ExitStatus() int
+}
+
+// execRunner runs the plugin configuration in process with its output
+// streamed to the logs just like the output of a subprocess would be.
+func (p *Plugin) execRunner(ctx context.Context, runner Runner) error {
+	var mu sync.Mutex
+
+	tail := newTailBuffer(p.TailLines)
+	stdout := &lineLogger{mu: &mu, level: logrus.InfoLevel, tail: tail, prefix: p.prefix()}
+	stderr := &lineLogger{mu: &mu, level: logrus.ErrorLevel, tail: tail, prefix: p.prefix()}
+
+	out, errOut := p.watch(stdout, stderr)
+
+	start := time.Now()
+	err := contextError(ctx, runner.Run(ctx, out, errOut))
+	code := runnerExitCode(ctx, err)
+
+	p.done(code)
+
+	stdout.Flush()
+	stderr.Flush()
+
+	if err == nil {
+		return nil
+	}
+
+	return &ExecError{
+		Code:     code,
+		Duration: time.Since(start),
+		Tail:     tail.Lines(),
+		Err:      err,
+	}
+}
+
+// runnerExitCode returns the exit code for how the runner finished, which is the code
+// it reported, 1 if it failed without one, or -1 if it was stopped by the context.
+func runnerExitCode(ctx context.Context, err error) int {
+	var status exitStatuser
+
+	switch {
+	case err == nil:
+		return 0
+	case errors.As(err, &status):
+		return status.ExitStatus()
+	case ctx.Err() == nil:
+		return 1
+	default:
+		return -1
+	}
+}
@@ -0,0 +1,141 @@
+// SPDX-License-Identifier: Apache-2.0
+
+package binarywrapper
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxLineLength is the most we'll hold on to for a single line of output
+// before flushing it to the logs anyways. Binaries that spew huge amounts
+// of output without any newlines shouldn't be able to eat all of our memory.
+const maxLineLength = 64 * 1024
+
+// lineLogger is an io.Writer that splits whatever is written to it into lines
+// and logs each one as soon as it's complete instead of waiting for the binary
+// to finish. A stdout and stderr lineLogger should share the same mutex so that
+// their lines are logged in the order they arrive and never interleave mid-line.
+// Each line is logged with the prefix in front of it, which names the target
+// the output came from when fanning out.
+type lineLogger struct {
+	mu     *sync.Mutex
+	level  logrus.Level
+	tail   *tailBuffer
+	prefix string
+	buf    []byte
+}
+
+// Write implements io.Writer by logging every complete line
+// and holding onto any trailing partial line for the next write.
+func (l *lineLogger) Write(p []byte) (int, error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.buf = append(l.buf, p...)
+
+	for {
+		i := bytes.IndexByte(l.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		l.emit(l.buf[:i])
+		l.buf = l.buf[i+1:]
+	}
+
+	// A secret could straddle where the line is split, so secrets are masked
+	// before splitting it and whatever might be the start of one is held onto
+	// until the next write, in case the rest of the secret comes along with it.
+	for len(l.buf) >= maxLineLength {
+		l.buf = []byte(redactions.Redact(string(l.buf)))
+
+		held := min(redactions.Longest()-1, maxLineLength/2)
+		end := min(maxLineLength, len(l.buf)-max(held, 0))
+
+		l.emit(l.buf[:end])
+		l.buf = l.buf[end:]
+	}
+
+	return len(p), nil
+}
+
+// Flush logs any partial line still being held, which
+// happens when output doesn't end with a trailing newline.
+func (l *lineLogger) Flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if len(l.buf) > 0 {
+		l.emit(l.buf)
+		l.buf = nil
+	}
+}
+
+// emit logs a single line and records it in the tail if one is kept.
+// Lines longer than maxLineLength are redacted as a whole and then logged
+// in chunks of at most that length, so each one is prefixed like any other
+// line without a secret being split between them.
+// Callers are expected to already be holding the mutex.
+func (l *lineLogger) emit(line []byte) {
+	if len(line) > maxLineLength {
+		line = []byte(redactions.Redact(string(line)))
+	}
+
+	for len(line) > maxLineLength {
+		l.emit(line[:maxLineLength])
+		line = line[maxLineLength:]
+	}
+
+	text := string(bytes.TrimSuffix(line, []byte("\r")))
+
+	logrus.StandardLogger().Log(l.level, l.prefix+text)
+
+	if l.tail != nil {
+		l.tail.add(text)
+	}
+}
+
+// tailBuffer is a fixed size ring buffer holding the last lines of
+// output so they can be included when reporting on a failed execution.
+// It is not safe for concurrent use on its own, the lineLogger mutex guards it.
+type tailBuffer struct {
+	lines []string
+	next  int
+	full  bool
+}
+
+// newTailBuffer returns a tailBuffer holding at most size lines,
+// or nil if no lines should be kept at all.
+func newTailBuffer(size int) *tailBuffer {
+	if size <= 0 {
+		return nil
+	}
+
+	return &tailBuffer{lines: make([]string, size)}
+}
+
+// add records a line, dropping the oldest line once the buffer is full.
+func (t *tailBuffer) add(line string) {
+	t.lines[t.next] = line
+	t.next = (t.next + 1) % len(t.lines)
+
+	if t.next == 0 {
+		t.full = true
+	}
+}
+
+// Lines returns the retained lines from oldest to newest.
+func (t *tailBuffer) Lines() []string {
+	if t == nil {
+		return nil
+	}
+
+	if !t.full {
+		return append([]string{}, t.lines[:t.next]...)
+	}
+
+	return append(append([]string{}, t.lines[t.next:]...), t.lines[:t.next]...)
+}